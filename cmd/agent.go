@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/goodieshq/cfdns/pkg/agent"
+	"github.com/goodieshq/cfdns/pkg/cf"
+	"github.com/goodieshq/cfdns/pkg/config"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// startAgentServer serves the agent report endpoint until the context is cancelled
+func startAgentServer(ctx context.Context, cfdns *cf.CFDNS, cfg config.AgentServer) (*agent.Server, error) {
+	tlsConfig, err := agent.NewTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	server := agent.NewServer(cfdns, cfg)
+	httpServer := &http.Server{
+		Handler:           server,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		err := httpServer.ServeTLS(listener, cfg.CertFile, cfg.KeyFile)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Str("listen", cfg.Listen).Msg("agent server failed")
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	log.Info().Str("listen", cfg.Listen).Bool("mtls", cfg.ClientCA != "").Msg("Serving agent reports")
+	return server, nil
+}
+
+// reporter detects the addresses of the host and reports them to the server
+type reporter struct {
+	cfg      *config.AgentConfig
+	detector *cf.Detector
+	client   *agent.Client
+}
+
+// newReporter creates the detector and report client of an agent configuration
+func newReporter(cfg *config.AgentConfig) (*reporter, error) {
+	client, err := agent.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	detector, err := cf.NewDetector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &reporter{cfg: cfg, detector: detector, client: client}, nil
+}
+
+// report runs one detection and report cycle and returns its exit code
+func (r *reporter) report(ctx context.Context) int {
+	var addresses []string
+	ipv4, ipv6 := r.detector.Lookup(ctx, *r.cfg.IPv4, *r.cfg.IPv6)
+	for _, address := range []string{ipv4, ipv6} {
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) == 0 {
+		log.Error().Msg("no public address detected, skipping report")
+		return EXIT_ERROR
+	}
+
+	resp, err := r.client.Report(ctx, addresses)
+	if err != nil {
+		log.Error().Err(err).Strs("addresses", addresses).Msg("failed to report addresses")
+		return EXIT_ERROR
+	}
+
+	for _, result := range resp.Results {
+		logger := log.With().Str("hostname", result.Hostname).Strs("addresses", addresses).Logger()
+		switch result.Status {
+		case agent.STATUS_UPDATED:
+			logger.Info().Msg("hostname updated")
+		case agent.STATUS_UNCHANGED:
+			logger.Debug().Msg("hostname unchanged")
+		default:
+			logger.Error().Str("error", result.Error).Msg("hostname could not be updated")
+		}
+	}
+
+	switch {
+	case len(resp.Failed()) > 0:
+		return EXIT_ERROR
+	case resp.Changed():
+		return EXIT_CHANGED
+	default:
+		return EXIT_OK
+	}
+}
+
+// runAgent reports the detected addresses of the host to the central server every cycle, or once,
+// and returns the exit code
+func runAgent(ctx context.Context, info *CLIFlags) int {
+	cfg, err := config.LoadAgentConfig(info.ConfigFile)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to load agent config file")
+		return EXIT_ERROR
+	}
+	setLogLevel(cfg.Verbose)
+
+	r, err := newReporter(cfg)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create agent")
+		return EXIT_ERROR
+	}
+	defer func() { r.detector.Close() }() // r is replaced on reload
+
+	log.Info().Str("server", cfg.Server).Str("name", cfg.Name).Msg("Reporting addresses as agent")
+	if info.Once {
+		return r.report(ctx)
+	}
+
+	// create a file watcher for the config file to signal changes
+	watcher := watchFile(ctx, info.ConfigFile)
+
+	for {
+		r.report(ctx)
+
+		timer := time.NewTimer(r.cfg.Frequency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Info().Msg("Agent stopped. Exiting.")
+			return EXIT_OK
+		case <-timer.C:
+			continue
+		case _, ok := <-watcher:
+			timer.Stop()
+			if !ok {
+				watcher = nil
+				continue
+			}
+
+			log.Info().Msg("Configuration file changed, reloading...")
+			cfgNew, err := config.LoadAgentConfig(info.ConfigFile)
+			if err != nil {
+				log.Error().Err(err).Msg("failed to reload agent config file, keeping existing configuration")
+				continue
+			}
+			rNew, err := newReporter(cfgNew)
+			if err != nil {
+				log.Error().Err(err).Msg("failed to apply new agent configuration, keeping existing configuration")
+				continue
+			}
+			r.detector.Close()
+			r = rNew
+			setLogLevel(cfgNew.Verbose)
+			log.Info().Msg("Configuration reloaded successfully.")
+		}
+	}
+}
+
+// setLogLevel enables debug logging in verbose mode
+func setLogLevel(verbose bool) {
+	if verbose {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+}
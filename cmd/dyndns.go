@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/goodieshq/cfdns/pkg/cf"
+	"github.com/goodieshq/cfdns/pkg/config"
+	"github.com/goodieshq/cfdns/pkg/dyndns"
+	"github.com/rs/zerolog/log"
+)
+
+// startDynDNS serves the dyndns2 update endpoint until the context is cancelled
+func startDynDNS(ctx context.Context, cfdns *cf.CFDNS, cfg config.DynDNS) (*dyndns.Server, error) {
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	server := dyndns.NewServer(cfdns, cfg)
+	httpServer := &http.Server{
+		Handler:           server,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		var err error
+		if cfg.CertFile != "" {
+			err = httpServer.ServeTLS(listener, cfg.CertFile, cfg.KeyFile)
+		} else {
+			err = httpServer.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Str("listen", cfg.Listen).Msg("dyndns server failed")
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	log.Info().Str("listen", cfg.Listen).Bool("tls", cfg.CertFile != "").Msg("Serving dyndns2 updates")
+	return server, nil
+}
@@ -9,8 +9,10 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/goodieshq/cfdns/pkg/agent"
 	"github.com/goodieshq/cfdns/pkg/cf"
 	"github.com/goodieshq/cfdns/pkg/config"
+	"github.com/goodieshq/cfdns/pkg/dyndns"
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -18,8 +20,15 @@ import (
 
 const VERSION = "0.3.1"
 
+const EXIT_OK = 0      // single run completed without changes
+const EXIT_ERROR = 1   // single run failed, or some domains or zones could not be processed
+const EXIT_CHANGED = 2 // single run applied changes, or found pending changes in a dry run
+
 type CLIFlags struct {
 	ConfigFile string
+	DryRun     bool
+	Once       bool
+	Agent      bool
 }
 
 func init() {
@@ -35,25 +44,55 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	// report the addresses of this host to a central cfdns server instead of updating records
+	if info.Agent {
+		os.Exit(runAgent(ctx, info))
+	}
+
 	// load the initial configuration from the YAML file
 	cfg, err := config.LoadConfig(info.ConfigFile)
 	if err != nil {
+		if info.Once || info.DryRun {
+			log.Error().Err(err).Msg("failed to load config file")
+			os.Exit(EXIT_ERROR)
+		}
 		log.Fatal().Err(err).Msg("failed to load config file")
 	}
 
 	// set the initial logging level based on config
-	if cfg.Verbose {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	} else {
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	}
+	setLogLevel(cfg.Verbose)
 
 	// Create the cfdns instance
 	cfdns, err := cf.NewCFDNS(*cfg)
 	if err != nil {
+		if info.Once || info.DryRun {
+			log.Error().Err(err).Msg("failed to create cfdns instance")
+			os.Exit(EXIT_ERROR)
+		}
 		log.Fatal().Err(err).Msg("failed to create cfdns instance")
 	}
 
+	// run a single cycle, or print the pending changes without applying them, and exit
+	if info.Once || info.DryRun {
+		os.Exit(runOnce(ctx, cfdns, info.DryRun))
+	}
+
+	// serve the dyndns2 update endpoint, so routers push the addresses of their hostnames
+	var dyndnsServer *dyndns.Server
+	if cfg.DynDNS.Listen != "" {
+		if dyndnsServer, err = startDynDNS(ctx, cfdns, cfg.DynDNS); err != nil {
+			log.Fatal().Err(err).Msg("failed to start dyndns server")
+		}
+	}
+
+	// serve the agent report endpoint, so remote hosts report their addresses without credentials
+	var agentServer *agent.Server
+	if cfg.AgentServer.Listen != "" {
+		if agentServer, err = startAgentServer(ctx, cfdns, cfg.AgentServer); err != nil {
+			log.Fatal().Err(err).Msg("failed to start agent server")
+		}
+	}
+
 	// create a file watcher for the config file to signal changes
 	watcher := watchFile(ctx, info.ConfigFile)
 
@@ -71,9 +110,13 @@ func main() {
 
 		tStart := time.Now()
 		log.Debug().Msg("Starting CFDNS processing cycle.")
-		cfdns.Process(ctx)
+		report := cfdns.Process(ctx)
 		cfdns.Wait()
-		log.Info().Str("duration", Dur(time.Since(tStart))).Msg("Completed CFDNS processing cycle.")
+		log.Info().
+			Str("duration", Dur(time.Since(tStart))).
+			Int("changes", len(report.Changes)).
+			Int("failed", len(report.Failed())+len(report.Errors)).
+			Msg("Completed CFDNS processing cycle.")
 
 		// wait for the next cycle, config file modification, or shutdown signal
 		select {
@@ -109,12 +152,39 @@ func main() {
 				continue
 			}
 
-			// update logging level based on new config
-			if cfg.Verbose {
-				zerolog.SetGlobalLevel(zerolog.DebugLevel)
-			} else {
-				zerolog.SetGlobalLevel(zerolog.InfoLevel)
+			// users are reloaded in place, a new listen address requires a restart
+			switch {
+			case dyndnsServer == nil && cfgNew.DynDNS.Listen != "":
+				if dyndnsServer, err = startDynDNS(ctx, cfdns, cfgNew.DynDNS); err != nil {
+					log.Error().Err(err).Msg("failed to start dyndns server")
+				}
+			case dyndnsServer != nil:
+				if cfgNew.DynDNS.Listen != cfg.DynDNS.Listen || cfgNew.DynDNS.CertFile != cfg.DynDNS.CertFile {
+					log.Warn().Msg("dyndns listen address or certificate changed, restart cfdns to apply")
+				}
+				dyndnsServer.SetConfig(cfgNew.DynDNS)
 			}
+
+			// agents are reloaded in place, new listen or TLS settings require a restart
+			switch {
+			case agentServer == nil && cfgNew.AgentServer.Listen != "":
+				if agentServer, err = startAgentServer(ctx, cfdns, cfgNew.AgentServer); err != nil {
+					log.Error().Err(err).Msg("failed to start agent server")
+				}
+			case agentServer != nil:
+				if cfgNew.AgentServer.Listen != cfg.AgentServer.Listen ||
+					cfgNew.AgentServer.CertFile != cfg.AgentServer.CertFile ||
+					cfgNew.AgentServer.ClientCA != cfg.AgentServer.ClientCA {
+					log.Warn().Msg("agent server listen address or certificates changed, restart cfdns to apply")
+				}
+				agentServer.SetConfig(cfgNew.AgentServer)
+			}
+
+			// keep the new configuration for the frequency of the next cycle
+			cfg = cfgNew
+
+			// update logging level based on new config
+			setLogLevel(cfg.Verbose)
 			log.Info().Msg("Configuration reloaded successfully.")
 		}
 	}
@@ -122,13 +192,36 @@ func main() {
 
 func cli() *CLIFlags {
 	var cliFlags CLIFlags
+
+	// the plan subcommand is a dry run, the once subcommand a single run, the agent subcommand
+	// reports the addresses of this host to a cfdns server
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "plan":
+			cliFlags.DryRun = true
+			args = args[1:]
+		case "once":
+			cliFlags.Once = true
+			args = args[1:]
+		case "agent":
+			cliFlags.Agent = true
+			args = args[1:]
+		}
+	}
+
 	flag.StringVar(&cliFlags.ConfigFile, "config", "", "Configuration File")
 	flag.StringVar(&cliFlags.ConfigFile, "c", "", "Configuration File (alias)")
-	flag.Parse()
+	flag.BoolVar(&cliFlags.DryRun, "dry-run", cliFlags.DryRun, "Print the pending changes without applying them, exit code 2 if there are any")
+	flag.BoolVar(&cliFlags.Once, "once", cliFlags.Once, "Run a single cycle and exit: 0 = no changes, 2 = changes applied, 1 = errors")
+	flag.CommandLine.Parse(args)
 
 	if cliFlags.ConfigFile == "" {
 		log.Fatal().Msg("configuration file is required, use -config/-c to specify the file")
 	}
+	if cliFlags.Agent && cliFlags.DryRun {
+		log.Fatal().Msg("the agent does not support dry runs")
+	}
 
 	return &cliFlags
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/goodieshq/cfdns/pkg/cf"
+	"github.com/rs/zerolog/log"
+)
+
+// runOnce runs a single processing cycle, or a plan in dry-run mode, and returns the exit code
+func runOnce(ctx context.Context, cfdns *cf.CFDNS, dryRun bool) int {
+	defer cfdns.Close()
+
+	var report *cf.Report
+	if dryRun {
+		report = cfdns.Plan(ctx)
+		printPlan(os.Stdout, report.Changes)
+	} else {
+		report = cfdns.Process(ctx)
+		cfdns.Wait()
+	}
+
+	log.Info().
+		Str("duration", Dur(report.Duration)).
+		Int("changes", len(report.Changes)).
+		Bool("dry_run", dryRun).
+		Msg("Completed CFDNS single run.")
+
+	switch {
+	case report.Err() != nil:
+		log.Error().Err(report.Err()).Msg("some domains could not be processed")
+		return EXIT_ERROR
+	case report.Changed():
+		return EXIT_CHANGED
+	default:
+		return EXIT_OK
+	}
+}
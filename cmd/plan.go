@@ -0,0 +1,87 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/goodieshq/cfdns/pkg/cf"
+)
+
+// printPlan writes the changes as a diff grouped by zone, in the style of terraform plan
+func printPlan(w io.Writer, changes []cf.Change) {
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "No changes. DNS records are up to date.")
+		return
+	}
+
+	changes = slices.Clone(changes)
+	slices.SortStableFunc(changes, func(a, b cf.Change) int {
+		return cmp.Or(
+			cmp.Compare(a.Zone, b.Zone),
+			cmp.Compare(a.Hostname, b.Hostname),
+			cmp.Compare(a.Type, b.Type),
+		)
+	})
+
+	counts := make(map[string]int)
+	zone := ""
+	for i, change := range changes {
+		if i == 0 || change.Zone != zone {
+			zone = change.Zone
+			fmt.Fprintf(w, "\nzone %s:\n", zone)
+		}
+		counts[change.Action]++
+
+		switch change.Action {
+		case cf.OP_CREATE:
+			fmt.Fprintf(w, "  + %-4s %s\n", change.Type, change.Hostname)
+			printState(w, "+", nil, change.New)
+		case cf.OP_UPDATE:
+			fmt.Fprintf(w, "  ~ %-4s %s\n", change.Type, change.Hostname)
+			printState(w, "~", change.Old, change.New)
+		case cf.OP_DELETE:
+			fmt.Fprintf(w, "  - %-4s %s\n", change.Type, change.Hostname)
+			printState(w, "-", change.Old, nil)
+		}
+	}
+
+	fmt.Fprintf(w, "\nPlan: %d to create, %d to update, %d to delete.\n",
+		counts[cf.OP_CREATE], counts[cf.OP_UPDATE], counts[cf.OP_DELETE])
+}
+
+// printState writes the attributes of a record, showing old -> new for changed attributes of updates
+func printState(w io.Writer, symbol string, before, after *cf.RecordState) {
+	attr := func(name string, get func(*cf.RecordState) string) {
+		switch {
+		case before == nil:
+			fmt.Fprintf(w, "      %s %-8s = %s\n", symbol, name, get(after))
+		case after == nil:
+			fmt.Fprintf(w, "      %s %-8s = %s\n", symbol, name, get(before))
+		case get(before) != get(after):
+			fmt.Fprintf(w, "      %s %-8s = %s -> %s\n", symbol, name, get(before), get(after))
+		}
+	}
+
+	attr("content", func(s *cf.RecordState) string { return s.Content })
+	attr("proxied", func(s *cf.RecordState) string {
+		if s.Proxied == nil {
+			return "(unset)"
+		}
+		return fmt.Sprint(*s.Proxied)
+	})
+	attr("ttl", func(s *cf.RecordState) string {
+		if s.TTL <= 1 {
+			return "auto"
+		}
+		return fmt.Sprintf("%ds", s.TTL)
+	})
+	attr("comment", func(s *cf.RecordState) string { return fmt.Sprintf("%q", s.Comment) })
+	attr("tags", func(s *cf.RecordState) string {
+		tags := slices.Clone(s.Tags)
+		slices.Sort(tags)
+		return "[" + strings.Join(tags, ", ") + "]"
+	})
+}
@@ -0,0 +1,49 @@
+package agent
+
+const REPORT_PATH = "/v1/report" // path of the address report endpoint
+const MAX_REPORT_SIZE = 4096     // maximum size of a report request body
+const MAX_ADDRESSES = 2          // maximum number of addresses in one report, one per family
+
+const (
+	STATUS_UPDATED   = "updated"   // the records were updated to the reported addresses
+	STATUS_UNCHANGED = "unchanged" // the records already published the reported addresses
+	STATUS_FAILED    = "failed"    // the records could not be updated, the agent reports again next cycle
+)
+
+// ReportRequest carries the public addresses an agent detected
+type ReportRequest struct {
+	Addresses []string `json:"addresses"` // detected IPv4 and/or IPv6 address
+}
+
+// HostnameResult is the outcome of a report for one hostname of the agent
+type HostnameResult struct {
+	Hostname string `json:"hostname"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ReportResponse lists the outcome of a report for every hostname the agent is authorized for
+type ReportResponse struct {
+	Results []HostnameResult `json:"results"`
+}
+
+// Failed returns the hostnames which could not be updated
+func (r *ReportResponse) Failed() []string {
+	var failed []string
+	for _, result := range r.Results {
+		if result.Status == STATUS_FAILED {
+			failed = append(failed, result.Hostname)
+		}
+	}
+	return failed
+}
+
+// Changed returns whether any hostname was updated
+func (r *ReportResponse) Changed() bool {
+	for _, result := range r.Results {
+		if result.Status == STATUS_UPDATED {
+			return true
+		}
+	}
+	return false
+}
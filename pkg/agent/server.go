@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/goodieshq/cfdns/pkg/cf"
+	"github.com/goodieshq/cfdns/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// agent is a reporting agent with the hostnames it may update
+type agent struct {
+	key       [sha256.Size]byte // hash of the pre-shared key, compared in constant time
+	hasKey    bool              // whether the agent may authenticate with a key
+	hostnames []string          // hostnames the agent may update
+}
+
+// checkKey returns whether the key is the pre-shared key of the agent
+func (a agent) checkKey(key string) bool {
+	hash := sha256.Sum256([]byte(key))
+	return subtle.ConstantTimeCompare(hash[:], a.key[:]) == 1 && a.hasKey
+}
+
+// Server accepts the addresses cfdns agents detected on remote hosts and publishes them for the
+// hostnames each agent is authorized for, so only the server holds the provider credentials
+type Server struct {
+	cfdns *cf.CFDNS
+
+	mu     sync.RWMutex
+	agents map[string]agent // agents keyed by name
+}
+
+// NewServer creates a report server publishing reported addresses with the cfdns instance
+func NewServer(cfdns *cf.CFDNS, cfg config.AgentServer) *Server {
+	s := &Server{cfdns: cfdns}
+	s.SetConfig(cfg)
+	return s
+}
+
+// SetConfig replaces the agents of the server
+func (s *Server) SetConfig(cfg config.AgentServer) {
+	agents := make(map[string]agent, len(cfg.Agents))
+	for _, a := range cfg.Agents {
+		agents[a.Name] = agent{
+			key:       sha256.Sum256([]byte(a.Key)),
+			hasKey:    a.Key != "",
+			hostnames: a.Hostnames,
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.agents = agents
+}
+
+// NewTLSConfig returns the TLS settings of the report server, requesting client certificates signed
+// by the client CA if one is configured
+func NewTLSConfig(cfg config.AgentServer) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.ClientCA == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(cfg.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client_ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("client_ca %s contains no certificates", cfg.ClientCA)
+	}
+
+	// agents without a certificate may still authenticate with their key
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
+
+// authenticate returns the agent of the request, identified by the common name of its verified
+// client certificate or by its basic auth credentials
+func (s *Server) authenticate(r *http.Request) (string, agent, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		a, found := s.agents[name]
+		if !found {
+			return "", agent{}, false
+		}
+		// credentials sent along with the certificate must belong to the same agent
+		if user, key, ok := r.BasicAuth(); ok && (user != name || !a.checkKey(key)) {
+			return "", agent{}, false
+		}
+		return name, a, true
+	}
+
+	name, key, ok := r.BasicAuth()
+	if !ok {
+		return "", agent{}, false
+	}
+	a, found := s.agents[name]
+	if !a.checkKey(key) || !found {
+		return "", agent{}, false
+	}
+	return name, a, true
+}
+
+// ServeHTTP handles the address reports of agents, answering the outcome for each of their hostnames
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != REPORT_PATH {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, a, ok := s.authenticate(r)
+	if !ok {
+		log.Warn().Str("remote", r.RemoteAddr).Msg("agent report with invalid credentials")
+		http.Error(w, "invalid agent credentials", http.StatusUnauthorized)
+		return
+	}
+
+	var req ReportRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_REPORT_SIZE)).Decode(&req); err != nil {
+		http.Error(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Addresses) == 0 || len(req.Addresses) > MAX_ADDRESSES {
+		http.Error(w, fmt.Sprintf("report must contain 1 to %d addresses", MAX_ADDRESSES), http.StatusBadRequest)
+		return
+	}
+	// an agent has one public address per family, a second one would overwrite the first
+	var ipv4, ipv6 int
+	for _, address := range req.Addresses {
+		ip := net.ParseIP(address)
+		switch {
+		case ip == nil:
+			http.Error(w, fmt.Sprintf("invalid address %q", address), http.StatusBadRequest)
+			return
+		case ip.To4() != nil:
+			ipv4++
+		default:
+			ipv6++
+		}
+	}
+	if ipv4 > 1 || ipv6 > 1 {
+		http.Error(w, "report must contain at most one address per family", http.StatusBadRequest)
+		return
+	}
+	// addresses the detection settings reject are refused before any hostname is updated
+	for _, hostname := range a.hostnames {
+		if err := s.cfdns.CheckAddresses(hostname, req.Addresses); err != nil {
+			log.Warn().Err(err).Str("agent", name).Str("hostname", hostname).Msg("agent report with rejected address")
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	resp := ReportResponse{Results: make([]HostnameResult, 0, len(a.hostnames))}
+	for _, hostname := range a.hostnames {
+		resp.Results = append(resp.Results, s.update(r.Context(), name, hostname, req.Addresses))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// update publishes the reported addresses for one hostname of an agent
+func (s *Server) update(ctx context.Context, name, hostname string, addresses []string) HostnameResult {
+	logger := log.With().Str("agent", name).Str("hostname", hostname).Strs("addresses", addresses).Logger()
+	result := HostnameResult{Hostname: hostname}
+
+	// provider errors are only logged, agents learn that they should report again
+	report, err := s.cfdns.Push(ctx, hostname, addresses)
+	switch {
+	case err != nil:
+		logger.Error().Err(err).Msg("agent report failed")
+		result.Status, result.Error = STATUS_FAILED, "hostname could not be updated"
+	case report.Err() != nil:
+		logger.Error().Err(report.Err()).Msg("agent report failed")
+		result.Status, result.Error = STATUS_FAILED, "records could not be updated"
+	case report.Changed():
+		logger.Info().Msg("agent report applied")
+		result.Status = STATUS_UPDATED
+	default:
+		logger.Debug().Msg("agent report without changes")
+		result.Status = STATUS_UNCHANGED
+	}
+	return result
+}
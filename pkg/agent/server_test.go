@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goodieshq/cfdns/pkg/cf"
+	"github.com/goodieshq/cfdns/pkg/config"
+)
+
+// newTestServer creates a report server for agent host, publishing host.a.test in a memory zone and
+// rejecting addresses in 9.9.9.0/24
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "cfdns.yaml")
+	err := os.WriteFile(filename, []byte(`
+ipv4: true
+ipv6: true
+detection:
+  denied_cidrs: ["9.9.9.0/24"]
+zones:
+  - provider: memory
+    name: a.test
+    domains:
+      - hostname: host.a.test
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfdns, err := cf.NewCFDNS(*cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cfdns.Close)
+
+	return NewServer(cfdns, config.AgentServer{
+		Agents: []config.Agent{{Name: "host", Key: "secret", Hostnames: []string{"host.a.test"}}},
+	})
+}
+
+// report sends an address report with the agent's credentials and returns the recorded response
+func report(s *Server, key string, addresses ...string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(ReportRequest{Addresses: addresses})
+	r := httptest.NewRequest(http.MethodPost, REPORT_PATH, bytes.NewReader(body))
+	r.SetBasicAuth("host", key)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestServerReport(t *testing.T) {
+	s := newTestServer(t)
+
+	w := report(s, "secret", "1.1.1.1", "2606:4700::1111")
+	if w.Code != http.StatusOK {
+		t.Fatalf("ServeHTTP() status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var resp ReportResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 1 || resp.Results[0].Status != STATUS_UPDATED {
+		t.Errorf("ServeHTTP() results = %+v, want host.a.test updated", resp.Results)
+	}
+
+	if w := report(s, "wrong", "1.1.1.1"); w.Code != http.StatusUnauthorized {
+		t.Errorf("ServeHTTP() status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestServerReportRejected(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		name      string
+		addresses []string
+	}{
+		{"private IPv4 address", []string{"192.168.1.1"}},
+		{"documentation IPv6 address", []string{"1.1.1.1", "2001:db8::1"}},
+		{"denied address", []string{"9.9.9.9"}},
+	}
+	for _, tt := range tests {
+		if w := report(s, "secret", tt.addresses...); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("ServeHTTP() with %s status = %d, want %d", tt.name, w.Code, http.StatusUnprocessableEntity)
+		}
+	}
+}
+
+func TestServerReportInvalid(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		name      string
+		addresses []string
+	}{
+		{"no address", nil},
+		{"invalid address", []string{"not-an-ip"}},
+		{"too many addresses", []string{"198.51.100.1", "2001:db8::1", "198.51.100.2"}},
+		{"two IPv4 addresses", []string{"198.51.100.1", "198.51.100.2"}},
+		{"two IPv6 addresses", []string{"2001:db8::1", "2001:db8::2"}},
+		{"IPv4-mapped IPv6 address", []string{"198.51.100.1", "::ffff:198.51.100.2"}},
+	}
+	for _, tt := range tests {
+		if w := report(s, "secret", tt.addresses...); w.Code != http.StatusBadRequest {
+			t.Errorf("ServeHTTP() with %s status = %d, want %d", tt.name, w.Code, http.StatusBadRequest)
+		}
+	}
+}
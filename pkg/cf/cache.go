@@ -0,0 +1,116 @@
+package cf
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goodieshq/cfdns/pkg/provider"
+)
+
+// recordCache keeps the A, AAAA and TXT records of a zone in memory between cycles, so unchanged
+// domains need no API call. It is refreshed with a single listing of the zone once the resync
+// interval has passed or a change failed, which also catches records edited outside of cfdns.
+type recordCache struct {
+	mu      sync.Mutex
+	records map[string][]provider.Record // records keyed by type and name
+	synced  time.Time                    // time of the last listing, zero if a resync is due
+}
+
+// newRecordCache creates an empty cache, which is filled by the first sync
+func newRecordCache() *recordCache {
+	return &recordCache{records: make(map[string][]provider.Record)}
+}
+
+// cacheKey returns the key of the records with the given type and name
+func cacheKey(recordType, name string) string {
+	return recordType + "/" + strings.ToLower(name)
+}
+
+// sync lists every record of the zone if the cache is older than the interval. A failing listing
+// means the zone or its API token is not usable.
+func (c *recordCache) sync(ctx context.Context, z *zone, interval time.Duration) error {
+	c.mu.Lock()
+	fresh := !c.synced.IsZero() && time.Since(c.synced) < interval
+	c.mu.Unlock()
+	if fresh {
+		return nil
+	}
+
+	// types are filtered here to keep it to one listing
+	records, err := z.provider.ListRecords(ctx, z.ref())
+	if err != nil {
+		return err
+	}
+
+	cached := make(map[string][]provider.Record)
+	for _, record := range records {
+		switch record.Type {
+		case RECORD_TYPE_IPV4, RECORD_TYPE_IPV6, "TXT":
+			key := cacheKey(record.Type, record.Name)
+			cached[key] = append(cached[key], record)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records = cached
+	c.synced = time.Now()
+	return nil
+}
+
+// get returns the cached records with the given type and name
+func (c *recordCache) get(recordType, name string) []provider.Record {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.records[cacheKey(recordType, name)])
+}
+
+// list returns every cached record of the given type
+func (c *recordCache) list(recordType string) []provider.Record {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var records []provider.Record
+	for _, cached := range c.records {
+		if len(cached) > 0 && cached[0].Type == recordType {
+			records = append(records, cached...)
+		}
+	}
+	return records
+}
+
+// put adds a created or updated record to the cache, replacing the cached version with the same ID
+func (c *recordCache) put(record provider.Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(record.Type, record.Name)
+	cached := c.records[key]
+	if i := slices.IndexFunc(cached, func(r provider.Record) bool { return r.ID == record.ID }); i >= 0 {
+		cached[i] = record
+		return
+	}
+	c.records[key] = append(cached, record)
+}
+
+// remove deletes a record from the cache
+func (c *recordCache) remove(record provider.Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(record.Type, record.Name)
+	c.records[key] = slices.DeleteFunc(c.records[key], func(r provider.Record) bool { return r.ID == record.ID })
+	if len(c.records[key]) == 0 {
+		delete(c.records, key)
+	}
+}
+
+// invalidate makes the next sync list the zone again, e.g. after a change failed on a stale record
+func (c *recordCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.synced = time.Time{}
+}
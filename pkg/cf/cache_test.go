@@ -0,0 +1,149 @@
+package cf
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/goodieshq/cfdns/pkg/provider"
+)
+
+// countingProvider counts the listings of a memory provider and fails its writes on demand
+type countingProvider struct {
+	*provider.Memory
+	lists int
+	fail  bool
+}
+
+func (p *countingProvider) ListRecords(ctx context.Context, zone provider.Zone) ([]provider.Record, error) {
+	p.lists++
+	return p.Memory.ListRecords(ctx, zone)
+}
+
+func (p *countingProvider) CreateRecord(ctx context.Context, zone provider.Zone, record provider.Record) (provider.Record, error) {
+	if p.fail {
+		return record, errors.New("service unavailable")
+	}
+	return p.Memory.CreateRecord(ctx, zone, record)
+}
+
+func (p *countingProvider) UpdateRecord(ctx context.Context, zone provider.Zone, record provider.Record) (provider.Record, error) {
+	if p.fail {
+		return record, errors.New("service unavailable")
+	}
+	return p.Memory.UpdateRecord(ctx, zone, record)
+}
+
+// newCacheTestZone returns the test zone hosted by a counting provider, with an A record for host.a.test
+func newCacheTestZone(t *testing.T) (*zone, *countingProvider) {
+	t.Helper()
+	mem := provider.NewMemory(testZone)
+	seedRecord(t, mem, "A", "host.a.test", "198.51.100.1")
+	p := &countingProvider{Memory: mem}
+	return &zone{id: testZone.ID, name: testZone.Name, provider: p, cache: newRecordCache()}, p
+}
+
+// cachedContents returns the cached contents of the A records of a hostname
+func cachedContents(z *zone, name string) []string {
+	var contents []string
+	for _, record := range z.cache.get("A", name) {
+		contents = append(contents, record.Content)
+	}
+	return contents
+}
+
+func TestRecordCacheResync(t *testing.T) {
+	z, p := newCacheTestZone(t)
+	ctx := context.Background()
+
+	if err := z.cache.sync(ctx, z, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedContents(z, "HOST.a.test"); len(got) != 1 || got[0] != "198.51.100.1" {
+		t.Fatalf("cached records = %v, want [198.51.100.1]", got)
+	}
+
+	// records edited outside of cfdns are not seen before the interval has passed
+	seedRecord(t, p.Memory, "A", "other.a.test", "198.51.100.2")
+	if err := z.cache.sync(ctx, z, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if p.lists != 1 || len(cachedContents(z, "other.a.test")) != 0 {
+		t.Errorf("listings = %d, want 1 while the cache is fresh", p.lists)
+	}
+
+	// an expired cache lists the zone again
+	z.cache.synced = time.Now().Add(-2 * time.Minute)
+	if err := z.cache.sync(ctx, z, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if p.lists != 2 {
+		t.Errorf("listings = %d, want 2 after the interval", p.lists)
+	}
+	if got := cachedContents(z, "other.a.test"); len(got) != 1 {
+		t.Errorf("cached records = %v, want the record created outside of cfdns", got)
+	}
+}
+
+func TestRecordCacheWrites(t *testing.T) {
+	z, p := newCacheTestZone(t)
+	ctx := context.Background()
+	if err := z.cache.sync(ctx, z, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// successful writes are applied to the cache without listing the zone again
+	exec := newExecutor(false)
+	created, err := exec.create(ctx, z, provider.Record{Type: "A", Name: "new.a.test", Content: "198.51.100.2", TTL: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := z.cache.get("A", "host.a.test")[0]
+	updated := old
+	updated.Content = "198.51.100.3"
+	if _, err := exec.update(ctx, z, old, updated); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.delete(ctx, z, created); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.cache.sync(ctx, z, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if p.lists != 1 {
+		t.Errorf("listings = %d, want 1", p.lists)
+	}
+	if got := cachedContents(z, "host.a.test"); len(got) != 1 || got[0] != "198.51.100.3" {
+		t.Errorf("cached records = %v, want [198.51.100.3]", got)
+	}
+	if got := cachedContents(z, "new.a.test"); len(got) != 0 {
+		t.Errorf("cached records = %v, want the deleted record removed", got)
+	}
+
+	// dry runs leave the cache alone
+	if _, err := newExecutor(true).create(ctx, z, provider.Record{Type: "A", Name: "dry.a.test", Content: "198.51.100.4"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedContents(z, "dry.a.test"); len(got) != 0 {
+		t.Errorf("cached records = %v, want none after a dry run", got)
+	}
+
+	// a failed write means the cache may be stale, the next sync lists the zone again
+	p.fail = true
+	old = z.cache.get("A", "host.a.test")[0]
+	updated = old
+	updated.Content = "198.51.100.5"
+	if _, err := exec.update(ctx, z, old, updated); err == nil {
+		t.Fatal("update() = nil, want error")
+	}
+	if err := z.cache.sync(ctx, z, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if p.lists != 2 {
+		t.Errorf("listings = %d, want 2 after a failed write", p.lists)
+	}
+	if got := cachedContents(z, "host.a.test"); len(got) != 1 || got[0] != "198.51.100.3" {
+		t.Errorf("cached records = %v, want [198.51.100.3]", got)
+	}
+}
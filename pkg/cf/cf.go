@@ -2,13 +2,17 @@ package cf
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/cloudflare/cloudflare-go"
 	"github.com/goodieshq/cfdns/pkg/config"
 	"github.com/goodieshq/cfdns/pkg/ipget"
+	"github.com/goodieshq/cfdns/pkg/provider"
 	"github.com/goodieshq/goropo"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -19,19 +23,30 @@ const (
 	RECORD_TYPE_IPV6 = "AAAA"
 )
 
+const ZONE_RESOLVE_TIMEOUT = 30 * time.Second // upper bound of listing the zones of one provider, retries included
+
 type CFDNS struct {
-	mu         sync.RWMutex    // protects config, api, httpClient, pool
-	cfg        config.Config   // current configuration
-	api        *cloudflare.API // Cloudflare API client
-	httpClient http.Client     // shared HTTP client
-	timeout    time.Duration   // HTTP timeout duration
-	pool       *goropo.Pool    // worker pool for concurrent tasks
+	mu         sync.RWMutex              // protects config, zones, resolver, httpClient, pool, sources, registry
+	cfg        config.Config             // current configuration
+	zones      []*zone                   // resolved zones and their providers
+	resolver   *zoneResolver             // resolution of the configured zones, some may still be pending
+	resolveMu  sync.Mutex                // serializes retries of pending zone resolutions
+	httpClient *http.Client              // shared HTTP client
+	timeout    time.Duration             // HTTP timeout duration
+	pool       *goropo.Pool              // worker pool for concurrent tasks
+	sources    map[string]*addressSource // public address sources keyed by name
+	registry   *registry                 // ownership tracking of managed records
+	pushMu     sync.Mutex                // serializes pushed address updates
+	foreignMu  sync.Mutex                // protects foreign
+	foreign    map[string]struct{}       // records not owned by this instance already warned about, keyed by zone and record ID
 }
 
 // NewCFDNS creates a new Cloudflare DNS updater instance
 func NewCFDNS(cfg config.Config) (*CFDNS, error) {
 	cfdns := &CFDNS{}
-	cfdns.SetConfig(&cfg)
+	if err := cfdns.SetConfig(&cfg); err != nil {
+		return nil, err
+	}
 	return cfdns, nil
 }
 
@@ -65,20 +80,40 @@ func (cfdns *CFDNS) Wait() {
 
 func (cfdns *CFDNS) SetConfig(cfg *config.Config) error {
 	if cfg != nil {
-		cfdns.mu.Lock()
-		defer cfdns.mu.Unlock()
+		// create the DNS providers of the zones, API traffic is sent through the global binding
+		// all API clients share one transport, limiting the request rate of every worker together
+		httpClient := ipget.NewHTTPClient(newBinding(cfg.Bind), cfg.Timeout)
+		httpClient.Transport = provider.NewAPITransport(httpClient.Transport, cfg.RateLimit)
+		resolver, err := newZoneResolver(cfg, httpClient)
+		if err != nil {
+			return err
+		}
+
+		// zones which cannot be listed now are resolved again every cycle, only misplaced domains
+		// are rejected
+		lists, errs := resolver.list(context.Background(), ZONE_RESOLVE_TIMEOUT)
+		for _, err := range resolver.resolve(lists, errs) {
+			if errors.Is(err, errDomainOutsideZone) {
+				return err
+			}
+			log.Error().Err(err).Msg("unable to resolve zone, retrying next cycle")
+		}
 
-		// create a new cloudflare API client from the scoped token
-		api, err := cloudflare.NewWithAPIToken(cfg.Token)
+		// build the public IP detectors of every address source
+		sources, err := newAddressSources(cfg)
 		if err != nil {
 			return err
 		}
 
+		cfdns.mu.Lock()
+		defer cfdns.mu.Unlock()
+
 		// swap in the new config and resources
-		cfdns.api = api
-		cfdns.httpClient = http.Client{
-			Timeout: cfg.Timeout,
-		}
+		cfdns.zones = resolver.zones
+		cfdns.resolver = resolver
+		cfdns.sources = sources
+		cfdns.registry = newRegistry(cfg.Registry)
+		cfdns.httpClient = httpClient
 		if cfdns.pool != nil {
 			// close previous pool before replacing
 			cfdns.pool.Close()
@@ -97,231 +132,328 @@ func (cfdns *CFDNS) SetConfig(cfg *config.Config) error {
 	return nil
 }
 
-// getRecords retrieves DNS records for the given hostname and record type
-func (cfdns *CFDNS) getRecords(ctx context.Context, hostname, recordType string) ([]cloudflare.DNSRecord, error) {
-	cfdns.mu.RLock()
-	defer cfdns.mu.RUnlock()
-	records, _, err := cfdns.api.ListDNSRecords(
-		ctx,
-		cloudflare.ZoneIdentifier(cfdns.cfg.ZoneID),
-		cloudflare.ListDNSRecordsParams{
-			Name: hostname,
-			Type: recordType,
-		},
-	)
-	if err != nil {
-		return nil, err
-	}
-	return records, nil
+// getRecords retrieves DNS records for the given hostname and record type from the zone's record cache
+func (cfdns *CFDNS) getRecords(z *zone, hostname, recordType string) []provider.Record {
+	return z.cache.get(recordType, hostname)
 }
 
-// ZoneIsValid checks if the configured zone ID is valid for the provided API token
+// ZoneIsValid checks if every configured zone is accessible with the credentials of its provider
 func (cfdns *CFDNS) ZoneIsValid(ctx context.Context) (bool, error) {
 	cfdns.mu.RLock()
-	pool := cfdns.pool
-	api := cfdns.api
-	zoneID := cfdns.cfg.ZoneID
-
-	fut := goropo.Submit(
-		pool,
-		ctx,
-		func(ctx context.Context) ([]cloudflare.Zone, error) {
-			return api.ListZones(ctx)
-		},
-	)
-
-	zones, err := fut.Await(ctx)
+	zones := cfdns.zones
 	cfdns.mu.RUnlock()
 
-	if err != nil {
-		return false, err
-	}
-
-	for _, zone := range zones {
-		if zone.ID == zoneID {
-			return true, nil
+	for _, z := range zones {
+		err := z.provider.ValidateZone(ctx, z.ref())
+		if errors.Is(err, provider.ErrZoneNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
 		}
 	}
 
-	return false, nil
+	return true, nil
 }
 
-// checkAndUpdate checks the existing DNS records for the given domain and record type,
-// and updates or creates the record if the address has changed or does not exist.
+// checkAndUpdate checks the existing DNS records for the given domain and record type, and
+// creates, updates or deletes records so they publish the given addresses according to the
+// domain's policy. Records not owned by this instance are only modified if the domain adopts them.
 // Caller must hold cfdns.mu RLock.
 func (cfdns *CFDNS) checkAndUpdate(
 	ctx context.Context,
+	exec *executor,
+	z *zone,
 	domain *config.Domain,
-	recordType,
-	address string,
-) error {
-	const timeout = time.Second * 10
-
-	// get existing records for this hostname and record type
-	ctxTimeout, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-	records, err := cfdns.getRecords(ctxTimeout, domain.Hostname, recordType)
-	if err != nil {
-		return err
-	}
-
-	// no records found for this hostname, create a new one
-	if len(records) == 0 {
-		ctxTimeout, cancel = context.WithTimeout(ctx, timeout)
-		defer cancel()
-
-		recordNew, err := cfdns.api.CreateDNSRecord(
-			ctxTimeout,
-			cloudflare.ZoneIdentifier(cfdns.cfg.ZoneID),
-			cloudflare.CreateDNSRecordParams{
-				Name:    domain.Hostname,
-				Content: address,
-				Type:    recordType,
-				Proxied: domain.Proxied,
-			},
-		)
+	recordType string,
+	addresses []string,
+) (err error) {
+	// the outcome is reported however the reconciliation ends
+	result := RecordResult{Zone: z.name, Hostname: domain.Hostname, Type: recordType, Action: ACTION_NONE}
+	started := time.Now()
+	defer func() {
+		result.Duration = time.Since(started)
 		if err != nil {
-			return err
+			result.Err = fmt.Errorf("%s %s: %w", recordType, domain.Hostname, err)
 		}
-		log.Info().
-			Str("id", recordNew.ID).
-			Str("hostname", recordNew.Name).
-			Str("type", recordNew.Type).
-			Str("address", recordNew.Content).
-			Msgf("Created new DNS record")
-		return nil
-	}
-
-	// iterate over existing records and update if the address has changed
-	for _, record := range records {
-		ctxTimeout, cancel = context.WithTimeout(ctx, timeout)
-		defer cancel()
-
-		if record.Content == address && (record.Proxied == nil ||
-			domain.Proxied == nil ||
-			(*record.Proxied == *domain.Proxied)) {
-
-			log.Debug().
+		exec.addResult(result)
+	}()
+
+	// get existing records for this hostname and record type, no API call is made unless they change
+	records := cfdns.getRecords(z, domain.Hostname, recordType)
+	owned := cfdns.registry.owned(z, domain.Hostname, recordType, records)
+
+	for i, record := range records {
+		if !owned[i] && !domain.Adopt {
+			// foreign records are expected with the multi and preserve policies, so they are only warned
+			// about the first time they are seen
+			level := zerolog.DebugLevel
+			if cfdns.firstSeenForeign(z, record.ID) {
+				level = zerolog.WarnLevel
+			}
+			log.WithLevel(level).
 				Str("id", record.ID).
 				Str("hostname", record.Name).
 				Str("type", record.Type).
 				Str("address", record.Content).
-				Msgf("Skipping DNS record")
-			return nil
+				Msg("DNS record is not owned by this instance, skipping (set adopt to take it over)")
 		}
+	}
 
-		recordNew, err := cfdns.api.UpdateDNSRecord(
-			ctxTimeout,
-			cloudflare.ZoneIdentifier(cfdns.cfg.ZoneID),
-			cloudflare.UpdateDNSRecordParams{
-				ID:      record.ID,
-				Content: address,
-				Proxied: domain.Proxied,
-			},
-		)
-		if err != nil {
-			log.Error().Err(err).
-				Str("id", record.ID).
-				Str("hostname", record.Name).
-				Str("type", record.Type).
-				Str("address", record.Content).
-				Msg("Failed to update DNS record")
-			return err
-		}
+	ops := planRecords(cfdns.registry, domain, records, owned, addresses)
+	result.Action = summarizeOps(ops)
+	result.OldContent = recordContents(records)
+	result.NewContent = contentsAfter(records, ops)
+	if len(ops) == 0 {
+		log.Debug().
+			Str("hostname", domain.Hostname).
+			Str("type", recordType).
+			Strs("addresses", addresses).
+			Msgf("Skipping DNS record")
+		return nil
+	}
 
-		log.Info().
-			Str("id", recordNew.ID).
-			Str("hostname", recordNew.Name).
-			Str("type", recordNew.Type).
-			Str("address", recordNew.Content).
-			Msgf("Updated DNS record")
+	return cfdns.applyOps(ctx, exec, z, domain, recordType, ops)
+}
+
+// firstSeenForeign reports whether a record not owned by this instance is seen for the first time
+func (cfdns *CFDNS) firstSeenForeign(z *zone, id string) bool {
+	cfdns.foreignMu.Lock()
+	defer cfdns.foreignMu.Unlock()
+
+	if cfdns.foreign == nil {
+		cfdns.foreign = make(map[string]struct{})
 	}
-	return nil
+	key := z.id + "/" + id
+	if _, ok := cfdns.foreign[key]; ok {
+		return false
+	}
+	cfdns.foreign[key] = struct{}{}
+	return true
 }
 
-func (cfdns *CFDNS) getPublicIPs(ctx context.Context) (string, string) {
-	var fut4, fut6 *goropo.Future[string]
+// recordDrifted reports whether an existing record differs from the desired address or any of the
+// desired record settings
+func recordDrifted(record provider.Record, settings recordSettings, address string) bool {
+	if record.Content != address {
+		return true
+	}
+
+	if record.Proxied != nil && settings.proxied != nil && *record.Proxied != *settings.proxied {
+		return true
+	}
+
+	// proxied records always have an automatic TTL, so their TTL is not compared
+	proxied := record.Proxied != nil && *record.Proxied
+	if settings.ttl != 0 && !proxied && record.TTL != settings.ttl {
+		return true
+	}
+
+	if settings.comment != nil && record.Comment != *settings.comment {
+		return true
+	}
+
+	if settings.tags != nil && !sameTags(record.Tags, settings.tags) {
+		return true
+	}
+
+	return false
+}
+
+// sameTags reports whether two tag lists contain the same tags, regardless of order
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = slices.Clone(a)
+	b = slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// getPublicIPs looks up the requested address families of an address source in parallel on the
+// worker pool, empty results are skipped
+func getPublicIPs(ctx context.Context, pool *goropo.Pool, src *addressSource, lookup4, lookup6 bool) (string, string) {
+	var await4, await6 func() string
 	var ipv4, ipv6 string
 
-	if *cfdns.cfg.IPv4 {
-		fut4 = goropo.Submit(cfdns.pool, ctx, ipget.GetPublicIPv4)
+	if lookup4 {
+		await4 = submitLookup(ctx, pool, src, ipget.FAMILY_IPV4)
 	}
 
-	if *cfdns.cfg.IPv6 {
-		fut6 = goropo.Submit(cfdns.pool, ctx, ipget.GetPublicIPv6)
+	if lookup6 {
+		await6 = submitLookup(ctx, pool, src, ipget.FAMILY_IPV6)
 	}
 
-	if fut4 != nil {
-		v, err := fut4.Await(ctx)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to get public ipv4")
-			ipv4 = ""
-		} else {
-			ipv4 = v
-			log.Debug().Str("ipv4", ipv4).Msg("fetched ipv4 address")
-		}
+	if await4 != nil {
+		ipv4 = await4()
 	}
 
-	if fut6 != nil {
-		v, err := fut6.Await(ctx)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to get public ipv6")
-			ipv6 = ""
-		} else {
-			ipv6 = v
-			log.Debug().Str("ipv6", ipv6).Msg("fetched ipv6 address")
-		}
+	if await6 != nil {
+		ipv6 = await6()
 	}
 
 	return ipv4, ipv6
 }
 
-func (cfdns *CFDNS) Process(ctx context.Context) {
+// Process updates the DNS records of every domain to the current public addresses and reports the
+// outcome of every hostname and record type
+func (cfdns *CFDNS) Process(ctx context.Context) *Report {
+	started := time.Now()
+	exec := newExecutor(false)
+	cfdns.process(ctx, exec)
+	return exec.report(started)
+}
+
+// Plan reports the changes Process would make without modifying any record
+func (cfdns *CFDNS) Plan(ctx context.Context) *Report {
+	started := time.Now()
+	exec := newExecutor(true)
+	cfdns.process(ctx, exec)
+	return exec.report(started)
+}
+
+// process runs a processing cycle, performing the record changes with the given executor
+func (cfdns *CFDNS) process(ctx context.Context, exec *executor) {
+	for _, err := range cfdns.resolveZones(ctx) {
+		exec.fail(err)
+	}
+
 	cfdns.mu.RLock()
 	defer cfdns.mu.RUnlock()
 
-	valid, err := cfdns.ZoneIsValid(ctx)
-	if err != nil || !valid {
-		log.Error().Err(err).Msg("unable to verify zone and API token, skipping processing cycle")
+	// verify every zone and API token, failing zones are skipped without affecting the others
+	zones := cfdns.validZones(ctx, exec)
+	if len(zones) == 0 {
+		log.Error().Msg("no zone could be verified, skipping processing cycle")
 		return
 	}
 
-	// acquire the current public IP addresses for this run
-	ipv4, ipv6 := cfdns.getPublicIPs(ctx)
+	// group the domains of all zones by the address sources their records are published from, and
+	// collect the address families each source has to look up
+	groups := make(map[string][]target)
+	lookups := make(map[string]*sourceLookup)
+	for _, z := range zones {
+		for _, domain := range z.domains {
+			// addresses of pushed domains are only published when a client reports them
+			if domain.Pushed {
+				continue
+			}
+
+			keys := domainSourceKeys(domain)
+			group := strings.Join(keys, ",")
+			groups[group] = append(groups[group], target{zone: z, domain: domain})
+
+			for _, key := range keys {
+				l, ok := lookups[key]
+				if !ok {
+					l = &sourceLookup{src: cfdns.sources[key], done: make(chan struct{})}
+					lookups[key] = l
+				}
+				l.lookup4 = l.lookup4 || *domain.IPv4
+				l.lookup6 = l.lookup6 || *domain.IPv6
+			}
+		}
+	}
+
+	// each address source is looked up independently so a slow or failing uplink does not delay the others
+	for key, l := range lookups {
+		if l.src == nil {
+			exec.fail(fmt.Errorf("unknown address source %q", key))
+			log.Error().Str("address_source", key).Msg("unknown address source, skipping domains")
+			close(l.done)
+			continue
+		}
+		go func() {
+			defer close(l.done)
+			l.ipv4, l.ipv6 = getPublicIPs(ctx, cfdns.pool, l.src, l.lookup4, l.lookup6)
+		}()
+	}
 
+	// the domains of each group are updated as soon as all of their sources are looked up
+	var wg sync.WaitGroup
+	for group, targets := range groups {
+		keys := strings.Split(group, ",")
+		sourceLookups := make([]*sourceLookup, len(keys))
+		for i, key := range keys {
+			sourceLookups[i] = lookups[key]
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, l := range sourceLookups {
+				<-l.done
+			}
+			cfdns.processTargets(ctx, exec, sourceLookups, targets)
+		}()
+	}
+	wg.Wait()
+
+	// delete the owned records which are no longer declared, the domains of pending zones are not
+	// known to belong to a resolved zone, so they could be taken as undeclared
+	switch {
+	case !cfdns.cfg.Prune:
+	case len(cfdns.resolver.pending) > 0:
+		log.Warn().Int("pending_zones", len(cfdns.resolver.pending)).Msg("some zones are not resolved, skipping prune")
+	default:
+		cfdns.prune(ctx, exec, zones)
+	}
+}
+
+// processTargets updates the DNS records of domains in every zone with the addresses of their address
+// sources. A family is skipped for a domain unless every one of its sources found an address.
+// Caller must hold cfdns.mu RLock.
+func (cfdns *CFDNS) processTargets(ctx context.Context, exec *executor, lookups []*sourceLookup, targets []target) {
 	// make a list of futures for all domain updates, allocate enough for both ipv4 and ipv6
-	futs := make([]*goropo.FutureAny, 0, len(cfdns.cfg.Domains)*2)
-
-	// iterate over all configured domains and update their DNS records as needed
-	for _, domain := range cfdns.cfg.Domains {
-		if *cfdns.cfg.IPv4 && ipv4 != "" {
-			fut := goropo.Submit(
-				cfdns.pool,
-				ctx,
-				func(ctx context.Context) (any, error) {
-					if err := cfdns.checkAndUpdate(ctx, &domain, RECORD_TYPE_IPV4, ipv4); err != nil {
-						log.Error().Err(err).Str("domain", domain.Hostname).Msg("failed to update ipv4 record")
-						return nil, err
-					}
-					return nil, nil
-				},
-			)
-			futs = append(futs, fut)
+	futs := make([]*goropo.FutureAny, 0, len(targets)*2)
+
+	submit := func(t target, recordType string, addresses []string) {
+		fut := goropo.Submit(
+			cfdns.pool,
+			ctx,
+			func(ctx context.Context) (any, error) {
+				if err := cfdns.checkAndUpdate(ctx, exec, t.zone, t.domain, recordType, addresses); err != nil {
+					log.Error().Err(err).Str("zone", t.zone.name).Str("domain", t.domain.Hostname).Msgf("failed to update %s records", recordType)
+					return nil, err
+				}
+				return nil, nil
+			},
+		)
+		futs = append(futs, fut)
+	}
+
+	// iterate over the domains of these sources and update their DNS records as needed
+	for _, t := range targets {
+		domain := t.domain
+
+		if *domain.IPv4 {
+			if addresses, _ := sourceAddresses(lookups, ipget.FAMILY_IPV4, nil); len(addresses) > 0 {
+				submit(t, RECORD_TYPE_IPV4, addresses)
+			} else {
+				exec.skip(t, RECORD_TYPE_IPV4, fmt.Errorf("no public ipv4 address"))
+			}
 		}
 
-		if *cfdns.cfg.IPv6 && ipv6 != "" {
-			fut := goropo.Submit(
-				cfdns.pool,
-				ctx,
-				func(ctx context.Context) (any, error) {
-					if err := cfdns.checkAndUpdate(ctx, &domain, RECORD_TYPE_IPV6, ipv6); err != nil {
-						log.Error().Err(err).Str("domain", domain.Hostname).Msg("failed to update ipv6 record")
-						return nil, err
-					}
-					return nil, nil
-				},
-			)
-			futs = append(futs, fut)
+		if *domain.IPv6 {
+			// hosts with an interface identifier get the detected prefix combined with their own suffix
+			var combine func(string) (string, error)
+			if domain.IPv6Suffix != "" {
+				combine = func(address string) (string, error) {
+					return ipget.CombinePrefix(address, domain.IPv6PrefixLength, domain.IPv6Suffix)
+				}
+			}
+
+			addresses, err := sourceAddresses(lookups, ipget.FAMILY_IPV6, combine)
+			if err != nil {
+				exec.skip(t, RECORD_TYPE_IPV6, err)
+				log.Error().Err(err).Str("domain", domain.Hostname).Msg("failed to apply ipv6 suffix")
+			} else if len(addresses) > 0 {
+				submit(t, RECORD_TYPE_IPV6, addresses)
+			} else {
+				exec.skip(t, RECORD_TYPE_IPV6, fmt.Errorf("no public ipv6 address"))
+			}
 		}
 	}
 
@@ -329,3 +461,31 @@ func (cfdns *CFDNS) Process(ctx context.Context) {
 		_, _ = fut.Await(ctx)
 	}
 }
+
+// sourceAddresses returns the distinct addresses of a family found by the sources, transformed by
+// the optional combine function. It is empty if any source failed, so records of an incomplete set
+// of addresses are not deleted.
+func sourceAddresses(lookups []*sourceLookup, family ipget.Family, combine func(string) (string, error)) ([]string, error) {
+	addresses := make([]string, 0, len(lookups))
+	for _, l := range lookups {
+		address := l.ipv4
+		if family == ipget.FAMILY_IPV6 {
+			address = l.ipv6
+		}
+		if address == "" {
+			return nil, nil
+		}
+
+		if combine != nil {
+			var err error
+			if address, err = combine(address); err != nil {
+				return nil, err
+			}
+		}
+
+		if !slices.Contains(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses, nil
+}
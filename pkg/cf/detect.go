@@ -0,0 +1,315 @@
+package cf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/goodieshq/cfdns/pkg/config"
+	"github.com/goodieshq/cfdns/pkg/ipget"
+	"github.com/goodieshq/goropo"
+	"github.com/rs/zerolog/log"
+)
+
+const DETECTOR_WORKER_COUNT = 4 // concurrent lookups of a detector, enough for a quorum per family
+
+// quorum is a set of sources queried in parallel which must agree on the address
+type quorum struct {
+	sources   []ipget.Source
+	threshold int
+}
+
+// addressSource looks up the public addresses of one uplink
+type addressSource struct {
+	name      string                   // name of the source, used in logs
+	binding   *ipget.Binding           // interface or address discovery traffic is sent from
+	validator *ipget.Validator         // rejects bogon and unexpected addresses
+	detector  *ipget.Detector          // public IP address detector
+	quorums   map[ipget.Family]*quorum // per-family quorum lookups, replacing the detector
+}
+
+// sourceLookup is the pending result of one address source's lookup during a processing cycle
+type sourceLookup struct {
+	src     *addressSource
+	lookup4 bool          // whether any domain publishes the IPv4 address of the source
+	lookup6 bool          // whether any domain publishes the IPv6 address of the source
+	ipv4    string        // looked up IPv4 address, empty on failure
+	ipv6    string        // looked up IPv6 address, empty on failure
+	done    chan struct{} // closed once the addresses are set
+}
+
+// Detector looks up the public addresses of the host with a single address source, for agents which
+// report their addresses to a central cfdns server instead of updating records themselves
+type Detector struct {
+	src  *addressSource
+	pool *goropo.Pool
+}
+
+// NewDetector creates a detector with the bind, detection and ip_sources settings of an agent
+func NewDetector(cfg *config.AgentConfig) (*Detector, error) {
+	src, err := newAddressSource(cfg.IPSources, config.DEFAULT_SOURCE, newBinding(cfg.Bind), cfg.Detection)
+	if err != nil {
+		return nil, err
+	}
+	return &Detector{
+		src:  src,
+		pool: goropo.NewPool(DETECTOR_WORKER_COUNT, DETECTOR_WORKER_COUNT*5),
+	}, nil
+}
+
+// Lookup returns the public addresses of the requested families, empty if none could be determined
+func (d *Detector) Lookup(ctx context.Context, ipv4, ipv6 bool) (string, string) {
+	return getPublicIPs(ctx, d.pool, d.src, ipv4, ipv6)
+}
+
+// Close closes the worker pool of the detector
+func (d *Detector) Close() {
+	d.pool.Close()
+}
+
+// newBinding converts a configured bind to an ipget binding, nil if nothing is bound
+func newBinding(bind config.Bind) *ipget.Binding {
+	if bind.Interface == "" && bind.Address == "" {
+		return nil
+	}
+	return &ipget.Binding{
+		Interface: bind.Interface,
+		Address:   net.ParseIP(bind.Address),
+	}
+}
+
+// domainSourceKey returns the key of the address source used to discover the addresses of a domain
+func domainSourceKey(domain *config.Domain) string {
+	switch {
+	case domain.Source != "":
+		return domain.Source
+	case domain.Bind != nil:
+		// a domain bind is shorthand for an anonymous source with the global detection settings
+		return "bind:" + newBinding(*domain.Bind).String()
+	default:
+		return config.DEFAULT_SOURCE
+	}
+}
+
+// domainSourceKeys returns the keys of every address source whose addresses are published for a domain
+func domainSourceKeys(domain *config.Domain) []string {
+	if len(domain.Sources) > 0 {
+		return domain.Sources
+	}
+	return []string{domainSourceKey(domain)}
+}
+
+// newAddressSources builds the default source, every named source, and one anonymous source per
+// distinct domain binding, keyed as returned by domainSourceKey
+func newAddressSources(cfg *config.Config) (map[string]*addressSource, error) {
+	sources := make(map[string]*addressSource)
+
+	add := func(name string, bind config.Bind, detection config.Detection) error {
+		if _, ok := sources[name]; ok {
+			return nil
+		}
+		src, err := newAddressSource(cfg.IPSources, name, newBinding(bind), detection)
+		if err != nil {
+			return fmt.Errorf("address source %s: %w", name, err)
+		}
+		sources[name] = src
+		return nil
+	}
+
+	if err := add(config.DEFAULT_SOURCE, cfg.Bind, cfg.Detection); err != nil {
+		return nil, err
+	}
+
+	for _, named := range cfg.Sources {
+		detection := cfg.Detection
+		if named.Detection != nil {
+			detection = *named.Detection
+		}
+		if err := add(named.Name, named.Bind, detection); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, domain := range cfg.AllDomains() {
+		if domain.Source == "" && domain.Bind != nil {
+			if err := add(domainSourceKey(domain), *domain.Bind, cfg.Detection); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return sources, nil
+}
+
+// newAddressSource builds the validator, detector and quorums of a single address source
+func newAddressSource(ipSources []config.IPSource, name string, binding *ipget.Binding, detection config.Detection) (*addressSource, error) {
+	validator, err := ipget.NewValidator(detection.AllowedCIDRs, detection.DeniedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	sources, err := newSources(ipSources, detection, detection.Methods, binding, validator)
+	if err != nil {
+		return nil, err
+	}
+
+	quorums := make(map[ipget.Family]*quorum)
+	for family, q := range map[ipget.Family]*config.Quorum{
+		ipget.FAMILY_IPV4: detection.Quorum.IPv4,
+		ipget.FAMILY_IPV6: detection.Quorum.IPv6,
+	} {
+		if q == nil {
+			continue
+		}
+		qSources, err := newSources(ipSources, detection, q.Methods, binding, validator)
+		if err != nil {
+			return nil, err
+		}
+		quorums[family] = &quorum{sources: qSources, threshold: q.Threshold}
+	}
+
+	return &addressSource{
+		name:      name,
+		binding:   binding,
+		validator: validator,
+		detector:  ipget.NewDetector(validator, sources...),
+		quorums:   quorums,
+	}, nil
+}
+
+// newSources creates one IP source per discovery method, HTTP sources skip services whose address
+// the validator rejects
+func newSources(ipSources []config.IPSource, detection config.Detection, methods []string, binding *ipget.Binding, validator *ipget.Validator) ([]ipget.Source, error) {
+	var filter *regexp.Regexp
+	if detection.Interface != "" {
+		re, err := regexp.Compile(detection.Interface)
+		if err != nil {
+			return nil, err
+		}
+		filter = re
+	}
+
+	ipv4Services, ipv6Services, err := newServices(ipSources)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make([]ipget.Source, 0, len(methods))
+	for _, method := range methods {
+		switch method {
+		case config.DETECT_METHOD_HTTP:
+			sources = append(sources, ipget.NewHTTPSourceWithServices(ipv4Services, ipv6Services, binding, validator))
+		case config.DETECT_METHOD_INTERFACE:
+			sources = append(sources, ipget.NewInterfaceSource(filter, binding))
+		case config.DETECT_METHOD_DNS:
+			sources = append(sources, ipget.NewDNSSource(binding))
+		case config.DETECT_METHOD_STUN:
+			sources = append(sources, ipget.NewSTUNSource(detection.STUNServers, binding))
+		case config.DETECT_METHOD_ROUTER:
+			sources = append(sources, ipget.NewRouterSource(net.ParseIP(detection.Router.Gateway), detection.Router.IGDURL, binding))
+		default:
+			return nil, fmt.Errorf("unknown detection method: %q", method)
+		}
+	}
+
+	return sources, nil
+}
+
+// newServices converts the configured ip_sources to HTTP services, split by address family
+func newServices(ipSources []config.IPSource) ([]ipget.Service, []ipget.Service, error) {
+	var ipv4, ipv6 []ipget.Service
+	for _, src := range ipSources {
+		var arg string
+		switch src.Parser {
+		case ipget.PARSER_JSON:
+			arg = src.Path
+		case ipget.PARSER_REGEX:
+			arg = src.Pattern
+		case ipget.PARSER_KV:
+			arg = src.Key
+		}
+
+		parse, err := ipget.NewParser(src.Parser, arg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ip_sources %q: %w", src.Name, err)
+		}
+
+		service := ipget.Service{
+			Name:    src.Name,
+			URL:     src.URL,
+			Headers: src.Headers,
+			Parse:   parse,
+		}
+		if ipget.Family(src.Family) == ipget.FAMILY_IPV6 {
+			ipv6 = append(ipv6, service)
+		} else {
+			ipv4 = append(ipv4, service)
+		}
+	}
+	return ipv4, ipv6, nil
+}
+
+// submitLookup starts the address lookup for a family on the worker pool and returns a function which
+// waits for its result. An empty result means no trustworthy address could be determined.
+func submitLookup(ctx context.Context, pool *goropo.Pool, src *addressSource, family ipget.Family) func() string {
+	logger := log.With().Str("address_source", src.name).Str("bind", src.binding.String()).Logger()
+
+	q, ok := src.quorums[family]
+	if !ok {
+		fut := goropo.Submit(pool, ctx, func(ctx context.Context) (string, error) {
+			return src.detector.Lookup(ctx, family)
+		})
+		return func() string {
+			ip, err := fut.Await(ctx)
+			if err != nil {
+				logger.Error().Err(err).Msgf("failed to get public %s", family)
+				return ""
+			}
+			logger.Debug().Str(string(family), ip).Msgf("fetched %s address", family)
+			return ip
+		}
+	}
+
+	// every source of the quorum is queried in parallel
+	futs := make([]*goropo.Future[string], len(q.sources))
+	for i, source := range q.sources {
+		futs[i] = goropo.Submit(pool, ctx, func(ctx context.Context) (string, error) {
+			return source.Lookup(ctx, family)
+		})
+	}
+
+	return func() string {
+		votes := make([]ipget.Vote, len(futs))
+		for i, fut := range futs {
+			ip, err := fut.Await(ctx)
+			if err == nil {
+				// rejected addresses do not count towards the quorum
+				if err = src.validator.Check(ip); err != nil {
+					logger.Warn().Err(err).Str("source", q.sources[i].Name()).Str("address", ip).Msg("rejected IP address from source")
+				}
+			}
+			votes[i] = ipget.Vote{Source: q.sources[i].Name(), IP: ip, Err: err}
+		}
+
+		ip, err := ipget.Consensus(votes, q.threshold)
+		if err != nil {
+			results := make([]string, len(votes))
+			for i, vote := range votes {
+				if errors.Is(vote.Err, ipget.ErrRejected) {
+					results[i] = vote.Source + "=rejected:" + vote.IP
+				} else if vote.Err != nil {
+					results[i] = vote.Source + "=error"
+				} else {
+					results[i] = vote.Source + "=" + vote.IP
+				}
+			}
+			logger.Warn().Err(err).Strs("votes", results).Msgf("sources disagree on the public %s address, skipping update", family)
+			return ""
+		}
+
+		logger.Debug().Str(string(family), ip).Int("threshold", q.threshold).Msgf("fetched %s address by quorum", family)
+		return ip
+	}
+}
@@ -0,0 +1,171 @@
+package cf
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/goodieshq/cfdns/pkg/provider"
+	"github.com/rs/zerolog/log"
+)
+
+// Change is a change to a DNS record, applied by Process or pending in a Plan
+type Change struct {
+	Zone     string       // name of the zone the record belongs to
+	Action   string       // one of the OP_* kinds
+	Hostname string       // name of the record
+	Type     string       // record type, e.g. A, AAAA or TXT
+	Old      *RecordState // record before the change, nil for creations
+	New      *RecordState // record after the change, nil for deletions
+}
+
+// RecordState is the content and settings of a DNS record
+type RecordState struct {
+	Content string
+	Proxied *bool
+	TTL     int
+	Comment string
+	Tags    []string
+}
+
+// executor performs the record changes of one processing cycle and keeps track of them, keeping the
+// record caches up to date. A dry-run executor only keeps track of the changes without sending them
+// to the provider.
+type executor struct {
+	dryRun  bool
+	mu      sync.Mutex
+	changes []Change
+	results []RecordResult
+	errs    []error
+}
+
+// newExecutor creates an executor, which does not modify any record in dry-run mode
+func newExecutor(dryRun bool) *executor {
+	return &executor{dryRun: dryRun}
+}
+
+// report returns the report of the cycle started at the given time
+func (e *executor) report(started time.Time) *Report {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return &Report{
+		Started:  started,
+		Duration: time.Since(started),
+		DryRun:   e.dryRun,
+		Records:  slices.Clone(e.results),
+		Changes:  slices.Clone(e.changes),
+		Errors:   slices.Clone(e.errs),
+	}
+}
+
+// addResult keeps track of the outcome of a hostname and record type
+func (e *executor) addResult(result RecordResult) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.results = append(e.results, result)
+}
+
+// add keeps track of a performed or planned change
+func (e *executor) add(change Change) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.changes = append(e.changes, change)
+}
+
+// fail keeps track of an error not tied to a hostname which prevented part of the cycle from completing
+func (e *executor) fail(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.errs = append(e.errs, err)
+}
+
+// skip reports a hostname and record type which could not be processed
+func (e *executor) skip(t target, recordType string, err error) {
+	e.addResult(RecordResult{
+		Zone:     t.zone.name,
+		Hostname: t.domain.Hostname,
+		Type:     recordType,
+		Action:   ACTION_SKIPPED,
+		Err:      fmt.Errorf("%s %s: %w", recordType, t.domain.Hostname, err),
+	})
+}
+
+// create creates a record, or only pretends to in dry-run mode
+func (e *executor) create(ctx context.Context, z *zone, record provider.Record) (provider.Record, error) {
+	if !e.dryRun {
+		var err error
+		record, err = z.provider.CreateRecord(ctx, z.ref(), record)
+		if err != nil {
+			z.cache.invalidate()
+			return record, err
+		}
+		z.cache.put(record)
+		log.Info().
+			Str("id", record.ID).
+			Str("hostname", record.Name).
+			Str("type", record.Type).
+			Str("address", record.Content).
+			Msgf("Created new DNS record")
+	}
+
+	e.add(Change{Zone: z.name, Action: OP_CREATE, Hostname: record.Name, Type: record.Type, New: recordState(record)})
+	return record, nil
+}
+
+// update replaces the content and settings of an existing record, or only pretends to in dry-run mode
+func (e *executor) update(ctx context.Context, z *zone, old, record provider.Record) (provider.Record, error) {
+	record.ID = old.ID
+	if !e.dryRun {
+		var err error
+		record, err = z.provider.UpdateRecord(ctx, z.ref(), record)
+		if err != nil {
+			z.cache.invalidate()
+			return record, err
+		}
+		// providers without record identifiers may identify the updated record differently
+		z.cache.remove(old)
+		z.cache.put(record)
+		log.Info().
+			Str("id", record.ID).
+			Str("hostname", record.Name).
+			Str("type", record.Type).
+			Str("address", record.Content).
+			Msgf("Updated DNS record")
+	}
+
+	e.add(Change{Zone: z.name, Action: OP_UPDATE, Hostname: old.Name, Type: old.Type, Old: recordState(old), New: recordState(record)})
+	return record, nil
+}
+
+// delete deletes an existing record, or only pretends to in dry-run mode
+func (e *executor) delete(ctx context.Context, z *zone, old provider.Record) error {
+	if !e.dryRun {
+		if err := z.provider.DeleteRecord(ctx, z.ref(), old); err != nil {
+			z.cache.invalidate()
+			return err
+		}
+		z.cache.remove(old)
+		log.Info().
+			Str("id", old.ID).
+			Str("hostname", old.Name).
+			Str("type", old.Type).
+			Str("address", old.Content).
+			Msg("Deleted DNS record")
+	}
+
+	e.add(Change{Zone: z.name, Action: OP_DELETE, Hostname: old.Name, Type: old.Type, Old: recordState(old)})
+	return nil
+}
+
+// recordState returns the content and settings of a record
+func recordState(record provider.Record) *RecordState {
+	return &RecordState{
+		Content: record.Content,
+		Proxied: record.Proxied,
+		TTL:     record.TTL,
+		Comment: record.Comment,
+		Tags:    record.Tags,
+	}
+}
@@ -0,0 +1,96 @@
+package cf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// prune deletes the records owned by this instance whose hostname is no longer configured in their
+// zone, or whose address family was disabled for the hostname. At most prune_limit records are
+// deleted per cycle, ownership records included, the remaining ones are deleted in later cycles.
+// Caller must hold cfdns.mu RLock.
+func (cfdns *CFDNS) prune(ctx context.Context, exec *executor, zones []*zone) {
+	remaining := cfdns.cfg.PruneLimit
+
+	for _, z := range zones {
+		logger := log.With().Str("zone", z.name).Logger()
+
+		// the records declared by the configuration, keyed by type and hostname
+		declared := make(map[string]struct{})
+		for _, domain := range z.domains {
+			if *domain.IPv4 {
+				declared[RECORD_TYPE_IPV4+"/"+domain.Hostname] = struct{}{}
+			}
+			if *domain.IPv6 {
+				declared[RECORD_TYPE_IPV6+"/"+domain.Hostname] = struct{}{}
+			}
+		}
+
+		records := cfdns.registry.ownedRecords(z, RECORD_TYPE_IPV4, RECORD_TYPE_IPV6)
+
+		// ownership of a hostname and type is released with its last record
+		stale := make(map[string]int)
+		for _, record := range records {
+			if _, ok := declared[record.Type+"/"+record.Name]; !ok {
+				stale[record.Type+"/"+record.Name]++
+			}
+		}
+
+		for _, record := range records {
+			key := record.Type + "/" + record.Name
+			if _, ok := stale[key]; !ok {
+				continue
+			}
+
+			// the last record is only deleted if its ownership record can be released along with it,
+			// a cycle without other deletions takes the pair even if prune_limit is 1
+			deletes := 1
+			if stale[key] == 1 && cfdns.registry.ownTXT(z, record.Name, record.Type) != nil {
+				deletes++
+			}
+			if remaining < deletes && remaining < cfdns.cfg.PruneLimit {
+				logger.Warn().
+					Str("hostname", record.Name).
+					Str("type", record.Type).
+					Int("prune_limit", cfdns.cfg.PruneLimit).
+					Msg("prune limit reached, deferring deletion to the next cycle")
+				return
+			}
+			remaining -= deletes
+
+			result := RecordResult{
+				Zone:       z.name,
+				Hostname:   record.Name,
+				Type:       record.Type,
+				Action:     OP_DELETE,
+				OldContent: []string{record.Content},
+			}
+			started := time.Now()
+			err := exec.delete(ctx, z, record)
+			result.Duration = time.Since(started)
+			if err != nil {
+				result.Err = fmt.Errorf("%s %s: %w", record.Type, record.Name, err)
+			}
+			exec.addResult(result)
+
+			if err != nil {
+				logger.Error().Err(err).
+					Str("id", record.ID).
+					Str("hostname", record.Name).
+					Str("type", record.Type).
+					Msg("Failed to delete stale DNS record")
+				continue
+			}
+
+			if stale[key]--; stale[key] == 0 {
+				if err := cfdns.registry.release(ctx, exec, z, record.Name, record.Type); err != nil {
+					exec.fail(err)
+					logger.Error().Err(err).Str("hostname", record.Name).Str("type", record.Type).Msg("failed to release DNS record ownership")
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package cf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/goodieshq/cfdns/pkg/config"
+	"github.com/goodieshq/cfdns/pkg/ipget"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrUnknownHostname is returned when an address is pushed for a hostname which is not configured
+var ErrUnknownHostname = errors.New("hostname is not configured")
+
+// ErrInvalidAddress is returned when a pushed address is not a valid IPv4 or IPv6 address
+var ErrInvalidAddress = errors.New("invalid address")
+
+// Push publishes the addresses a client reported for a configured hostname, in every zone the
+// hostname is configured in, instead of detecting them. Only the families the client reported an
+// address for are updated. Addresses the detection settings of the hostname's address sources
+// reject are not published, the error wraps ipget.ErrRejected.
+func (cfdns *CFDNS) Push(ctx context.Context, hostname string, addresses []string) (*Report, error) {
+	var ipv4, ipv6 string
+	for _, address := range addresses {
+		ip := net.ParseIP(strings.TrimSpace(address))
+		switch {
+		case ip == nil:
+			return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, address)
+		case ip.To4() != nil:
+			ipv4 = ip.String()
+		default:
+			ipv6 = ip.String()
+		}
+	}
+
+	// zones which could not be resolved before are tried again
+	cfdns.resolveZones(ctx)
+
+	// concurrent pushes for the same hostname would both create its missing records
+	cfdns.pushMu.Lock()
+	defer cfdns.pushMu.Unlock()
+
+	cfdns.mu.RLock()
+	defer cfdns.mu.RUnlock()
+
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	var targets []target
+	for _, z := range cfdns.zones {
+		for _, domain := range z.domains {
+			if domain.Hostname == hostname {
+				targets = append(targets, target{zone: z, domain: domain})
+			}
+		}
+	}
+	if len(targets) == 0 {
+		if cfdns.resolver.pendingHostname(hostname) {
+			return nil, fmt.Errorf("zone of %s is not resolved yet", hostname)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrUnknownHostname, hostname)
+	}
+
+	// a client may push any address, it must pass the same checks as a detected one
+	for _, t := range targets {
+		if err := cfdns.checkAddresses(t.domain, ipv4, ipv6); err != nil {
+			log.Warn().Err(err).Str("domain", hostname).Msg("rejected pushed address")
+			return nil, err
+		}
+	}
+
+	started := time.Now()
+	exec := newExecutor(false)
+	for _, t := range targets {
+		if err := t.zone.cache.sync(ctx, t.zone, cfdns.cfg.ResyncInterval); err != nil {
+			exec.fail(fmt.Errorf("zone %s: %w", t.zone.name, err))
+			log.Error().Err(err).Str("zone", t.zone.name).Msg("unable to list zone records, skipping pushed update")
+			continue
+		}
+
+		domain := t.domain
+		if *domain.IPv4 && ipv4 != "" {
+			if err := cfdns.checkAndUpdate(ctx, exec, t.zone, domain, RECORD_TYPE_IPV4, []string{ipv4}); err != nil {
+				log.Error().Err(err).Str("zone", t.zone.name).Str("domain", domain.Hostname).Msg("failed to update pushed A records")
+			}
+		}
+
+		if *domain.IPv6 && ipv6 != "" {
+			// hosts with an interface identifier get the pushed prefix combined with their own suffix
+			address := ipv6
+			if domain.IPv6Suffix != "" {
+				var err error
+				if address, err = ipget.CombinePrefix(ipv6, domain.IPv6PrefixLength, domain.IPv6Suffix); err != nil {
+					exec.skip(t, RECORD_TYPE_IPV6, err)
+					log.Error().Err(err).Str("domain", domain.Hostname).Msg("failed to apply ipv6 suffix")
+					continue
+				}
+			}
+			if err := cfdns.checkAndUpdate(ctx, exec, t.zone, domain, RECORD_TYPE_IPV6, []string{address}); err != nil {
+				log.Error().Err(err).Str("zone", t.zone.name).Str("domain", domain.Hostname).Msg("failed to update pushed AAAA records")
+			}
+		}
+	}
+
+	return exec.report(started), nil
+}
+
+// CheckAddresses validates addresses before they are pushed for a configured hostname, the error
+// wraps ipget.ErrRejected if an address source of one of its domains rejects an address
+func (cfdns *CFDNS) CheckAddresses(hostname string, addresses []string) error {
+	cfdns.mu.RLock()
+	defer cfdns.mu.RUnlock()
+
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	for _, domain := range cfdns.cfg.AllDomains() {
+		if domain.Hostname != hostname {
+			continue
+		}
+		if err := cfdns.checkAddresses(domain, addresses...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAddresses validates the pushed addresses of a domain with the validator of each of its
+// address sources
+func (cfdns *CFDNS) checkAddresses(domain *config.Domain, addresses ...string) error {
+	for _, key := range domainSourceKeys(domain) {
+		source, ok := cfdns.sources[key]
+		if !ok {
+			return fmt.Errorf("unknown address source %q", key)
+		}
+		for _, address := range addresses {
+			if address == "" {
+				continue
+			}
+			if err := source.validator.Check(address); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package cf
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/goodieshq/cfdns/pkg/config"
+	"github.com/goodieshq/cfdns/pkg/provider"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	OP_CREATE = "create" // a record is created for an address
+	OP_UPDATE = "update" // an existing record is changed to an address or to the desired settings
+	OP_DELETE = "delete" // an existing record is deleted
+)
+
+// recordOp is a single change to the records of a hostname and record type
+type recordOp struct {
+	kind     string          // one of the OP_* kinds
+	record   provider.Record // existing record, empty for creations
+	content  string          // desired address, empty for deletions
+	settings recordSettings  // desired settings, including the ownership marker
+	adopt    bool            // the record is not owned yet and is taken over by this change
+}
+
+// planRecords computes the changes converging the existing records of a hostname and record type to
+// the desired addresses according to the domain's policy. Records which are not owned are never
+// changed unless the domain adopts them.
+func planRecords(
+	reg *registry,
+	domain *config.Domain,
+	records []provider.Record,
+	owned []bool,
+	addresses []string,
+) []recordOp {
+	var ops []recordOp
+
+	// split the records into those cfdns may change and the addresses of all others
+	var managed []int
+	foreign := make(map[string]struct{})
+	for i, record := range records {
+		if owned[i] || domain.Adopt {
+			managed = append(managed, i)
+		} else {
+			foreign[record.Content] = struct{}{}
+		}
+	}
+
+	// update returns the operation changing a managed record, nil if it is already up to date
+	update := func(i int, address string) *recordOp {
+		settings := reg.settings(domain, &records[i])
+		if owned[i] && !recordDrifted(records[i], settings, address) {
+			return nil
+		}
+		return &recordOp{kind: OP_UPDATE, record: records[i], content: address, settings: settings, adopt: !owned[i]}
+	}
+
+	create := func(address string) recordOp {
+		return recordOp{kind: OP_CREATE, content: address, settings: reg.settings(domain, nil)}
+	}
+
+	switch domain.Policy {
+	case config.POLICY_PRESERVE:
+		// only the first managed record follows the address, every other record is left alone
+		if len(managed) > 0 {
+			if op := update(managed[0], addresses[0]); op != nil {
+				ops = append(ops, *op)
+			}
+		} else if _, ok := foreign[addresses[0]]; !ok {
+			ops = append(ops, create(addresses[0]))
+		}
+		return ops
+
+	case config.POLICY_SINGLE:
+		// a second record next to records owned by someone else would turn the name into a round-robin
+		if len(managed) == 0 && len(foreign) > 0 {
+			return nil
+		}
+		addresses = addresses[:1]
+	}
+
+	// records already publishing a desired address are kept, duplicates of the same address are not
+	used := make(map[int]bool)
+	var missing []string
+	for _, address := range addresses {
+		i := slices.IndexFunc(managed, func(i int) bool {
+			return !used[i] && records[i].Content == address
+		})
+		if i >= 0 {
+			used[managed[i]] = true
+			if op := update(managed[i], address); op != nil {
+				ops = append(ops, *op)
+			}
+			continue
+		}
+		if _, ok := foreign[address]; ok {
+			continue
+		}
+		missing = append(missing, address)
+	}
+
+	// the remaining managed records are reused for missing addresses and deleted once none are left
+	for _, i := range managed {
+		if used[i] {
+			continue
+		}
+		if len(missing) > 0 {
+			ops = append(ops, *update(i, missing[0]))
+			missing = missing[1:]
+			continue
+		}
+		ops = append(ops, recordOp{kind: OP_DELETE, record: records[i]})
+	}
+
+	for _, address := range missing {
+		ops = append(ops, create(address))
+	}
+
+	return ops
+}
+
+// applyOps performs the changes to the records of a hostname and record type. Updates and creations
+// are applied before deletions so the hostname never resolves to nothing while converging.
+// Caller must hold cfdns.mu RLock.
+func (cfdns *CFDNS) applyOps(ctx context.Context, exec *executor, z *zone, domain *config.Domain, recordType string, ops []recordOp) error {
+	// records owned by another instance through their companion TXT record must not be created next
+	// to or taken over, unless the domain adopts them
+	if slices.ContainsFunc(ops, func(op recordOp) bool { return op.kind == OP_CREATE || op.adopt }) {
+		if err := cfdns.registry.claimable(z, domain.Hostname, recordType, domain.Adopt); err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	claim := false
+
+	slices.SortStableFunc(ops, func(a, b recordOp) int {
+		return boolInt(a.kind == OP_DELETE) - boolInt(b.kind == OP_DELETE)
+	})
+
+	for _, op := range ops {
+		switch op.kind {
+		case OP_CREATE:
+			_, err := exec.create(ctx, z, op.settings.apply(provider.Record{
+				Type:    recordType,
+				Name:    domain.Hostname,
+				Content: op.content,
+			}))
+			if err != nil {
+				log.Error().Err(err).
+					Str("hostname", domain.Hostname).
+					Str("type", recordType).
+					Str("address", op.content).
+					Msg("Failed to create DNS record")
+				errs = append(errs, err)
+				continue
+			}
+			claim = true
+
+		case OP_UPDATE:
+			// unmanaged settings are sent back unchanged so the update does not clear them
+			record := op.settings.apply(op.record)
+			record.Content = op.content
+
+			_, err := exec.update(ctx, z, op.record, record)
+			if err != nil {
+				log.Error().Err(err).
+					Str("id", op.record.ID).
+					Str("hostname", op.record.Name).
+					Str("type", op.record.Type).
+					Str("address", op.record.Content).
+					Msg("Failed to update DNS record")
+				errs = append(errs, err)
+				continue
+			}
+			if op.adopt {
+				claim = true
+				log.Info().
+					Str("id", op.record.ID).
+					Str("hostname", op.record.Name).
+					Str("type", op.record.Type).
+					Bool("dry_run", exec.dryRun).
+					Msg("Adopted DNS record")
+			}
+
+		case OP_DELETE:
+			if err := exec.delete(ctx, z, op.record); err != nil {
+				log.Error().Err(err).
+					Str("id", op.record.ID).
+					Str("hostname", op.record.Name).
+					Str("type", op.record.Type).
+					Str("address", op.record.Content).
+					Msg("Failed to delete DNS record")
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if claim {
+		if err := cfdns.registry.claim(ctx, exec, z, domain.Hostname, recordType, domain.Adopt); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// boolInt converts a bool to 1 or 0, for sorting
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
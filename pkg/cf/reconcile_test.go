@@ -0,0 +1,431 @@
+package cf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/goodieshq/cfdns/pkg/provider"
+)
+
+// testZone is the zone of the test configurations as hosted by the memory provider
+var testZone = provider.Zone{ID: "a.test", Name: "a.test"}
+
+// newTestCFDNS creates an instance from a YAML configuration whose zones are hosted by the given
+// memory provider, so several instances can share the same records
+func newTestCFDNS(t *testing.T, data string, mem *provider.Memory) *CFDNS {
+	t.Helper()
+	cfdns, err := NewCFDNS(*loadTestConfig(t, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cfdns.Close)
+
+	for _, z := range cfdns.zones {
+		z.provider = mem
+	}
+	return cfdns
+}
+
+// seedRecord stores an existing record in the test zone
+func seedRecord(t *testing.T, mem *provider.Memory, recordType, name, content string, settings ...func(*provider.Record)) {
+	t.Helper()
+	record := provider.Record{Type: recordType, Name: name, Content: content, TTL: 1}
+	for _, set := range settings {
+		set(&record)
+	}
+	if _, err := mem.CreateRecord(context.Background(), testZone, record); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// withComment sets the comment of a seeded record
+func withComment(comment string) func(*provider.Record) {
+	return func(record *provider.Record) { record.Comment = comment }
+}
+
+// zoneContents returns the sorted contents of the stored records with the given type and name
+func zoneContents(t *testing.T, mem *provider.Memory, recordType, name string) []string {
+	t.Helper()
+	records, err := mem.ListRecords(context.Background(), testZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, record := range records {
+		if record.Type == recordType && record.Name == name {
+			contents = append(contents, record.Content)
+		}
+	}
+	slices.Sort(contents)
+	return contents
+}
+
+// reconcile converges the A records of every domain to the addresses like a processing cycle does.
+// The record caches are refreshed first, so changes made by other instances are seen.
+func reconcile(t *testing.T, cfdns *CFDNS, dryRun bool, addresses ...string) *Report {
+	t.Helper()
+	cfdns.mu.RLock()
+	defer cfdns.mu.RUnlock()
+
+	started := time.Now()
+	exec := newExecutor(dryRun)
+	for _, z := range cfdns.zones {
+		z.cache.invalidate()
+	}
+	for _, z := range cfdns.validZones(context.Background(), exec) {
+		for _, domain := range z.domains {
+			cfdns.checkAndUpdate(context.Background(), exec, z, domain, RECORD_TYPE_IPV4, addresses)
+		}
+	}
+	return exec.report(started)
+}
+
+// prune deletes the stale owned records like a processing cycle does
+func prune(t *testing.T, cfdns *CFDNS) *Report {
+	t.Helper()
+	cfdns.mu.RLock()
+	defer cfdns.mu.RUnlock()
+
+	started := time.Now()
+	exec := newExecutor(false)
+	for _, z := range cfdns.zones {
+		z.cache.invalidate()
+	}
+	cfdns.prune(context.Background(), exec, cfdns.validZones(context.Background(), exec))
+	return exec.report(started)
+}
+
+// owns reports whether the instance owns every A record of host.a.test, false if there is none
+func owns(t *testing.T, cfdns *CFDNS) bool {
+	t.Helper()
+	cfdns.mu.RLock()
+	defer cfdns.mu.RUnlock()
+
+	z := cfdns.zones[0]
+	z.cache.invalidate()
+	if err := z.cache.sync(context.Background(), z, cfdns.cfg.ResyncInterval); err != nil {
+		t.Fatal(err)
+	}
+	records := z.cache.get(RECORD_TYPE_IPV4, "host.a.test")
+	owned := cfdns.registry.owned(z, "host.a.test", RECORD_TYPE_IPV4, records)
+	return len(records) > 0 && !slices.Contains(owned, false)
+}
+
+// policyConfig returns a configuration of host.a.test with the given policy and registry type
+func policyConfig(policy, registry string) string {
+	return fmt.Sprintf(`
+ipv4: true
+registry:
+  type: %s
+  owner_id: test
+zones:
+  - provider: memory
+    name: a.test
+    domains:
+      - hostname: host.a.test
+        policy: %s
+`, registry, policy)
+}
+
+func TestReconcileSingle(t *testing.T) {
+	mem := provider.NewMemory(testZone)
+	seedRecord(t, mem, "A", "host.a.test", "198.51.100.1")
+	seedRecord(t, mem, "A", "host.a.test", "198.51.100.2")
+	cfdns := newTestCFDNS(t, policyConfig("single", "none"), mem)
+
+	// only the first address is published, by reusing the first record and deleting the other one
+	report := reconcile(t, cfdns, false, "198.51.100.3", "198.51.100.4")
+	if err := report.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := zoneContents(t, mem, "A", "host.a.test"); !slices.Equal(got, []string{"198.51.100.3"}) {
+		t.Errorf("records = %v, want [198.51.100.3]", got)
+	}
+	if len(report.Records) != 1 || report.Records[0].Action != OP_UPDATE ||
+		!slices.Equal(report.Records[0].NewContent, []string{"198.51.100.3"}) {
+		t.Errorf("Records = %+v, want an update to 198.51.100.3", report.Records)
+	}
+	if len(report.Changes) != 2 || report.Changes[0].Action != OP_UPDATE || report.Changes[1].Action != OP_DELETE {
+		t.Errorf("Changes = %+v, want an update before a deletion", report.Changes)
+	}
+
+	// converged records are left alone
+	report = reconcile(t, cfdns, false, "198.51.100.3", "198.51.100.4")
+	if report.Changed() || report.Records[0].Action != ACTION_NONE {
+		t.Errorf("Changes = %+v, want none", report.Changes)
+	}
+}
+
+func TestReconcileSingleForeign(t *testing.T) {
+	mem := provider.NewMemory(testZone)
+	seedRecord(t, mem, "A", "host.a.test", "198.51.100.9")
+	cfdns := newTestCFDNS(t, policyConfig("single", "comment"), mem)
+
+	// a second record next to a foreign one would turn the name into a round-robin
+	if report := reconcile(t, cfdns, false, "198.51.100.1"); report.Changed() {
+		t.Errorf("Changes = %+v, want none", report.Changes)
+	}
+	if got := zoneContents(t, mem, "A", "host.a.test"); !slices.Equal(got, []string{"198.51.100.9"}) {
+		t.Errorf("records = %v, want [198.51.100.9]", got)
+	}
+}
+
+func TestReconcileMulti(t *testing.T) {
+	mem := provider.NewMemory(testZone)
+	seedRecord(t, mem, "A", "host.a.test", "198.51.100.1", withComment(OWNER_COMMENT_PREFIX+"test"))
+	seedRecord(t, mem, "A", "host.a.test", "198.51.100.3")
+	cfdns := newTestCFDNS(t, policyConfig("multi", "comment"), mem)
+
+	// the owned record is reused for the missing address, the foreign one already publishes the other
+	report := reconcile(t, cfdns, false, "198.51.100.2", "198.51.100.3")
+	if err := report.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := zoneContents(t, mem, "A", "host.a.test"), []string{"198.51.100.2", "198.51.100.3"}; !slices.Equal(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+	if len(report.Changes) != 1 || report.Changes[0].Action != OP_UPDATE {
+		t.Errorf("Changes = %+v, want one update", report.Changes)
+	}
+
+	// owned records of addresses which are gone are deleted, foreign ones are kept
+	report = reconcile(t, cfdns, false, "198.51.100.3")
+	if len(report.Changes) != 1 || report.Changes[0].Action != OP_DELETE {
+		t.Errorf("Changes = %+v, want one deletion", report.Changes)
+	}
+	if got := zoneContents(t, mem, "A", "host.a.test"); !slices.Equal(got, []string{"198.51.100.3"}) {
+		t.Errorf("records = %v, want [198.51.100.3]", got)
+	}
+}
+
+func TestReconcilePreserve(t *testing.T) {
+	mem := provider.NewMemory(testZone)
+	seedRecord(t, mem, "A", "host.a.test", "198.51.100.1", withComment(OWNER_COMMENT_PREFIX+"test"))
+	seedRecord(t, mem, "A", "host.a.test", "198.51.100.2", withComment(OWNER_COMMENT_PREFIX+"test"))
+	seedRecord(t, mem, "A", "host.a.test", "198.51.100.9")
+	cfdns := newTestCFDNS(t, policyConfig("preserve", "comment"), mem)
+
+	// only the first owned record follows the address
+	report := reconcile(t, cfdns, false, "198.51.100.5", "198.51.100.6")
+	if err := report.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := zoneContents(t, mem, "A", "host.a.test"), []string{"198.51.100.2", "198.51.100.5", "198.51.100.9"}; !slices.Equal(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+
+	// without an owned record, one is created unless a foreign record publishes the address
+	mem = provider.NewMemory(testZone)
+	seedRecord(t, mem, "A", "host.a.test", "198.51.100.9")
+	cfdns = newTestCFDNS(t, policyConfig("preserve", "comment"), mem)
+
+	if report := reconcile(t, cfdns, false, "198.51.100.9"); report.Changed() {
+		t.Errorf("Changes = %+v, want none", report.Changes)
+	}
+	reconcile(t, cfdns, false, "198.51.100.5")
+	if got, want := zoneContents(t, mem, "A", "host.a.test"), []string{"198.51.100.5", "198.51.100.9"}; !slices.Equal(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+}
+
+func TestReconcileRegistry(t *testing.T) {
+	registryConfig := func(registry, owner string, adopt bool) string {
+		return fmt.Sprintf(`
+ipv4: true
+registry:
+  type: %s
+  owner_id: %s
+zones:
+  - provider: memory
+    name: a.test
+    domains:
+      - hostname: host.a.test
+        adopt: %t
+`, registry, owner, adopt)
+	}
+
+	for _, registry := range []string{"comment", "tag", "txt"} {
+		t.Run(registry, func(t *testing.T) {
+			mem := provider.NewMemory(testZone)
+			cfdns := newTestCFDNS(t, registryConfig(registry, "test", false), mem)
+
+			// created records are claimed, and recognized on the next cycle
+			if report := reconcile(t, cfdns, false, "198.51.100.1"); report.Err() != nil || !report.Changed() {
+				t.Fatalf("reconcile() = %+v, want a created record", report)
+			}
+			if !owns(t, cfdns) {
+				t.Error("created record is not owned")
+			}
+			if report := reconcile(t, cfdns, false, "198.51.100.1"); report.Changed() {
+				t.Errorf("Changes = %+v, want none", report.Changes)
+			}
+
+			// another instance leaves the record alone
+			other := newTestCFDNS(t, registryConfig(registry, "other", false), mem)
+			if owns(t, other) {
+				t.Error("record is owned by another instance")
+			}
+			if report := reconcile(t, other, false, "198.51.100.2"); report.Changed() {
+				t.Errorf("Changes = %+v, want none", report.Changes)
+			}
+
+			// unless it adopts the record
+			adopter := newTestCFDNS(t, registryConfig(registry, "other", true), mem)
+			if report := reconcile(t, adopter, false, "198.51.100.2"); report.Err() != nil || !report.Changed() {
+				t.Fatalf("reconcile() = %+v, want an adopted record", report)
+			}
+			if !owns(t, adopter) {
+				t.Error("adopted record is not owned")
+			}
+			if got := zoneContents(t, mem, "A", "host.a.test"); !slices.Equal(got, []string{"198.51.100.2"}) {
+				t.Errorf("records = %v, want [198.51.100.2]", got)
+			}
+		})
+	}
+}
+
+func TestPruneLimit(t *testing.T) {
+	mem := provider.NewMemory(testZone)
+	seedRecord(t, mem, "A", "host.a.test", "198.51.100.1")
+	seedRecord(t, mem, "TXT", "_cfdns-a.host.a.test", OWNER_TXT_HERITAGE+"test")
+	for _, address := range []string{"198.51.100.2", "198.51.100.3", "198.51.100.4", "198.51.100.6"} {
+		seedRecord(t, mem, "A", "old.a.test", address)
+	}
+	seedRecord(t, mem, "TXT", "_cfdns-a.old.a.test", OWNER_TXT_HERITAGE+"test")
+	seedRecord(t, mem, "A", "foreign.a.test", "198.51.100.5")
+
+	cfdns := newTestCFDNS(t, `
+ipv4: true
+prune: true
+prune_limit: 2
+registry:
+  type: txt
+  owner_id: test
+zones:
+  - provider: memory
+    name: a.test
+    domains:
+      - hostname: host.a.test
+`, mem)
+
+	// the deletions of the undeclared records are spread over cycles
+	report := prune(t, cfdns)
+	if len(report.Changes) != 2 || len(zoneContents(t, mem, "A", "old.a.test")) != 2 {
+		t.Fatalf("Changes = %+v, want 2 deletions", report.Changes)
+	}
+	if len(zoneContents(t, mem, "TXT", "_cfdns-a.old.a.test")) != 1 {
+		t.Error("ownership record released before the last record was deleted")
+	}
+
+	// the ownership record counts against the limit, so the last record waits for the next cycle
+	report = prune(t, cfdns)
+	if len(report.Changes) != 1 || len(zoneContents(t, mem, "A", "old.a.test")) != 1 {
+		t.Fatalf("Changes = %+v, want 1 deletion", report.Changes)
+	}
+	if len(zoneContents(t, mem, "TXT", "_cfdns-a.old.a.test")) != 1 {
+		t.Error("ownership record released before the last record was deleted")
+	}
+
+	// ownership is released with the last record
+	report = prune(t, cfdns)
+	if len(report.Changes) != 2 || report.Err() != nil {
+		t.Fatalf("Changes = %+v, want the last record and its ownership record deleted", report.Changes)
+	}
+	if got := zoneContents(t, mem, "A", "old.a.test"); len(got) != 0 {
+		t.Errorf("records = %v, want none", got)
+	}
+	if got := zoneContents(t, mem, "TXT", "_cfdns-a.old.a.test"); len(got) != 0 {
+		t.Errorf("ownership records = %v, want none", got)
+	}
+
+	// declared and foreign records are kept
+	if report := prune(t, cfdns); report.Changed() {
+		t.Errorf("Changes = %+v, want none", report.Changes)
+	}
+	if len(zoneContents(t, mem, "A", "host.a.test")) != 1 || len(zoneContents(t, mem, "A", "foreign.a.test")) != 1 {
+		t.Error("declared or foreign records were pruned")
+	}
+}
+
+func TestReconcileDryRun(t *testing.T) {
+	mem := provider.NewMemory(testZone)
+	cfdns := newTestCFDNS(t, policyConfig("single", "txt"), mem)
+
+	// the record and its ownership record are planned without being created
+	report := reconcile(t, cfdns, true, "198.51.100.1")
+	if !report.DryRun || len(report.Changes) != 2 {
+		t.Fatalf("Changes = %+v, want a planned record and ownership record", report.Changes)
+	}
+	if len(report.Records) != 1 || report.Records[0].Action != OP_CREATE ||
+		!slices.Equal(report.Records[0].NewContent, []string{"198.51.100.1"}) {
+		t.Errorf("Records = %+v, want a planned creation of 198.51.100.1", report.Records)
+	}
+	if records, _ := mem.ListRecords(context.Background(), testZone); len(records) != 0 {
+		t.Errorf("records = %+v, want none in a dry run", records)
+	}
+
+	// the planned changes are the ones applied
+	applied := reconcile(t, cfdns, false, "198.51.100.1")
+	if len(applied.Changes) != len(report.Changes) || applied.DryRun {
+		t.Errorf("Changes = %+v, want %+v", applied.Changes, report.Changes)
+	}
+
+	report = reconcile(t, cfdns, true, "198.51.100.2")
+	if len(report.Changes) != 1 || report.Changes[0].Action != OP_UPDATE || report.Changes[0].New.Content != "198.51.100.2" {
+		t.Errorf("Changes = %+v, want a planned update to 198.51.100.2", report.Changes)
+	}
+	if got := zoneContents(t, mem, "A", "host.a.test"); !slices.Equal(got, []string{"198.51.100.1"}) {
+		t.Errorf("records = %v, want [198.51.100.1] in a dry run", got)
+	}
+}
+
+func TestReconcileOwnershipConflict(t *testing.T) {
+	ownerConfig := func(policy, owner string) string {
+		return fmt.Sprintf(`
+ipv4: true
+registry:
+  type: txt
+  owner_id: %s
+zones:
+  - provider: memory
+    name: a.test
+    domains:
+      - hostname: host.a.test
+        policy: %s
+`, owner, policy)
+	}
+
+	for _, policy := range []string{"multi", "preserve"} {
+		t.Run(policy, func(t *testing.T) {
+			mem := provider.NewMemory(testZone)
+			owner := newTestCFDNS(t, ownerConfig(policy, "test"), mem)
+			if report := reconcile(t, owner, false, "198.51.100.1"); report.Err() != nil || !report.Changed() {
+				t.Fatalf("reconcile() = %+v, want a created record", report)
+			}
+
+			// another instance must neither add records next to the owned ones nor claim them
+			other := newTestCFDNS(t, ownerConfig(policy, "other"), mem)
+			report := reconcile(t, other, false, "198.51.100.2")
+			if report.Changed() || !errors.Is(report.Err(), errOwnershipConflict) {
+				t.Errorf("reconcile() changes = %+v, error = %v, want an ownership conflict", report.Changes, report.Err())
+			}
+			if report := reconcile(t, other, false, "198.51.100.1"); report.Changed() {
+				t.Errorf("Changes = %+v, want none", report.Changes)
+			}
+
+			if got := zoneContents(t, mem, "TXT", "_cfdns-a.host.a.test"); !slices.Equal(got, []string{OWNER_TXT_HERITAGE + "test"}) {
+				t.Errorf("ownership records = %v, want the original owner", got)
+			}
+			if got := zoneContents(t, mem, "A", "host.a.test"); !slices.Equal(got, []string{"198.51.100.1"}) {
+				t.Errorf("records = %v, want [198.51.100.1]", got)
+			}
+			if !owns(t, owner) || owns(t, other) {
+				t.Error("records changed owner")
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package cf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/goodieshq/cfdns/pkg/config"
+	"github.com/goodieshq/cfdns/pkg/provider"
+)
+
+const (
+	OWNER_COMMENT_PREFIX = "cfdns:owner="          // comment marker of owned records, followed by the owner ID
+	OWNER_TAG_PREFIX     = "cfdns-owner:"          // tag of owned records, followed by the owner ID
+	OWNER_TXT_PREFIX     = "_cfdns-"               // label prefix of companion TXT records, followed by the record type
+	OWNER_TXT_HERITAGE   = "heritage=cfdns,owner=" // content of companion TXT records, followed by the owner ID
+)
+
+// errOwnershipConflict is returned when records would be claimed whose companion TXT record names
+// another owner, and the domain does not adopt them
+var errOwnershipConflict = errors.New("records are owned by another instance (set adopt to take them over)")
+
+// registry marks the records managed by this instance and recognizes them on later runs
+type registry struct {
+	kind    string // one of the config.REGISTRY_* types
+	ownerID string // identifier of this instance
+}
+
+// recordSettings are the desired settings of a record, nil and zero fields are left unchanged
+type recordSettings struct {
+	proxied *bool
+	ttl     int
+	comment *string
+	tags    []string
+}
+
+// apply returns the record with the desired settings, unset settings keep the value of the record
+func (s recordSettings) apply(record provider.Record) provider.Record {
+	if s.proxied != nil {
+		record.Proxied = s.proxied
+	}
+	if s.ttl != 0 {
+		record.TTL = s.ttl
+	}
+	if s.comment != nil {
+		record.Comment = *s.comment
+	}
+	if s.tags != nil {
+		record.Tags = s.tags
+	}
+	return record
+}
+
+// newRegistry creates the registry for the configured ownership tracking
+func newRegistry(cfg config.Registry) *registry {
+	return &registry{kind: cfg.Type, ownerID: cfg.OwnerID}
+}
+
+// commentMarker returns the comment marker of records owned by this instance
+func (r *registry) commentMarker() string {
+	return OWNER_COMMENT_PREFIX + r.ownerID
+}
+
+// tag returns the tag of records owned by this instance
+func (r *registry) tag() string {
+	return OWNER_TAG_PREFIX + r.ownerID
+}
+
+// txtName returns the name of the companion TXT record of a record
+func (r *registry) txtName(hostname, recordType string) string {
+	return OWNER_TXT_PREFIX + strings.ToLower(recordType) + "." + hostname
+}
+
+// txtContent returns the content of companion TXT records owned by this instance
+func (r *registry) txtContent() string {
+	return OWNER_TXT_HERITAGE + r.ownerID
+}
+
+// settings returns the desired settings of a domain's record, including the ownership marker.
+// The existing record is nil when the record is about to be created.
+func (r *registry) settings(domain *config.Domain, record *provider.Record) recordSettings {
+	settings := recordSettings{
+		proxied: domain.Proxied,
+		ttl:     domain.TTL,
+		comment: domain.Comment,
+		tags:    domain.Tags,
+	}
+
+	switch r.kind {
+	case config.REGISTRY_COMMENT:
+		// the marker is appended to the configured comment, or to the existing one if unmanaged
+		comment := ""
+		if domain.Comment != nil {
+			comment = *domain.Comment
+		} else if record != nil {
+			comment = record.Comment
+		}
+		if !strings.Contains(comment, r.commentMarker()) {
+			comment = strings.TrimSpace(comment + " " + r.commentMarker())
+		}
+		settings.comment = &comment
+
+	case config.REGISTRY_TAG:
+		// the owner tag is added to the configured tags, or to the existing ones if unmanaged
+		tags := domain.Tags
+		if tags == nil && record != nil {
+			tags = record.Tags
+		}
+		if !slices.Contains(tags, r.tag()) {
+			tags = append(slices.Clone(tags), r.tag())
+		}
+		settings.tags = tags
+	}
+
+	return settings
+}
+
+// marked reports whether a record carries the comment or tag marker of this instance
+func (r *registry) marked(record provider.Record) bool {
+	switch r.kind {
+	case config.REGISTRY_COMMENT:
+		return strings.Contains(record.Comment, r.commentMarker())
+	case config.REGISTRY_TAG:
+		return slices.Contains(record.Tags, r.tag())
+	default:
+		return false
+	}
+}
+
+// owned reports which of the existing records of a hostname and record type are owned by this
+// instance, all of them without a registry
+func (r *registry) owned(z *zone, hostname, recordType string, records []provider.Record) []bool {
+	owned := make([]bool, len(records))
+	switch r.kind {
+	case config.REGISTRY_COMMENT, config.REGISTRY_TAG:
+		for i, record := range records {
+			owned[i] = r.marked(record)
+		}
+	case config.REGISTRY_TXT:
+		// the companion TXT record claims every record of the hostname and type
+		txt := r.findTXT(z, hostname, recordType)
+		claimed := txt != nil && txtValue(txt.Content) == r.txtContent()
+		for i := range owned {
+			owned[i] = claimed
+		}
+	default:
+		for i := range owned {
+			owned[i] = true
+		}
+	}
+	return owned
+}
+
+// claimable checks that the records of a hostname and record type may be claimed by this instance.
+// A companion TXT record of another owner is only taken over if the domain adopts its records.
+func (r *registry) claimable(z *zone, hostname, recordType string, adopt bool) error {
+	if r.kind != config.REGISTRY_TXT || adopt {
+		return nil
+	}
+	if txt := r.findTXT(z, hostname, recordType); txt != nil && txtValue(txt.Content) != r.txtContent() {
+		return fmt.Errorf("%s: %w", txt.Name, errOwnershipConflict)
+	}
+	return nil
+}
+
+// claim marks a record as owned by this instance after it was created or adopted. Comment and tag
+// markers are written with the record itself, only the companion TXT record is created here.
+func (r *registry) claim(ctx context.Context, exec *executor, z *zone, hostname, recordType string, adopt bool) error {
+	if r.kind != config.REGISTRY_TXT {
+		return nil
+	}
+	if err := r.claimable(z, hostname, recordType, adopt); err != nil {
+		return err
+	}
+
+	name := r.txtName(hostname, recordType)
+	txt := r.findTXT(z, hostname, recordType)
+
+	var err error
+	if txt == nil {
+		_, err = exec.create(ctx, z, provider.Record{
+			Type:    "TXT",
+			Name:    name,
+			Content: r.txtContent(),
+			TTL:     config.TTL_AUTOMATIC,
+		})
+	} else if txtValue(txt.Content) != r.txtContent() {
+		record := *txt
+		record.Content = r.txtContent()
+		_, err = exec.update(ctx, z, *txt, record)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write ownership record %s: %w", name, err)
+	}
+	return nil
+}
+
+// release removes the ownership of a deleted record, only the companion TXT record needs deleting
+func (r *registry) release(ctx context.Context, exec *executor, z *zone, hostname, recordType string) error {
+	if r.kind != config.REGISTRY_TXT {
+		return nil
+	}
+
+	txt := r.ownTXT(z, hostname, recordType)
+	if txt == nil {
+		return nil
+	}
+
+	if err := exec.delete(ctx, z, *txt); err != nil {
+		return fmt.Errorf("could not delete ownership record %s: %w", txt.Name, err)
+	}
+	return nil
+}
+
+// ownedRecords lists the records of the given types in a zone owned by this instance, nil without a registry
+func (r *registry) ownedRecords(z *zone, recordTypes ...string) []provider.Record {
+	if r.kind == config.REGISTRY_NONE || r.kind == "" {
+		return nil
+	}
+
+	// the companion TXT records are collected once instead of looking them up per record
+	claimed := make(map[string]struct{})
+	if r.kind == config.REGISTRY_TXT {
+		for _, txt := range z.cache.list("TXT") {
+			if strings.HasPrefix(txt.Name, OWNER_TXT_PREFIX) && txtValue(txt.Content) == r.txtContent() {
+				claimed[txt.Name] = struct{}{}
+			}
+		}
+	}
+
+	var owned []provider.Record
+	for _, recordType := range recordTypes {
+		for _, record := range z.cache.list(recordType) {
+			_, ok := claimed[r.txtName(record.Name, record.Type)]
+			if ok || r.marked(record) {
+				owned = append(owned, record)
+			}
+		}
+	}
+
+	return owned
+}
+
+// findTXT returns the cached companion TXT record of a record, nil if there is none
+func (r *registry) findTXT(z *zone, hostname, recordType string) *provider.Record {
+	records := z.cache.get("TXT", r.txtName(hostname, recordType))
+	if len(records) == 0 {
+		return nil
+	}
+	return &records[0]
+}
+
+// ownTXT returns the cached companion TXT record of a record if it names this instance, nil otherwise
+func (r *registry) ownTXT(z *zone, hostname, recordType string) *provider.Record {
+	if r.kind != config.REGISTRY_TXT {
+		return nil
+	}
+	if txt := r.findTXT(z, hostname, recordType); txt != nil && txtValue(txt.Content) == r.txtContent() {
+		return txt
+	}
+	return nil
+}
+
+// txtValue strips the quotes providers may add around TXT contents
+func txtValue(content string) string {
+	return strings.Trim(content, `"`)
+}
@@ -0,0 +1,113 @@
+package cf
+
+import (
+	"errors"
+	"time"
+
+	"github.com/goodieshq/cfdns/pkg/provider"
+)
+
+const (
+	ACTION_NONE    = "none"    // the records already publish the desired addresses
+	ACTION_SKIPPED = "skipped" // the records were not processed, e.g. no public address was found
+)
+
+// Report is the outcome of a processing cycle
+type Report struct {
+	Started  time.Time      // start of the cycle
+	Duration time.Duration  // duration of the cycle
+	DryRun   bool           // whether the changes were only planned
+	Records  []RecordResult // outcome per hostname and record type
+	Changes  []Change       // every change applied (or planned), including ownership records
+	Errors   []error        // errors not tied to a hostname, e.g. unverified zones
+}
+
+// RecordResult is the outcome of reconciling the records of one hostname and record type
+type RecordResult struct {
+	Zone       string        // name of the zone
+	Hostname   string        // name of the records
+	Type       string        // record type, A or AAAA
+	Action     string        // one of the OP_* kinds, update if the changes are mixed, or an ACTION_* outcome
+	OldContent []string      // addresses published before the cycle
+	NewContent []string      // addresses published after the cycle
+	Err        error         // error which prevented the records from converging
+	Duration   time.Duration // time spent reconciling the records
+}
+
+// Changed reports whether any record was changed (or would be, in a dry run)
+func (r *Report) Changed() bool {
+	return len(r.Changes) > 0
+}
+
+// Err returns every error of the cycle joined together, nil if all domains and zones were processed
+func (r *Report) Err() error {
+	errs := make([]error, 0, len(r.Errors))
+	errs = append(errs, r.Errors...)
+	for _, record := range r.Records {
+		if record.Err != nil {
+			errs = append(errs, record.Err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Failed returns the results of the hostnames whose records could not be converged
+func (r *Report) Failed() []RecordResult {
+	var failed []RecordResult
+	for _, record := range r.Records {
+		if record.Err != nil {
+			failed = append(failed, record)
+		}
+	}
+	return failed
+}
+
+// summarizeOps returns the action of a result from the changes made to its records
+func summarizeOps(ops []recordOp) string {
+	if len(ops) == 0 {
+		return ACTION_NONE
+	}
+	for _, op := range ops[1:] {
+		if op.kind != ops[0].kind {
+			return OP_UPDATE
+		}
+	}
+	return ops[0].kind
+}
+
+// recordContents returns the contents of records
+func recordContents(records []provider.Record) []string {
+	contents := make([]string, len(records))
+	for i, record := range records {
+		contents[i] = record.Content
+	}
+	return contents
+}
+
+// contentsAfter returns the contents of records once the changes are applied to them
+func contentsAfter(records []provider.Record, ops []recordOp) []string {
+	changed := make(map[string]recordOp)
+	for _, op := range ops {
+		if op.kind != OP_CREATE {
+			changed[op.record.ID] = op
+		}
+	}
+
+	var contents []string
+	for _, record := range records {
+		op, ok := changed[record.ID]
+		switch {
+		case !ok:
+			contents = append(contents, record.Content)
+		case op.kind == OP_UPDATE:
+			contents = append(contents, op.content)
+		}
+	}
+
+	for _, op := range ops {
+		if op.kind == OP_CREATE {
+			contents = append(contents, op.content)
+		}
+	}
+	return contents
+}
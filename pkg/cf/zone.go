@@ -0,0 +1,288 @@
+package cf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goodieshq/cfdns/pkg/config"
+	"github.com/goodieshq/cfdns/pkg/provider"
+	"github.com/goodieshq/goropo"
+	"github.com/rs/zerolog/log"
+)
+
+// zone is a DNS zone together with the provider hosting it
+type zone struct {
+	id       string            // zone ID at the provider
+	name     string            // zone name (or ID if unknown), used in logs
+	provider provider.Provider // provider managing the zone's records
+	domains  []*config.Domain  // domains published in this zone
+	cache    *recordCache      // records of the zone, refreshed every resync interval
+}
+
+// target is a domain together with the zone its records are published in
+type target struct {
+	zone   *zone
+	domain *config.Domain
+}
+
+// ref returns the zone as known to its provider
+func (z *zone) ref() provider.Zone {
+	return provider.Zone{ID: z.id, Name: z.name}
+}
+
+// errDomainOutsideZone is returned when a configured domain does not belong to its zone
+var errDomainOutsideZone = errors.New("domain does not belong to its zone")
+
+// zoneResolver maps the configured zones to the zones accessible with their providers, sharing
+// Cloudflare providers between zones with the same token. The zones accessible with each provider
+// are listed once, to resolve zones configured by name and to map domains of zones configured
+// without id or name to the zone whose name is the longest suffix of their hostname. Configured zones
+// whose provider cannot list its zones stay pending and are resolved again next cycle, so an outage
+// or an expired token does not affect the other zones.
+type zoneResolver struct {
+	providers map[string]provider.Provider // providers keyed by providerKey
+	zones     []*zone                      // resolved zones
+	byID      map[string]*zone             // resolved zones keyed by provider and zone ID
+	pending   []*config.Zone               // configured zones which are not resolved yet
+}
+
+// newZoneResolver creates the providers of every configured zone, all zones are pending
+func newZoneResolver(cfg *config.Config, httpClient *http.Client) (*zoneResolver, error) {
+	r := &zoneResolver{
+		providers: make(map[string]provider.Provider),
+		byID:      make(map[string]*zone),
+	}
+
+	for i := range cfg.Zones {
+		zc := &cfg.Zones[i]
+		key := providerKey(zc)
+		if _, ok := r.providers[key]; !ok {
+			p, err := newProvider(zc, cfg, httpClient)
+			if err != nil {
+				return nil, fmt.Errorf("zone %s: %w", zc, err)
+			}
+			r.providers[key] = p
+		}
+		r.pending = append(r.pending, zc)
+	}
+
+	return r, nil
+}
+
+// list lists the accessible zones of the providers of the pending zones, each call bounded by the
+// timeout. Providers whose listing failed are missing from the result.
+func (r *zoneResolver) list(ctx context.Context, timeout time.Duration) (map[string][]provider.Zone, map[string]error) {
+	lists := make(map[string][]provider.Zone)
+	errs := make(map[string]error)
+	for _, zc := range r.pending {
+		key := providerKey(zc)
+		if _, ok := lists[key]; ok {
+			continue
+		}
+		if _, ok := errs[key]; ok {
+			continue
+		}
+
+		listCtx, cancel := context.WithTimeout(ctx, timeout)
+		list, err := r.providers[key].Zones(listCtx)
+		cancel()
+		if err != nil {
+			errs[key] = err
+			continue
+		}
+		lists[key] = list
+	}
+	return lists, errs
+}
+
+// resolve maps the pending zones whose provider's zones were listed, and returns an error for every
+// zone which stays pending. A domain outside of its zone wraps errDomainOutsideZone.
+func (r *zoneResolver) resolve(lists map[string][]provider.Zone, errs map[string]error) []error {
+	var failed []error
+	var pending []*config.Zone
+	for _, zc := range r.pending {
+		if err := r.resolveZone(zc, lists, errs); err != nil {
+			failed = append(failed, err)
+			pending = append(pending, zc)
+		}
+	}
+	r.pending = pending
+	return failed
+}
+
+// resolveZone maps the domains of a configured zone to their zones, all or none of them
+func (r *zoneResolver) resolveZone(zc *config.Zone, lists map[string][]provider.Zone, errs map[string]error) error {
+	key := providerKey(zc)
+	list, ok := lists[key]
+	if !ok {
+		return fmt.Errorf("zone %s: could not list zones: %w", zc, errs[key])
+	}
+
+	// zones without id or name: map each domain to its zone by hostname
+	targets := make([]provider.Zone, len(zc.Domains))
+	if zc.ID == "" && zc.Name == "" {
+		for i, domain := range zc.Domains {
+			pz, ok := zoneForHostname(list, domain.Hostname)
+			if !ok {
+				return fmt.Errorf("%w: %s is not in any zone accessible with the configured token", errDomainOutsideZone, domain.Hostname)
+			}
+			targets[i] = pz
+		}
+	} else {
+		pz, ok := findZone(list, zc.ID, zc.Name)
+		if !ok {
+			return fmt.Errorf("zone %s is not accessible with the configured token", zc)
+		}
+		for i, domain := range zc.Domains {
+			if !inZone(domain.Hostname, pz.Name) {
+				return fmt.Errorf("%w: %s is not in zone %s", errDomainOutsideZone, domain.Hostname, pz.Name)
+			}
+			targets[i] = pz
+		}
+		// zones without domains are still verified every cycle
+		r.add(zc, pz)
+	}
+
+	for i := range zc.Domains {
+		z := r.add(zc, targets[i])
+		z.domains = append(z.domains, &zc.Domains[i])
+	}
+	return nil
+}
+
+// add returns the zone for the provider zone, merging domains of zones which resolve to the same id
+func (r *zoneResolver) add(zc *config.Zone, pz provider.Zone) *zone {
+	key := zc.Provider + "/" + pz.ID
+	if z, ok := r.byID[key]; ok {
+		return z
+	}
+	z := &zone{id: pz.ID, name: pz.Name, provider: r.providers[providerKey(zc)], cache: newRecordCache()}
+	r.byID[key] = z
+	r.zones = append(r.zones, z)
+	return z
+}
+
+// pendingHostname reports whether the hostname belongs to a zone which is not resolved yet
+func (r *zoneResolver) pendingHostname(hostname string) bool {
+	for _, zc := range r.pending {
+		for _, domain := range zc.Domains {
+			if domain.Hostname == hostname {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// providerKey identifies the zones sharing a provider: Cloudflare zones share the client of their token
+func providerKey(zc *config.Zone) string {
+	if zc.Provider == config.PROVIDER_CLOUDFLARE {
+		return zc.Provider + "/" + zc.Token
+	}
+	return zc.Provider + "/" + zc.Name
+}
+
+// newProvider creates the provider of a configured zone
+func newProvider(zc *config.Zone, cfg *config.Config, httpClient *http.Client) (provider.Provider, error) {
+	switch zc.Provider {
+	case config.PROVIDER_CLOUDFLARE:
+		return provider.NewCloudflare(zc.Token, httpClient, cfg.Retry)
+	case config.PROVIDER_RFC2136:
+		return provider.NewRFC2136(zc.Name, zc.RFC2136, newBinding(cfg.Bind), cfg.Timeout)
+	case config.PROVIDER_MEMORY:
+		return provider.NewMemory(provider.Zone{ID: zc.ID, Name: zc.Name}), nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q", zc.Provider)
+	}
+}
+
+// findZone returns the zone with the given id, or with the given name if the id is empty
+func findZone(zones []provider.Zone, id, name string) (provider.Zone, bool) {
+	for _, z := range zones {
+		if (id != "" && z.ID == id) || (id == "" && strings.EqualFold(z.Name, name)) {
+			return z, true
+		}
+	}
+	return provider.Zone{}, false
+}
+
+// zoneForHostname returns the zone whose name is the longest suffix of the hostname
+func zoneForHostname(zones []provider.Zone, hostname string) (provider.Zone, bool) {
+	var best provider.Zone
+	found := false
+	for _, z := range zones {
+		if inZone(hostname, z.Name) && len(z.Name) > len(best.Name) {
+			best = z
+			found = true
+		}
+	}
+	return best, found
+}
+
+// inZone reports whether the hostname is the zone apex or a name below it
+func inZone(hostname, zoneName string) bool {
+	hostname = strings.ToLower(hostname)
+	zoneName = strings.ToLower(strings.TrimSuffix(zoneName, "."))
+	return hostname == zoneName || strings.HasSuffix(hostname, "."+zoneName)
+}
+
+// resolveZones retries the resolution of the zones whose provider could not list its zones, and
+// returns an error for every zone which is still pending
+func (cfdns *CFDNS) resolveZones(ctx context.Context) []error {
+	cfdns.resolveMu.Lock()
+	defer cfdns.resolveMu.Unlock()
+
+	cfdns.mu.RLock()
+	resolver := cfdns.resolver
+	cfdns.mu.RUnlock()
+	if resolver == nil || len(resolver.pending) == 0 {
+		return nil
+	}
+
+	// the zones are listed without holding the lock, so a slow provider does not block pushes
+	lists, errs := resolver.list(ctx, ZONE_RESOLVE_TIMEOUT)
+
+	cfdns.mu.Lock()
+	defer cfdns.mu.Unlock()
+
+	// the configuration was replaced while listing
+	if cfdns.resolver != resolver {
+		return nil
+	}
+
+	failed := resolver.resolve(lists, errs)
+	cfdns.zones = resolver.zones
+	for _, err := range failed {
+		log.Error().Err(err).Msg("unable to resolve zone, retrying next cycle")
+	}
+	return failed
+}
+
+// validZones refreshes the record cache of every zone due for a resync in parallel and returns the
+// zones which can be processed, so a failing zone does not affect the others. Listing the records
+// verifies the zone and its credentials, zones with a fresh cache are not verified again.
+// Caller must hold cfdns.mu RLock.
+func (cfdns *CFDNS) validZones(ctx context.Context, exec *executor) []*zone {
+	futs := make([]*goropo.FutureAny, len(cfdns.zones))
+	for i, z := range cfdns.zones {
+		futs[i] = goropo.Submit(cfdns.pool, ctx, func(ctx context.Context) (any, error) {
+			return nil, z.cache.sync(ctx, z, cfdns.cfg.ResyncInterval)
+		})
+	}
+
+	valid := make([]*zone, 0, len(cfdns.zones))
+	for i, fut := range futs {
+		if _, err := fut.Await(ctx); err != nil {
+			exec.fail(fmt.Errorf("zone %s: %w", cfdns.zones[i].name, err))
+			log.Error().Err(err).Str("zone", cfdns.zones[i].name).Msg("unable to list zone records, skipping zone")
+			continue
+		}
+		valid = append(valid, cfdns.zones[i])
+	}
+
+	return valid
+}
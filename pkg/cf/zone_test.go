@@ -0,0 +1,145 @@
+package cf
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goodieshq/cfdns/pkg/config"
+	"github.com/goodieshq/cfdns/pkg/provider"
+)
+
+// loadTestConfig loads a configuration from YAML, as read from a config file
+func loadTestConfig(t *testing.T, data string) *config.Config {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "cfdns.yaml")
+	if err := os.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// flakyProvider is a memory provider whose zones cannot be listed while it is down
+type flakyProvider struct {
+	*provider.Memory
+	down bool
+}
+
+func (p *flakyProvider) Zones(ctx context.Context) ([]provider.Zone, error) {
+	if p.down {
+		return nil, errors.New("service unavailable")
+	}
+	return p.Memory.Zones(ctx)
+}
+
+func TestZoneResolverIsolation(t *testing.T) {
+	cfg := loadTestConfig(t, `
+ipv4: true
+zones:
+  - provider: memory
+    name: a.test
+    domains:
+      - hostname: host.a.test
+  - provider: memory
+    name: b.test
+    domains:
+      - hostname: host.b.test
+`)
+
+	r, err := newZoneResolver(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flaky := &flakyProvider{Memory: provider.NewMemory(provider.Zone{Name: "b.test"}), down: true}
+	r.providers[providerKey(&cfg.Zones[1])] = flaky
+
+	// the zone of the failing provider stays pending without affecting the other one
+	failed := r.resolve(r.list(context.Background(), ZONE_RESOLVE_TIMEOUT))
+	if len(failed) != 1 || errors.Is(failed[0], errDomainOutsideZone) {
+		t.Fatalf("resolve() = %v, want one listing error", failed)
+	}
+	if len(r.zones) != 1 || r.zones[0].name != "a.test" || len(r.zones[0].domains) != 1 {
+		t.Fatalf("resolved zones = %v, want a.test with its domain", r.zones)
+	}
+	if !r.pendingHostname("host.b.test") || r.pendingHostname("host.a.test") {
+		t.Error("pendingHostname() does not report the domains of the pending zone only")
+	}
+
+	// the zone is resolved once its provider recovers
+	flaky.down = false
+	if failed := r.resolve(r.list(context.Background(), ZONE_RESOLVE_TIMEOUT)); len(failed) != 0 {
+		t.Fatalf("resolve() = %v, want no errors", failed)
+	}
+	if len(r.zones) != 2 || len(r.pending) != 0 || r.pendingHostname("host.b.test") {
+		t.Fatalf("resolved zones = %d, pending = %d, want 2 and 0", len(r.zones), len(r.pending))
+	}
+}
+
+func TestZoneResolverRetry(t *testing.T) {
+	cfg := loadTestConfig(t, `
+ipv4: true
+prune: true
+registry:
+  type: txt
+  owner_id: test
+zones:
+  - provider: memory
+    name: a.test
+    domains:
+      - hostname: host.a.test
+`)
+
+	cfdns, err := NewCFDNS(*cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfdns.Close()
+
+	// simulate a provider outage during startup
+	flaky := &flakyProvider{Memory: provider.NewMemory(provider.Zone{Name: "a.test"}), down: true}
+	r, err := newZoneResolver(&cfdns.cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.providers[providerKey(&cfdns.cfg.Zones[0])] = flaky
+	r.resolve(r.list(context.Background(), ZONE_RESOLVE_TIMEOUT))
+	cfdns.resolver, cfdns.zones = r, r.zones
+
+	report := cfdns.Plan(context.Background())
+	if len(report.Errors) != 1 {
+		t.Errorf("Plan() errors = %v, want the pending zone", report.Errors)
+	}
+	if _, err := cfdns.Push(context.Background(), "host.a.test", []string{"1.1.1.1"}); err == nil || errors.Is(err, ErrUnknownHostname) {
+		t.Errorf("Push() error = %v, want a pending zone error", err)
+	}
+
+	// pushes and cycles resolve the zone once the provider recovers
+	flaky.down = false
+	report, err = cfdns.Push(context.Background(), "host.a.test", []string{"1.1.1.1"})
+	if err != nil || report.Err() != nil || !report.Changed() {
+		t.Fatalf("Push() = %v, %v, want a created record", report, err)
+	}
+	if len(cfdns.zones) != 1 || len(r.pending) != 0 {
+		t.Errorf("zones = %d, pending = %d, want 1 and 0", len(cfdns.zones), len(r.pending))
+	}
+}
+
+func TestZoneResolverOutsideZone(t *testing.T) {
+	cfg := loadTestConfig(t, `
+zones:
+  - provider: memory
+    name: a.test
+    domains:
+      - hostname: host.b.test
+`)
+
+	if _, err := NewCFDNS(*cfg); !errors.Is(err, errDomainOutsideZone) {
+		t.Errorf("NewCFDNS() error = %v, want %v", err, errDomainOutsideZone)
+	}
+}
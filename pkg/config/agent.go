@@ -0,0 +1,124 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+type AgentConfig struct {
+	Server    string        `yaml:"server"`     // URL of the cfdns agent report server (e.g. https://cfdns.example.com:8246)
+	Name      string        `yaml:"name"`       // Agent name configured on the server
+	Key       string        `yaml:"key"`        // Pre-shared key of the agent, empty = client certificate only
+	CertFile  string        `yaml:"cert_file"`  // Client certificate for mutual TLS, empty = pre-shared key only
+	KeyFile   string        `yaml:"key_file"`   // Private key of the client certificate
+	CAFile    string        `yaml:"ca_file"`    // CA certificates verifying the server, empty = system roots
+	Frequency time.Duration `yaml:"frequency"`  // Frequency at which to report the addresses
+	Timeout   time.Duration `yaml:"timeout"`    // HTTP timeout duration of the reports
+	Verbose   bool          `yaml:"verbose"`    // Verbose logging output
+	IPv4      *bool         `yaml:"ipv4"`       // report the IPv4 address
+	IPv6      *bool         `yaml:"ipv6"`       // report the IPv6 address
+	Detection Detection     `yaml:"detection"`  // Public IP address discovery settings
+	IPSources []IPSource    `yaml:"ip_sources"` // HTTP services used by the http method, replacing the built-in ones
+	Bind      Bind          `yaml:"bind"`       // Source interface/address for IP discovery
+}
+
+// LoadAgentConfig reads the configuration of an agent reporting its addresses to a cfdns server
+func LoadAgentConfig(filename string) (*AgentConfig, error) {
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file: %w", err)
+	}
+
+	data, err := expandEnv(string(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	var config AgentConfig
+
+	decoder := yaml.NewDecoder(strings.NewReader(data))
+	decoder.SetStrict(true)
+
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("could not parse config file: %w", err)
+	}
+
+	config.Server = strings.TrimRight(strings.TrimSpace(config.Server), "/")
+	u, err := url.Parse(config.Server)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid agent server URL %q", config.Server)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("agent server URL must use https")
+	}
+
+	config.Name = strings.TrimSpace(config.Name)
+	if config.Name == "" || strings.Contains(config.Name, ":") {
+		return nil, fmt.Errorf("agent name cannot be empty or contain ':'")
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must be set together")
+	}
+	if config.Key == "" && config.CertFile == "" {
+		return nil, fmt.Errorf("agent requires a key or a client certificate")
+	}
+
+	if config.Frequency == 0 {
+		config.Frequency = DEFAULT_AGENT_FREQUENCY
+	}
+	if config.Frequency < MINIMUM_FREQUENCY {
+		log.Warn().Msgf("frequency %s is too low, setting to minimum of %s", config.Frequency.String(), MINIMUM_FREQUENCY.String())
+		config.Frequency = MINIMUM_FREQUENCY
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = DEFAULT_TIMEOUT
+	}
+	if config.Timeout < MINIMUM_TIMEOUT {
+		log.Warn().Msgf("timeout %s is too low, setting to minimum of %s", config.Timeout.String(), MINIMUM_TIMEOUT.String())
+		config.Timeout = MINIMUM_TIMEOUT
+	}
+
+	if err := validateBind(&config.Bind); err != nil {
+		return nil, err
+	}
+
+	if err := validateDetection(&config.Detection); err != nil {
+		return nil, err
+	}
+
+	for i := range config.IPSources {
+		if err := validateIPSource(&config.IPSources[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	t := true
+	f := false
+
+	// if neither IPv4 nor IPv6 are explicitly specified, report both
+	if config.IPv4 == nil && config.IPv6 == nil {
+		config.IPv4 = &t
+		config.IPv6 = &t
+	}
+
+	if config.IPv4 == nil {
+		config.IPv4 = &f
+	}
+
+	if config.IPv6 == nil {
+		config.IPv6 = &f
+	}
+
+	if !*config.IPv4 && !*config.IPv6 {
+		return nil, fmt.Errorf("at least one of ipv4 or ipv6 must be enabled")
+	}
+
+	return &config, nil
+}
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"regexp"
 	"strings"
@@ -11,29 +14,211 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-const DEFAULT_FREQUENCY = time.Hour * 1   // default to updating every hour
-const MINIMUM_FREQUENCY = time.Minute * 1 // minimum update frequency is 1 minute
-const DEFAULT_TIMEOUT = time.Second * 10  // default timeout for HTTP requests
-const MINIMUM_TIMEOUT = time.Second * 1   // minimum timeout for HTTP requests
-const DEFAULT_WORKER_COUNT = 10           // default number of concurrent workers
-const MINIMUM_WORKER_COUNT = 1            // minimum number of concurrent workers
-const MAXIMUM_WORKER_COUNT = 100          // maximum number of concurrent workers
+const DEFAULT_FREQUENCY = time.Hour * 1          // default to updating every hour
+const MINIMUM_FREQUENCY = time.Minute * 1        // minimum update frequency is 1 minute
+const DEFAULT_TIMEOUT = time.Second * 10         // default timeout for HTTP requests
+const MINIMUM_TIMEOUT = time.Second * 1          // minimum timeout for HTTP requests
+const DEFAULT_RESYNC_INTERVAL = time.Minute * 30 // default interval between full listings of the cached zone records
+const DEFAULT_RATE_LIMIT = 4.0                   // default Cloudflare API requests per second (1200 per 5 minutes)
+const DEFAULT_RETRY_ATTEMPTS = 5                 // default number of attempts of a Cloudflare API call
+const DEFAULT_RETRY_BASE_DELAY = time.Second * 1 // default delay before the first retry, doubled for every further one
+const DEFAULT_RETRY_MAX_DELAY = time.Minute * 1  // default upper bound of the delay between retries
+const DEFAULT_WORKER_COUNT = 10                  // default number of concurrent workers
+const MINIMUM_WORKER_COUNT = 1                   // minimum number of concurrent workers
+const MAXIMUM_WORKER_COUNT = 100                 // maximum number of concurrent workers
+const DEFAULT_IPV6_PREFIX_LENGTH = 64            // default length of the prefix kept when applying an ipv6_suffix
+const DEFAULT_SOURCE = "default"                 // name of the address source using the global bind and detection
+const DEFAULT_PRUNE_LIMIT = 10                   // default maximum number of records deleted per cycle when pruning
+const DEFAULT_AGENT_FREQUENCY = time.Minute * 5  // default interval between the address reports of an agent
+const MINIMUM_AGENT_KEY_LENGTH = 16              // minimum length of the pre-shared key of an agent
+const TTL_AUTOMATIC = 1                          // Cloudflare's automatic TTL, also used for proxied records
+const MINIMUM_TTL = 30                           // minimum TTL accepted by Cloudflare (60 outside of enterprise zones)
+const MAXIMUM_TTL = 86400                        // maximum TTL accepted by Cloudflare
+
+const REGISTRY_NONE = "none"       // no ownership tracking, every matching record is managed
+const REGISTRY_COMMENT = "comment" // owned records carry the owner marker in their comment
+const REGISTRY_TAG = "tag"         // owned records carry the owner tag
+const REGISTRY_TXT = "txt"         // owned records have a companion TXT record naming the owner
+
+const PROVIDER_CLOUDFLARE = "cloudflare" // records are managed through the Cloudflare API
+const PROVIDER_MEMORY = "memory"         // records are only kept in memory, for trying out a configuration
+const PROVIDER_RFC2136 = "rfc2136"       // records are sent as RFC 2136 dynamic updates to an authoritative server
+
+const TSIG_HMAC_SHA256 = "hmac-sha256" // TSIG algorithm HMAC-SHA256
+const TSIG_HMAC_SHA512 = "hmac-sha512" // TSIG algorithm HMAC-SHA512
+
+const POLICY_SINGLE = "single"     // converge to exactly one record, deleting extra ones
+const POLICY_MULTI = "multi"       // publish one record per address of the domain's sources (round-robin)
+const POLICY_PRESERVE = "preserve" // only update the record owned by cfdns, leaving other records alone
+
+const DETECT_METHOD_HTTP = "http"           // query external HTTP echo services
+const DETECT_METHOD_INTERFACE = "interface" // read addresses assigned to local network interfaces
+const DETECT_METHOD_DNS = "dns"             // query resolvers which echo the client address (OpenDNS, Cloudflare, Google)
+const DETECT_METHOD_STUN = "stun"           // read the mapped address from STUN binding responses
+const DETECT_METHOD_ROUTER = "router"       // ask the local router via NAT-PMP, PCP or UPnP IGD
+
+type Bind struct {
+	Interface string `yaml:"interface"` // Network interface to send traffic from (linux only), empty = any
+	Address   string `yaml:"address"`   // Local source address to send traffic from, empty = any
+}
 
 type Domain struct {
-	Hostname string `yaml:"hostname"` // FQDN of the domain to update
-	Proxied  *bool  `yaml:"proxied"`  // Whether the record is proxied through CloudFlare, nil = leave unchanged
+	Hostname         string   `yaml:"hostname"`           // FQDN of the domain to update
+	Proxied          *bool    `yaml:"proxied"`            // Whether the record is proxied through CloudFlare, nil = leave unchanged
+	IPv6Suffix       string   `yaml:"ipv6_suffix"`        // Interface identifier (e.g. ::10) appended to the detected IPv6 prefix, empty = detected address
+	IPv6PrefixLength int      `yaml:"ipv6_prefix_length"` // Number of prefix bits kept from the detected address, 0 = global default
+	Bind             *Bind    `yaml:"bind"`               // Source interface/address for discovering this domain's address, nil = global bind
+	Source           string   `yaml:"source"`             // Name of the address source publishing this domain, empty = default
+	Sources          []string `yaml:"sources"`            // Names of the address sources published together by the multi policy
+	Policy           string   `yaml:"policy"`             // Handling of multiple records: single (default), multi or preserve
+	TTL              int      `yaml:"ttl"`                // Record TTL in seconds (1 = automatic), 0 = global default
+	Comment          *string  `yaml:"comment"`            // Record comment, nil = global default
+	Tags             []string `yaml:"tags"`               // Record tags (name:value), nil = global default
+	Adopt            bool     `yaml:"adopt"`              // Take over existing records not owned by this instance
+	IPv4             *bool    `yaml:"ipv4"`               // Publish an A record for this domain, nil = global ipv4
+	IPv6             *bool    `yaml:"ipv6"`               // Publish an AAAA record for this domain, nil = global ipv6
+	Pushed           bool     `yaml:"-"`                  // Addresses are pushed by clients (dyndns or agents) instead of detected
+}
+
+type AddressSource struct {
+	Name      string     `yaml:"name"`      // Unique name referenced by domains
+	Bind      Bind       `yaml:"bind"`      // Source interface/address of this uplink
+	Detection *Detection `yaml:"detection"` // Discovery settings of this uplink, nil = global detection
+}
+
+type IPSource struct {
+	Name    string            `yaml:"name"`    // Identifier used in logs, defaults to the URL
+	URL     string            `yaml:"url"`     // HTTP(S) URL returning the client address
+	Family  string            `yaml:"family"`  // Address family returned by the URL: ipv4 or ipv6
+	Headers map[string]string `yaml:"headers"` // Additional request headers
+	Parser  string            `yaml:"parser"`  // Response parser: text (default), json, regex or kv
+	Path    string            `yaml:"path"`    // JSON path for the json parser, e.g. .ip
+	Pattern string            `yaml:"pattern"` // Regular expression with a capture group for the regex parser
+	Key     string            `yaml:"key"`     // Key for the kv parser, e.g. ip for /cdn-cgi/trace
+}
+
+type Router struct {
+	Gateway string `yaml:"gateway"` // Router address for NAT-PMP/PCP, empty = default route gateway
+	IGDURL  string `yaml:"igd_url"` // UPnP IGD device description URL, empty = discover via SSDP
+}
+
+type Quorum struct {
+	Methods   []string `yaml:"methods"`   // Discovery methods queried in parallel, each one is a vote
+	Threshold int      `yaml:"threshold"` // Minimum number of methods which must agree, 0 = simple majority
+}
+
+type Quorums struct {
+	IPv4 *Quorum `yaml:"ipv4"` // Quorum for IPv4 lookups, nil = first working method wins
+	IPv6 *Quorum `yaml:"ipv6"` // Quorum for IPv6 lookups, nil = first working method wins
+}
+
+type Detection struct {
+	Methods      []string `yaml:"methods"`       // Ordered list of discovery methods, later methods are fallbacks
+	Interface    string   `yaml:"interface"`     // Regular expression matched against interface names, empty = the bound interface or all interfaces
+	STUNServers  []string `yaml:"stun_servers"`  // STUN servers (host:port) for the stun method, empty = built-in list
+	Router       Router   `yaml:"router"`        // Router settings for the router method
+	Quorum       Quorums  `yaml:"quorum"`        // Per-family consensus lookups, replacing methods when set
+	AllowedCIDRs []string `yaml:"allowed_cidrs"` // If set, detected addresses must be in one of these ranges (overrides the reserved range check)
+	DeniedCIDRs  []string `yaml:"denied_cidrs"`  // Detected addresses in these ranges are always rejected
+}
+
+type Registry struct {
+	Type    string `yaml:"type"`     // Ownership marker of managed records: none (default), comment, tag or txt
+	OwnerID string `yaml:"owner_id"` // Identifier of this cfdns instance, required unless type is none
+}
+
+type Retry struct {
+	Attempts  int           `yaml:"attempts"`   // Attempts of a Cloudflare API call with a retryable error (rate limit, server, network), 0 = default
+	BaseDelay time.Duration `yaml:"base_delay"` // Delay before the first retry, doubled for every further one with jitter, 0 = default
+	MaxDelay  time.Duration `yaml:"max_delay"`  // Upper bound of the delay between retries, 0 = default
+}
+
+type TSIG struct {
+	Name      string `yaml:"name"`      // Name of the TSIG key, empty = unsigned updates
+	Algorithm string `yaml:"algorithm"` // hmac-sha256 (default) or hmac-sha512
+	Secret    string `yaml:"secret"`    // Base64 encoded secret of the key
+}
+
+type RFC2136 struct {
+	Server string `yaml:"server"` // Authoritative server accepting dynamic updates and zone transfers (host or host:port)
+	TSIG   TSIG   `yaml:"tsig"`   // Key signing the updates and zone transfers
+}
+
+type DynDNSUser struct {
+	Username  string   `yaml:"username"`  // Basic auth user name
+	Password  string   `yaml:"password"`  // Basic auth password
+	Hostnames []string `yaml:"hostnames"` // Configured hostnames the user may update
+}
+
+type DynDNS struct {
+	Listen   string       `yaml:"listen"`    // Address of the dyndns2 update server (e.g. :8245), empty = disabled
+	CertFile string       `yaml:"cert_file"` // TLS certificate of the update server, empty = plain HTTP
+	KeyFile  string       `yaml:"key_file"`  // TLS private key of the update server
+	Users    []DynDNSUser `yaml:"users"`     // Users allowed to push addresses
+}
+
+type Agent struct {
+	Name      string   `yaml:"name"`      // Agent name, also the common name of its client certificate
+	Key       string   `yaml:"key"`       // Pre-shared key of the agent, empty = client certificate only
+	Hostnames []string `yaml:"hostnames"` // Configured hostnames the agent may update
+}
+
+type AgentServer struct {
+	Listen   string  `yaml:"listen"`    // Address of the agent report server (e.g. :8246), empty = disabled
+	CertFile string  `yaml:"cert_file"` // TLS certificate of the report server, required
+	KeyFile  string  `yaml:"key_file"`  // TLS private key of the report server, required
+	ClientCA string  `yaml:"client_ca"` // CA certificates verifying agent client certificates, empty = pre-shared keys only
+	Agents   []Agent `yaml:"agents"`    // Agents allowed to report their addresses
+}
+
+type Zone struct {
+	Provider string   `yaml:"provider"` // DNS provider hosting the zone: cloudflare (default), rfc2136 or memory
+	ID       string   `yaml:"id"`       // CloudFlare Zone ID
+	Name     string   `yaml:"name"`     // CloudFlare Zone name (e.g. example.com), used when the ID is empty; both empty = map each domain to its zone
+	Token    string   `yaml:"token"`    // CloudFlare token for this zone, empty = global token
+	RFC2136  RFC2136  `yaml:"rfc2136"`  // Server settings of rfc2136 zones
+	Domains  []Domain `yaml:"domains"`  // List of domain names to update in this zone
 }
 
 type Config struct {
-	ZoneID      string        `yaml:"zone_id"`      // CloudFlare Zone ID
-	Token       string        `yaml:"token"`        // CloudFlare zone-scoped token (read/write)
-	Frequency   time.Duration `yaml:"frequency"`    // Frequency at which to update the domains
-	Verbose     bool          `yaml:"verbose"`      // Verbose logging output
-	IPv4        *bool         `yaml:"ipv4"`         // use IPv4 A records
-	IPv6        *bool         `yaml:"ipv6"`         // use IPv6 AAAA records
-	Domains     []Domain      `yaml:"domains"`      // List of domain names to update
-	WorkerCount int           `yaml:"worker_count"` // Number of concurrent workers
-	Timeout     time.Duration `yaml:"timeout"`      // HTTP timeout duration
+	ZoneID           string          `yaml:"zone_id"`            // CloudFlare Zone ID of the top-level domains
+	ZoneName         string          `yaml:"zone_name"`          // CloudFlare Zone name of the top-level domains, used when zone_id is empty
+	Token            string          `yaml:"token"`              // CloudFlare zone-scoped token (read/write), default for all zones
+	Frequency        time.Duration   `yaml:"frequency"`          // Frequency at which to update the domains
+	Verbose          bool            `yaml:"verbose"`            // Verbose logging output
+	IPv4             *bool           `yaml:"ipv4"`               // use IPv4 A records
+	IPv6             *bool           `yaml:"ipv6"`               // use IPv6 AAAA records
+	Domains          []Domain        `yaml:"domains"`            // List of domain names to update in the top-level zone
+	Zones            []Zone          `yaml:"zones"`              // Additional zones, each with its own token and domains
+	WorkerCount      int             `yaml:"worker_count"`       // Number of concurrent workers
+	Timeout          time.Duration   `yaml:"timeout"`            // HTTP timeout duration
+	Detection        Detection       `yaml:"detection"`          // Public IP address discovery settings
+	IPSources        []IPSource      `yaml:"ip_sources"`         // HTTP services used by the http method, replacing the built-in ones
+	IPv6PrefixLength int             `yaml:"ipv6_prefix_length"` // Default prefix length for domains with an ipv6_suffix
+	Bind             Bind            `yaml:"bind"`               // Source interface/address for IP discovery and Cloudflare API traffic
+	Sources          []AddressSource `yaml:"sources"`            // Named address sources (e.g. one per uplink) referenced by domains
+	TTL              int             `yaml:"ttl"`                // Default record TTL in seconds (1 = automatic), 0 = leave unchanged
+	Comment          *string         `yaml:"comment"`            // Default record comment, nil = leave unchanged
+	Tags             []string        `yaml:"tags"`               // Default record tags, nil = leave unchanged
+	Registry         Registry        `yaml:"registry"`           // Ownership tracking, so records created by others are not modified
+	Prune            bool            `yaml:"prune"`              // Delete owned records of hostnames (and families) no longer configured
+	PruneLimit       int             `yaml:"prune_limit"`        // Maximum number of records deleted per cycle, 0 = default
+	ResyncInterval   time.Duration   `yaml:"resync_interval"`    // Interval between full listings of the zone records, catching external edits
+	RateLimit        float64         `yaml:"rate_limit"`         // Cloudflare API requests per second shared by all workers, 0 = default
+	Retry            Retry           `yaml:"retry"`              // Retries of failed Cloudflare API calls
+	DynDNS           DynDNS          `yaml:"dyndns"`             // DynDNS2 update server, so routers push their addresses
+	AgentServer      AgentServer     `yaml:"agent_server"`       // Report server of cfdns agents detecting their own addresses
+}
+
+// AllDomains returns pointers to the domains of every zone
+func (config *Config) AllDomains() []*Domain {
+	var domains []*Domain
+	for i := range config.Zones {
+		for j := range config.Zones[i].Domains {
+			domains = append(domains, &config.Zones[i].Domains[j])
+		}
+	}
+	return domains
 }
 
 // Environment variable names for sensitive config values
@@ -84,18 +269,59 @@ func LoadConfig(filename string) (*Config, error) {
 		return nil, fmt.Errorf("could not parse config file: %w", err)
 	}
 
-	config.ZoneID = strings.TrimSpace(config.ZoneID)
-	if config.ZoneID == "" {
-		return nil, fmt.Errorf("zone id cannot be empty")
+	if err := validateZones(&config); err != nil {
+		return nil, err
 	}
 
-	config.Token = strings.TrimSpace(config.Token)
-	if config.Token == "" {
-		return nil, fmt.Errorf("API token cannot be empty")
+	if config.IPv6PrefixLength == 0 {
+		config.IPv6PrefixLength = DEFAULT_IPV6_PREFIX_LENGTH
+	}
+	if config.IPv6PrefixLength < 1 || config.IPv6PrefixLength > 127 {
+		return nil, fmt.Errorf("ipv6_prefix_length must be between 1 and 127")
 	}
 
-	if len(config.Domains) == 0 {
-		return nil, fmt.Errorf("domains list cannot be empty")
+	for i := range config.Zones {
+		zone := &config.Zones[i]
+		for j := range zone.Domains {
+			domain := &zone.Domains[j]
+			if err := validateIPv6Suffix(domain, config.IPv6PrefixLength); err != nil {
+				return nil, err
+			}
+			if domain.Bind != nil {
+				if err := validateBind(domain.Bind); err != nil {
+					return nil, fmt.Errorf("domain %s: %w", domain.Hostname, err)
+				}
+			}
+			if err := validateRecordSettings(domain, zone, &config); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := validateBind(&config.Bind); err != nil {
+		return nil, err
+	}
+
+	if err := validateRegistry(&config.Registry); err != nil {
+		return nil, err
+	}
+
+	if err := validateProviders(&config); err != nil {
+		return nil, err
+	}
+
+	if config.Prune && config.Registry.Type == REGISTRY_NONE {
+		return nil, fmt.Errorf("prune requires a registry so only records owned by this instance are deleted")
+	}
+	if config.PruneLimit == 0 {
+		config.PruneLimit = DEFAULT_PRUNE_LIMIT
+	}
+	if config.PruneLimit < 0 {
+		return nil, fmt.Errorf("prune_limit cannot be negative")
+	}
+
+	if err := validateSources(&config); err != nil {
+		return nil, err
 	}
 
 	if config.Frequency == 0 {
@@ -106,6 +332,25 @@ func LoadConfig(filename string) (*Config, error) {
 		config.Frequency = MINIMUM_FREQUENCY
 	}
 
+	if config.ResyncInterval == 0 {
+		config.ResyncInterval = DEFAULT_RESYNC_INTERVAL
+	}
+	if config.ResyncInterval < 0 {
+		return nil, fmt.Errorf("resync_interval cannot be negative")
+	}
+
+	if err := validateRetry(&config); err != nil {
+		return nil, err
+	}
+
+	if err := validateDynDNS(&config); err != nil {
+		return nil, err
+	}
+
+	if err := validateAgentServer(&config); err != nil {
+		return nil, err
+	}
+
 	if config.Timeout == 0 {
 		config.Timeout = DEFAULT_TIMEOUT
 	}
@@ -126,6 +371,16 @@ func LoadConfig(filename string) (*Config, error) {
 		config.WorkerCount = MAXIMUM_WORKER_COUNT
 	}
 
+	if err := validateDetection(&config.Detection); err != nil {
+		return nil, err
+	}
+
+	for i := range config.IPSources {
+		if err := validateIPSource(&config.IPSources[i]); err != nil {
+			return nil, err
+		}
+	}
+
 	t := true
 	f := false
 
@@ -147,5 +402,613 @@ func LoadConfig(filename string) (*Config, error) {
 		return nil, fmt.Errorf("at least one of ipv4 or ipv6 must be enabled")
 	}
 
+	// domains publish the globally enabled address families unless they choose their own
+	for _, domain := range config.AllDomains() {
+		if domain.IPv4 == nil {
+			domain.IPv4 = config.IPv4
+		}
+		if domain.IPv6 == nil {
+			domain.IPv6 = config.IPv6
+		}
+	}
+
 	return &config, nil
 }
+
+// validateDetection normalizes the detection methods and validates the interface filter
+func validateDetection(detection *Detection) error {
+	if len(detection.Methods) == 0 {
+		detection.Methods = []string{DETECT_METHOD_HTTP}
+	}
+
+	if err := validateMethods(detection.Methods); err != nil {
+		return err
+	}
+
+	for family, quorum := range map[string]*Quorum{"ipv4": detection.Quorum.IPv4, "ipv6": detection.Quorum.IPv6} {
+		if quorum == nil {
+			continue
+		}
+		if len(quorum.Methods) == 0 {
+			return fmt.Errorf("%s quorum methods cannot be empty", family)
+		}
+		if err := validateMethods(quorum.Methods); err != nil {
+			return err
+		}
+		if quorum.Threshold == 0 {
+			quorum.Threshold = len(quorum.Methods)/2 + 1
+		}
+		if quorum.Threshold < 1 || quorum.Threshold > len(quorum.Methods) {
+			return fmt.Errorf("%s quorum threshold must be between 1 and %d", family, len(quorum.Methods))
+		}
+	}
+
+	if _, err := regexp.Compile(detection.Interface); err != nil {
+		return fmt.Errorf("invalid detection interface pattern: %w", err)
+	}
+
+	for _, server := range detection.STUNServers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return fmt.Errorf("invalid STUN server %q: %w", server, err)
+		}
+	}
+
+	for _, cidrs := range [][]string{detection.AllowedCIDRs, detection.DeniedCIDRs} {
+		for i, cidr := range cidrs {
+			cidrs[i] = strings.TrimSpace(cidr)
+			if _, _, err := net.ParseCIDR(cidrs[i]); err != nil {
+				return fmt.Errorf("invalid detection CIDR %q: %w", cidr, err)
+			}
+		}
+	}
+
+	detection.Router.Gateway = strings.TrimSpace(detection.Router.Gateway)
+	if detection.Router.Gateway != "" && net.ParseIP(detection.Router.Gateway).To4() == nil {
+		return fmt.Errorf("invalid router gateway %q: must be an IPv4 address", detection.Router.Gateway)
+	}
+
+	detection.Router.IGDURL = strings.TrimSpace(detection.Router.IGDURL)
+	if detection.Router.IGDURL != "" {
+		if u, err := url.Parse(detection.Router.IGDURL); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid router igd_url %q", detection.Router.IGDURL)
+		}
+	}
+
+	return nil
+}
+
+// validateMethods normalizes a list of detection methods in place, rejecting unknown methods
+func validateMethods(methods []string) error {
+	for i, method := range methods {
+		method = strings.ToLower(strings.TrimSpace(method))
+		switch method {
+		case DETECT_METHOD_HTTP, DETECT_METHOD_INTERFACE, DETECT_METHOD_DNS, DETECT_METHOD_STUN, DETECT_METHOD_ROUTER:
+		default:
+			return fmt.Errorf("unknown detection method: %q", method)
+		}
+		methods[i] = method
+	}
+	return nil
+}
+
+// validateIPSource normalizes an HTTP IP source and checks that its parser is usable
+func validateIPSource(source *IPSource) error {
+	source.URL = strings.TrimSpace(source.URL)
+	u, err := url.Parse(source.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid ip_sources url %q", source.URL)
+	}
+
+	if source.Name == "" {
+		source.Name = source.URL
+	}
+
+	source.Family = strings.ToLower(strings.TrimSpace(source.Family))
+	if source.Family != "ipv4" && source.Family != "ipv6" {
+		return fmt.Errorf("ip_sources %q: family must be ipv4 or ipv6", source.Name)
+	}
+
+	source.Parser = strings.ToLower(strings.TrimSpace(source.Parser))
+	switch source.Parser {
+	case "", "text":
+		source.Parser = "text"
+	case "json":
+		if strings.TrimPrefix(strings.TrimSpace(source.Path), ".") == "" {
+			return fmt.Errorf("ip_sources %q: json parser requires a path", source.Name)
+		}
+	case "regex":
+		if source.Pattern == "" {
+			return fmt.Errorf("ip_sources %q: regex parser requires a pattern", source.Name)
+		}
+		if _, err := regexp.Compile(source.Pattern); err != nil {
+			return fmt.Errorf("ip_sources %q: invalid pattern: %w", source.Name, err)
+		}
+	case "kv":
+		if strings.TrimSpace(source.Key) == "" {
+			return fmt.Errorf("ip_sources %q: kv parser requires a key", source.Name)
+		}
+	default:
+		return fmt.Errorf("ip_sources %q: unknown parser %q", source.Name, source.Parser)
+	}
+
+	return nil
+}
+
+// validateIPv6Suffix checks the domain's interface identifier and applies the default prefix length
+func validateIPv6Suffix(domain *Domain, defaultPrefixLength int) error {
+	domain.IPv6Suffix = strings.TrimSpace(domain.IPv6Suffix)
+	if domain.IPv6Suffix == "" {
+		return nil
+	}
+
+	if ip := net.ParseIP(domain.IPv6Suffix); ip == nil || ip.To4() != nil {
+		return fmt.Errorf("domain %s: invalid ipv6_suffix %q", domain.Hostname, domain.IPv6Suffix)
+	}
+
+	if domain.IPv6PrefixLength == 0 {
+		domain.IPv6PrefixLength = defaultPrefixLength
+	}
+	if domain.IPv6PrefixLength < 1 || domain.IPv6PrefixLength > 127 {
+		return fmt.Errorf("domain %s: ipv6_prefix_length must be between 1 and 127", domain.Hostname)
+	}
+
+	return nil
+}
+
+// validateTTL checks that a TTL is automatic or within the range accepted by Cloudflare, 0 is unset
+func validateTTL(ttl int) error {
+	if ttl == 0 || ttl == TTL_AUTOMATIC {
+		return nil
+	}
+	if ttl < MINIMUM_TTL || ttl > MAXIMUM_TTL {
+		return fmt.Errorf("ttl must be %d (automatic) or between %d and %d", TTL_AUTOMATIC, MINIMUM_TTL, MAXIMUM_TTL)
+	}
+	return nil
+}
+
+// validateRecordSettings applies the global TTL, comment and tags to a domain which does not set its own.
+// An rfc2136 server does not support automatic TTLs, proxying, comments and tags, so its domains do
+// not inherit them and must not set them.
+func validateRecordSettings(domain *Domain, zone *Zone, config *Config) error {
+	if err := validateTTL(config.TTL); err != nil {
+		return err
+	}
+	if err := validateTTL(domain.TTL); err != nil {
+		return fmt.Errorf("domain %s: %w", domain.Hostname, err)
+	}
+
+	dnsOnly := zone.Provider == PROVIDER_RFC2136
+	if dnsOnly {
+		var setting string
+		switch {
+		case domain.TTL == TTL_AUTOMATIC:
+			setting = "automatic ttl"
+		case domain.Proxied != nil && *domain.Proxied:
+			setting = "proxied"
+		case domain.Comment != nil:
+			setting = "comment"
+		case domain.Tags != nil:
+			setting = "tags"
+		}
+		if setting != "" {
+			return fmt.Errorf("domain %s: the %s provider does not support %s", domain.Hostname, zone.Provider, setting)
+		}
+		domain.Proxied = nil
+	}
+
+	if domain.TTL == 0 && !(dnsOnly && config.TTL == TTL_AUTOMATIC) {
+		domain.TTL = config.TTL
+	}
+	if domain.Comment == nil && !dnsOnly {
+		domain.Comment = config.Comment
+	}
+	if domain.Tags == nil && !dnsOnly {
+		domain.Tags = config.Tags
+	}
+
+	// copy the tags so normalizing them does not alias the global list
+	tags := make([]string, 0, len(domain.Tags))
+	for _, tag := range domain.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return fmt.Errorf("domain %s: tags cannot be empty", domain.Hostname)
+		}
+		tags = append(tags, tag)
+	}
+	if domain.Tags != nil {
+		domain.Tags = tags
+	}
+
+	return nil
+}
+
+// owner IDs end up in comments, tags and TXT contents, so they are restricted to a safe character set
+var reOwnerID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// validateRegistry normalizes the registry type and checks the owner ID
+func validateRegistry(registry *Registry) error {
+	registry.Type = strings.ToLower(strings.TrimSpace(registry.Type))
+	registry.OwnerID = strings.TrimSpace(registry.OwnerID)
+
+	switch registry.Type {
+	case "", REGISTRY_NONE:
+		registry.Type = REGISTRY_NONE
+		return nil
+	case REGISTRY_COMMENT, REGISTRY_TAG, REGISTRY_TXT:
+	default:
+		return fmt.Errorf("unknown registry type: %q", registry.Type)
+	}
+
+	if registry.OwnerID == "" {
+		return fmt.Errorf("registry owner_id cannot be empty")
+	}
+	if !reOwnerID.MatchString(registry.OwnerID) {
+		return fmt.Errorf("invalid registry owner_id %q: only letters, digits, '.', '_' and '-' are allowed", registry.OwnerID)
+	}
+
+	return nil
+}
+
+// validateRFC2136 checks the server and TSIG key of an rfc2136 zone
+func validateRFC2136(rfc *RFC2136) error {
+	rfc.Server = strings.TrimSpace(rfc.Server)
+	if rfc.Server == "" {
+		return fmt.Errorf("rfc2136 server cannot be empty")
+	}
+	if _, _, err := net.SplitHostPort(rfc.Server); err != nil {
+		rfc.Server = net.JoinHostPort(strings.Trim(rfc.Server, "[]"), "53")
+	}
+
+	tsig := &rfc.TSIG
+	tsig.Name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(tsig.Name), "."))
+	tsig.Algorithm = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(tsig.Algorithm), "."))
+	tsig.Secret = strings.TrimSpace(tsig.Secret)
+	if tsig.Name == "" {
+		if tsig.Secret != "" {
+			return fmt.Errorf("rfc2136 tsig name cannot be empty when a secret is set")
+		}
+		return nil
+	}
+
+	switch tsig.Algorithm {
+	case "":
+		tsig.Algorithm = TSIG_HMAC_SHA256
+	case TSIG_HMAC_SHA256, TSIG_HMAC_SHA512:
+	default:
+		return fmt.Errorf("invalid rfc2136 tsig algorithm %q: must be %s or %s", tsig.Algorithm, TSIG_HMAC_SHA256, TSIG_HMAC_SHA512)
+	}
+
+	if secret, err := base64.StdEncoding.DecodeString(tsig.Secret); err != nil || len(secret) == 0 {
+		return fmt.Errorf("rfc2136 tsig secret must be a non-empty base64 string")
+	}
+
+	return nil
+}
+
+// validateProviders checks the registry against the features of each zone's provider, the record
+// settings are checked by validateRecordSettings
+func validateProviders(config *Config) error {
+	for i := range config.Zones {
+		zone := &config.Zones[i]
+		if zone.Provider != PROVIDER_RFC2136 {
+			continue
+		}
+
+		switch config.Registry.Type {
+		case REGISTRY_COMMENT, REGISTRY_TAG:
+			return fmt.Errorf("zone %s: registry type %s is not supported by the %s provider, use txt", zone, config.Registry.Type, zone.Provider)
+		}
+	}
+	return nil
+}
+
+// validateDynDNS checks the users of the update server and marks the domains they update as pushed,
+// so they are no longer updated with detected addresses
+func validateDynDNS(config *Config) error {
+	dyndns := &config.DynDNS
+	dyndns.Listen = strings.TrimSpace(dyndns.Listen)
+	if dyndns.Listen == "" {
+		if len(dyndns.Users) > 0 {
+			return fmt.Errorf("dyndns users require a listen address")
+		}
+		return nil
+	}
+
+	if (dyndns.CertFile == "") != (dyndns.KeyFile == "") {
+		return fmt.Errorf("dyndns cert_file and key_file must be set together")
+	}
+	if len(dyndns.Users) == 0 {
+		return fmt.Errorf("dyndns users list cannot be empty")
+	}
+
+	seen := make(map[string]struct{})
+	for i := range dyndns.Users {
+		user := &dyndns.Users[i]
+		user.Username = strings.TrimSpace(user.Username)
+		if user.Username == "" || strings.Contains(user.Username, ":") {
+			return fmt.Errorf("dyndns username cannot be empty or contain ':'")
+		}
+		if _, ok := seen[user.Username]; ok {
+			return fmt.Errorf("duplicate dyndns user: %s", user.Username)
+		}
+		seen[user.Username] = struct{}{}
+
+		if user.Password == "" {
+			return fmt.Errorf("dyndns user %s: password cannot be empty", user.Username)
+		}
+		if len(user.Hostnames) == 0 {
+			return fmt.Errorf("dyndns user %s: hostnames list cannot be empty", user.Username)
+		}
+
+		if err := markPushed(config, user.Hostnames); err != nil {
+			return fmt.Errorf("dyndns user %s: %w", user.Username, err)
+		}
+	}
+
+	return nil
+}
+
+// validateAgentServer checks the agents of the report server and marks the domains they update as
+// pushed, so they are no longer updated with detected addresses
+func validateAgentServer(config *Config) error {
+	server := &config.AgentServer
+	server.Listen = strings.TrimSpace(server.Listen)
+	if server.Listen == "" {
+		if len(server.Agents) > 0 {
+			return fmt.Errorf("agent_server agents require a listen address")
+		}
+		return nil
+	}
+
+	// agents authenticate with secrets, so reports are only accepted over TLS
+	if server.CertFile == "" || server.KeyFile == "" {
+		return fmt.Errorf("agent_server requires cert_file and key_file")
+	}
+	if len(server.Agents) == 0 {
+		return fmt.Errorf("agent_server agents list cannot be empty")
+	}
+
+	seen := make(map[string]struct{})
+	for i := range server.Agents {
+		agent := &server.Agents[i]
+		agent.Name = strings.TrimSpace(agent.Name)
+		if agent.Name == "" || strings.Contains(agent.Name, ":") {
+			return fmt.Errorf("agent name cannot be empty or contain ':'")
+		}
+		if _, ok := seen[agent.Name]; ok {
+			return fmt.Errorf("duplicate agent: %s", agent.Name)
+		}
+		seen[agent.Name] = struct{}{}
+
+		switch {
+		case agent.Key == "" && server.ClientCA == "":
+			return fmt.Errorf("agent %s: key is required without a client_ca", agent.Name)
+		case agent.Key != "" && len(agent.Key) < MINIMUM_AGENT_KEY_LENGTH:
+			return fmt.Errorf("agent %s: key must be at least %d characters", agent.Name, MINIMUM_AGENT_KEY_LENGTH)
+		}
+		if len(agent.Hostnames) == 0 {
+			return fmt.Errorf("agent %s: hostnames list cannot be empty", agent.Name)
+		}
+
+		if err := markPushed(config, agent.Hostnames); err != nil {
+			return fmt.Errorf("agent %s: %w", agent.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// markPushed normalizes hostnames updated by clients and marks their domains as pushed
+func markPushed(config *Config, hostnames []string) error {
+	domains := make(map[string][]*Domain)
+	for _, domain := range config.AllDomains() {
+		domains[domain.Hostname] = append(domains[domain.Hostname], domain)
+	}
+
+	for i, hostname := range hostnames {
+		hostname = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(hostname), "."))
+		if _, ok := domains[hostname]; !ok {
+			return fmt.Errorf("hostname %s is not a configured domain", hostname)
+		}
+		for _, domain := range domains[hostname] {
+			domain.Pushed = true
+		}
+		hostnames[i] = hostname
+	}
+	return nil
+}
+
+// validateRetry applies the defaults of the API rate limit and retries
+func validateRetry(config *Config) error {
+	if config.RateLimit == 0 {
+		config.RateLimit = DEFAULT_RATE_LIMIT
+	}
+	if config.RateLimit < 0 {
+		return fmt.Errorf("rate_limit cannot be negative")
+	}
+
+	retry := &config.Retry
+	if retry.Attempts == 0 {
+		retry.Attempts = DEFAULT_RETRY_ATTEMPTS
+	}
+	if retry.BaseDelay == 0 {
+		retry.BaseDelay = DEFAULT_RETRY_BASE_DELAY
+	}
+	if retry.MaxDelay == 0 {
+		retry.MaxDelay = DEFAULT_RETRY_MAX_DELAY
+	}
+	if retry.Attempts < 1 || retry.BaseDelay < 0 || retry.MaxDelay < retry.BaseDelay {
+		return fmt.Errorf("retry attempts must be at least 1 and max_delay must not be below base_delay")
+	}
+
+	return nil
+}
+
+// validateBind normalizes a source binding and checks its address
+func validateBind(bind *Bind) error {
+	bind.Interface = strings.TrimSpace(bind.Interface)
+	bind.Address = strings.TrimSpace(bind.Address)
+	if bind.Address != "" && net.ParseIP(bind.Address) == nil {
+		return fmt.Errorf("invalid bind address %q", bind.Address)
+	}
+	return nil
+}
+
+// validateSources checks the named address sources and that every domain references a known one
+func validateSources(config *Config) error {
+	names := map[string]struct{}{DEFAULT_SOURCE: {}}
+	for i := range config.Sources {
+		source := &config.Sources[i]
+		source.Name = strings.TrimSpace(source.Name)
+		if source.Name == "" {
+			return fmt.Errorf("address source name cannot be empty")
+		}
+		if _, ok := names[source.Name]; ok {
+			return fmt.Errorf("duplicate address source name: %s", source.Name)
+		}
+		names[source.Name] = struct{}{}
+
+		if err := validateBind(&source.Bind); err != nil {
+			return fmt.Errorf("address source %s: %w", source.Name, err)
+		}
+		if source.Detection != nil {
+			if err := validateDetection(source.Detection); err != nil {
+				return fmt.Errorf("address source %s: %w", source.Name, err)
+			}
+		}
+	}
+
+	for _, domain := range config.AllDomains() {
+		domain.Policy = strings.ToLower(strings.TrimSpace(domain.Policy))
+		switch domain.Policy {
+		case "":
+			domain.Policy = POLICY_SINGLE
+		case POLICY_SINGLE, POLICY_MULTI, POLICY_PRESERVE:
+		default:
+			return fmt.Errorf("domain %s: unknown policy %q", domain.Hostname, domain.Policy)
+		}
+
+		domain.Source = strings.TrimSpace(domain.Source)
+		if len(domain.Sources) > 0 {
+			if domain.Policy != POLICY_MULTI {
+				return fmt.Errorf("domain %s: sources requires the multi policy", domain.Hostname)
+			}
+			if domain.Source != "" || domain.Bind != nil {
+				return fmt.Errorf("domain %s: sources cannot be combined with source or bind", domain.Hostname)
+			}
+		}
+
+		seen := make(map[string]struct{})
+		for i, name := range domain.Sources {
+			name = strings.TrimSpace(name)
+			if _, ok := names[name]; !ok {
+				return fmt.Errorf("domain %s: unknown address source %q", domain.Hostname, name)
+			}
+			if _, ok := seen[name]; ok {
+				return fmt.Errorf("domain %s: duplicate address source %q", domain.Hostname, name)
+			}
+			seen[name] = struct{}{}
+			domain.Sources[i] = name
+		}
+
+		if domain.Source == "" {
+			continue
+		}
+		if domain.Bind != nil {
+			return fmt.Errorf("domain %s: bind and source cannot both be set", domain.Hostname)
+		}
+		if _, ok := names[domain.Source]; !ok {
+			return fmt.Errorf("domain %s: unknown address source %q", domain.Hostname, domain.Source)
+		}
+	}
+
+	return nil
+}
+
+// validateZones moves the top-level zone into the zones list and checks that every zone is usable
+func validateZones(config *Config) error {
+	config.ZoneID = strings.TrimSpace(config.ZoneID)
+	config.ZoneName = strings.TrimSpace(config.ZoneName)
+	config.Token = strings.TrimSpace(config.Token)
+
+	// the top-level zone and domains are kept for single zone configurations
+	if len(config.Domains) > 0 {
+		config.Zones = append([]Zone{{ID: config.ZoneID, Name: config.ZoneName, Domains: config.Domains}}, config.Zones...)
+		config.Domains = nil
+	} else if config.ZoneID != "" || config.ZoneName != "" {
+		return fmt.Errorf("domains list cannot be empty")
+	}
+
+	if len(config.Zones) == 0 {
+		return fmt.Errorf("zones list cannot be empty")
+	}
+
+	seen := make(map[string]struct{})
+	for i := range config.Zones {
+		zone := &config.Zones[i]
+		zone.ID = strings.TrimSpace(zone.ID)
+		zone.Name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(zone.Name), "."))
+		zone.Token = strings.TrimSpace(zone.Token)
+		zone.Provider = strings.ToLower(strings.TrimSpace(zone.Provider))
+		if zone.Provider == "" {
+			zone.Provider = PROVIDER_CLOUDFLARE
+		}
+
+		// zones without id and name are resolved per domain, so they may repeat with different tokens
+		// a zone may be hosted by several providers, e.g. split-horizon zones on cloudflare and rfc2136
+		if zone.ID != "" || zone.Name != "" {
+			key := zone.Provider + "/" + zone.ID + "/" + zone.Name
+			if _, ok := seen[key]; ok {
+				return fmt.Errorf("duplicate zone: %s", zone)
+			}
+			seen[key] = struct{}{}
+		}
+
+		switch zone.Provider {
+		case PROVIDER_CLOUDFLARE:
+			if zone.Token == "" {
+				zone.Token = config.Token
+			}
+			if zone.Token == "" {
+				return fmt.Errorf("zone %s: API token cannot be empty", zone)
+			}
+		case PROVIDER_MEMORY, PROVIDER_RFC2136:
+			// only Cloudflare can list the zones to map domains to
+			if zone.Name == "" {
+				return fmt.Errorf("zone %s: name is required for the %s provider", zone, zone.Provider)
+			}
+			if zone.Provider == PROVIDER_RFC2136 {
+				if err := validateRFC2136(&zone.RFC2136); err != nil {
+					return fmt.Errorf("zone %s: %w", zone, err)
+				}
+			}
+		default:
+			return fmt.Errorf("zone %s: invalid provider %q", zone, zone.Provider)
+		}
+
+		if len(zone.Domains) == 0 {
+			return fmt.Errorf("zone %s: domains list cannot be empty", zone)
+		}
+
+		for j := range zone.Domains {
+			domain := &zone.Domains[j]
+			domain.Hostname = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain.Hostname), "."))
+			if domain.Hostname == "" {
+				return fmt.Errorf("zone %s: hostname cannot be empty", zone)
+			}
+		}
+	}
+
+	return nil
+}
+
+// String returns the zone name if known, otherwise the zone ID
+func (zone *Zone) String() string {
+	switch {
+	case zone.Name != "":
+		return zone.Name
+	case zone.ID != "":
+		return zone.ID
+	}
+	return "(auto)"
+}
@@ -0,0 +1,196 @@
+package dyndns
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/goodieshq/cfdns/pkg/cf"
+	"github.com/goodieshq/cfdns/pkg/config"
+	"github.com/goodieshq/cfdns/pkg/ipget"
+	"github.com/rs/zerolog/log"
+)
+
+const UPDATE_PATH = "/nic/update" // path of the dyndns2 update endpoint
+const MAX_HOSTNAMES = 20          // maximum number of hostnames in one request
+const AUTH_REALM = "cfdns"        // realm of the basic auth challenge
+
+const (
+	CODE_GOOD     = "good"    // the records were updated to the address
+	CODE_NOCHG    = "nochg"   // the records already published the address
+	CODE_BADAUTH  = "badauth" // the user name or password is wrong
+	CODE_NOHOST   = "nohost"  // the hostname is not configured or not allowed for the user
+	CODE_NOTFQDN  = "notfqdn" // the hostname is not a fully qualified domain name
+	CODE_NUMHOST  = "numhost" // too many hostnames were given in one request
+	CODE_DNSERR   = "dnserr"  // the records could not be updated
+	CODE_BADIP    = "badip"   // the address is invalid or rejected by the detection settings (not part of dyndns2, clients treat it as fatal)
+	CODE_SERVFAIL = "911"     // the server failed to process the request, the client retries later
+)
+
+// user is a dyndns user with the hostnames it may update
+type user struct {
+	password  [sha256.Size]byte // hash of the password, compared in constant time
+	hostnames []string          // hostnames the user may update
+}
+
+// Server implements the dyndns2 update protocol, so routers which know their WAN address push it
+// instead of cfdns detecting it. Each request is published through CFDNS.Push.
+type Server struct {
+	cfdns *cf.CFDNS
+
+	mu    sync.RWMutex
+	users map[string]user // users keyed by name
+}
+
+// NewServer creates an update server publishing pushed addresses with the cfdns instance
+func NewServer(cfdns *cf.CFDNS, cfg config.DynDNS) *Server {
+	s := &Server{cfdns: cfdns}
+	s.SetConfig(cfg)
+	return s
+}
+
+// SetConfig replaces the users of the server
+func (s *Server) SetConfig(cfg config.DynDNS) {
+	users := make(map[string]user, len(cfg.Users))
+	for _, u := range cfg.Users {
+		users[u.Username] = user{password: sha256.Sum256([]byte(u.Password)), hostnames: u.Hostnames}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = users
+}
+
+// authenticate returns the user of the request's basic auth credentials
+func (s *Server) authenticate(r *http.Request) (string, user, bool) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return "", user{}, false
+	}
+
+	s.mu.RLock()
+	u, found := s.users[name]
+	s.mu.RUnlock()
+
+	hash := sha256.Sum256([]byte(password))
+	if subtle.ConstantTimeCompare(hash[:], u.password[:]) != 1 || !found {
+		return "", user{}, false
+	}
+	return name, u, true
+}
+
+// ServeHTTP handles /nic/update?hostname=...&myip=... requests, answering one code per hostname
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != UPDATE_PATH {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	name, u, ok := s.authenticate(r)
+	if !ok {
+		log.Warn().Str("remote", r.RemoteAddr).Msg("dyndns request with invalid credentials")
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+AUTH_REALM+`"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, CODE_BADAUTH)
+		return
+	}
+
+	query := r.URL.Query()
+	hostnames := splitList(query.Get("hostname"))
+	if len(hostnames) == 0 {
+		fmt.Fprintln(w, CODE_NOTFQDN)
+		return
+	}
+	if len(hostnames) > MAX_HOSTNAMES {
+		fmt.Fprintln(w, CODE_NUMHOST)
+		return
+	}
+
+	addresses := requestAddresses(r)
+	if len(addresses) == 0 {
+		fmt.Fprintln(w, CODE_SERVFAIL)
+		return
+	}
+
+	for _, hostname := range hostnames {
+		fmt.Fprintln(w, s.update(r.Context(), name, u, hostname, addresses))
+	}
+}
+
+// update publishes the addresses for one hostname and returns its dyndns2 response line
+func (s *Server) update(ctx context.Context, name string, u user, hostname string, addresses []string) string {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	logger := log.With().Str("user", name).Str("hostname", hostname).Strs("addresses", addresses).Logger()
+
+	if !strings.Contains(hostname, ".") {
+		return CODE_NOTFQDN
+	}
+	if !slices.Contains(u.hostnames, hostname) {
+		logger.Warn().Msg("dyndns user is not allowed to update hostname")
+		return CODE_NOHOST
+	}
+
+	report, err := s.cfdns.Push(ctx, hostname, addresses)
+	switch {
+	case errors.Is(err, cf.ErrUnknownHostname):
+		return CODE_NOHOST
+	case errors.Is(err, cf.ErrInvalidAddress) || errors.Is(err, ipget.ErrRejected):
+		logger.Warn().Err(err).Msg("dyndns update with an unacceptable address")
+		return CODE_BADIP
+	case err != nil:
+		logger.Error().Err(err).Msg("dyndns update failed")
+		return CODE_SERVFAIL
+	case len(report.Errors) > 0:
+		logger.Error().Err(report.Err()).Msg("dyndns update failed")
+		return CODE_SERVFAIL
+	case len(report.Failed()) > 0:
+		logger.Error().Err(report.Err()).Msg("dyndns update failed")
+		return CODE_DNSERR
+	case report.Changed():
+		logger.Info().Msg("dyndns update applied")
+		return CODE_GOOD + " " + strings.Join(addresses, ",")
+	default:
+		logger.Debug().Msg("dyndns update without changes")
+		return CODE_NOCHG + " " + strings.Join(addresses, ",")
+	}
+}
+
+// requestAddresses returns the addresses of the myip and myipv6 parameters, or the address of the
+// client if there are none. CFDNS.Push validates them, so a client behind NAT which omits myip gets
+// its private address rejected instead of published.
+func requestAddresses(r *http.Request) []string {
+	query := r.URL.Query()
+	if addresses := append(splitList(query.Get("myip")), splitList(query.Get("myipv6"))...); len(addresses) > 0 {
+		return addresses
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return []string{host}
+}
+
+// splitList splits a comma separated parameter, ignoring empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
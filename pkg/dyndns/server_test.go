@@ -0,0 +1,116 @@
+package dyndns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/goodieshq/cfdns/pkg/cf"
+	"github.com/goodieshq/cfdns/pkg/config"
+)
+
+// newTestServer creates an update server for user router, publishing host.a.test and other.a.test
+// in a memory zone. The user may only update host.a.test.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "cfdns.yaml")
+	err := os.WriteFile(filename, []byte(`
+ipv4: true
+ipv6: true
+detection:
+  denied_cidrs: ["9.9.9.0/24"]
+zones:
+  - provider: memory
+    name: a.test
+    domains:
+      - hostname: host.a.test
+      - hostname: other.a.test
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfdns, err := cf.NewCFDNS(*cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cfdns.Close)
+
+	return NewServer(cfdns, config.DynDNS{
+		Users: []config.DynDNSUser{{Username: "router", Password: "secret", Hostnames: []string{"host.a.test"}}},
+	})
+}
+
+// update sends an update request with the query and the user's credentials and returns the recorded response
+func update(s *Server, password, query string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, UPDATE_PATH+"?"+query, nil)
+	r.SetBasicAuth("router", password)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestServerUpdate(t *testing.T) {
+	s := newTestServer(t)
+
+	w := update(s, "secret", "hostname=host.a.test&myip=1.1.1.1&myipv6=2606:4700::1111")
+	if got, want := strings.TrimSpace(w.Body.String()), "good 1.1.1.1,2606:4700::1111"; w.Code != http.StatusOK || got != want {
+		t.Fatalf("ServeHTTP() = %d %q, want %d %q", w.Code, got, http.StatusOK, want)
+	}
+
+	w = update(s, "secret", "hostname=host.a.test&myip=1.1.1.1")
+	if got, want := strings.TrimSpace(w.Body.String()), "nochg 1.1.1.1"; got != want {
+		t.Errorf("ServeHTTP() = %q, want %q", got, want)
+	}
+
+	w = update(s, "secret", "hostname=host.a.test&myip=1.0.0.1")
+	if got, want := strings.TrimSpace(w.Body.String()), "good 1.0.0.1"; got != want {
+		t.Errorf("ServeHTTP() = %q, want %q", got, want)
+	}
+}
+
+func TestServerUpdateBadAuth(t *testing.T) {
+	s := newTestServer(t)
+
+	w := update(s, "wrong", "hostname=host.a.test&myip=1.1.1.1")
+	if got := strings.TrimSpace(w.Body.String()); w.Code != http.StatusUnauthorized || got != CODE_BADAUTH {
+		t.Errorf("ServeHTTP() = %d %q, want %d %q", w.Code, got, http.StatusUnauthorized, CODE_BADAUTH)
+	}
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("ServeHTTP() did not send a basic auth challenge")
+	}
+}
+
+func TestServerUpdateErrors(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"no hostname", "myip=1.1.1.1", CODE_NOTFQDN},
+		{"unqualified hostname", "hostname=host&myip=1.1.1.1", CODE_NOTFQDN},
+		{"hostname of another user", "hostname=other.a.test&myip=1.1.1.1", CODE_NOHOST},
+		{"unknown hostname", "hostname=unknown.a.test&myip=1.1.1.1", CODE_NOHOST},
+		{"too many hostnames", "hostname=" + strings.Repeat("host.a.test,", MAX_HOSTNAMES+1) + "&myip=1.1.1.1", CODE_NUMHOST},
+		{"invalid address", "hostname=host.a.test&myip=not-an-ip", CODE_BADIP},
+		{"private address", "hostname=host.a.test&myip=192.168.1.1", CODE_BADIP},
+		{"denied address", "hostname=host.a.test&myip=9.9.9.9", CODE_BADIP},
+		// httptest requests come from 192.0.2.1, which must not be published either
+		{"private client address", "hostname=host.a.test", CODE_BADIP},
+	}
+	for _, tt := range tests {
+		w := update(s, "secret", tt.query)
+		if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+			t.Errorf("ServeHTTP() with %s = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package ipget
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Binding restricts outgoing traffic to a local network interface and/or source address, so that
+// the detected address is the one of the uplink the traffic actually egresses from
+type Binding struct {
+	Interface string // network interface name, empty = any
+	Address   net.IP // local source address, nil = any
+}
+
+// String returns a short description of the binding for logs
+func (b *Binding) String() string {
+	if b == nil || (b.Interface == "" && b.Address == nil) {
+		return "default"
+	}
+	parts := make([]string, 0, 2)
+	if b.Interface != "" {
+		parts = append(parts, "interface="+b.Interface)
+	}
+	if b.Address != nil {
+		parts = append(parts, "address="+b.Address.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// Dialer returns a dialer for the given network (tcp, tcp4, udp6, ...) honoring the binding, hostnames
+// are resolved through the binding as well
+func (b *Binding) Dialer(network string) *net.Dialer {
+	dialer := b.dialer(network)
+	dialer.Resolver = b.Resolver()
+	return dialer
+}
+
+// dialer returns a dialer for IP addresses honoring the binding
+func (b *Binding) dialer(network string) *net.Dialer {
+	dialer := &net.Dialer{Timeout: TIMEOUT_DEFAULT}
+	if b == nil {
+		return dialer
+	}
+
+	if b.Address != nil {
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = &net.UDPAddr{IP: b.Address}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: b.Address}
+		}
+	}
+	if b.Interface != "" {
+		dialer.Control = bindToDevice(b.Interface)
+	}
+	return dialer
+}
+
+// Resolver returns a resolver whose queries to the system's nameservers honor the binding, the default
+// resolver if nothing is bound. A nameserver on the loopback interface (e.g. systemd-resolved) cannot be
+// reached through another interface, so it is queried unbound and forwards the queries over its own
+// default route.
+func (b *Binding) Resolver() *net.Resolver {
+	if b == nil || (b.Interface == "" && b.Address == nil) {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+					dialer := &net.Dialer{Timeout: TIMEOUT_DEFAULT}
+					return dialer.DialContext(ctx, network, address)
+				}
+			}
+			return b.dialer(network).DialContext(ctx, network, address)
+		},
+	}
+}
+
+// DialContext connects to the address on the named network honoring the binding
+func (b *Binding) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return b.Dialer(network).DialContext(ctx, network, address)
+}
+
+// ListenPacket opens an unconnected packet socket on the network (udp4 or udp6) honoring the binding
+func (b *Binding) ListenPacket(ctx context.Context, network string) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	address := ":0"
+	if b != nil {
+		if b.Interface != "" {
+			lc.Control = bindToDevice(b.Interface)
+		}
+		if b.Address != nil {
+			address = net.JoinHostPort(b.Address.String(), "0")
+		}
+	}
+	return lc.ListenPacket(ctx, network, address)
+}
+
+// NewHTTPClient creates an HTTP client whose connections honor the binding, nil = default routing
+func NewHTTPClient(b *Binding, timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = b.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
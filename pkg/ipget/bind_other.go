@@ -0,0 +1,15 @@
+//go:build !linux
+
+package ipget
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindToDevice is not supported on this platform, bind to the interface's address instead
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("binding to interface %s is only supported on linux, use a source address instead", iface)
+	}
+}
@@ -0,0 +1,47 @@
+package ipget
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestBindingResolver(t *testing.T) {
+	var unbound *Binding
+	if unbound.Resolver() != net.DefaultResolver {
+		t.Error("Resolver() of a nil binding is not the default resolver")
+	}
+	if (&Binding{}).Resolver() != net.DefaultResolver {
+		t.Error("Resolver() of an empty binding is not the default resolver")
+	}
+
+	bound := &Binding{Address: net.IPv4(127, 0, 0, 2)}
+	dialer := bound.Dialer("udp4")
+	if dialer.Resolver == nil || dialer.Resolver == net.DefaultResolver {
+		t.Fatal("Dialer() of a bound binding does not resolve through the binding")
+	}
+
+	// a local stub resolver is queried unbound, the bound address could not reach it on other interfaces
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c, err := dialer.Resolver.Dial(context.Background(), "udp4", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if local := c.LocalAddr().(*net.UDPAddr); local.IP.Equal(bound.Address) {
+		t.Errorf("resolver connection to a loopback nameserver is bound to %s", local.IP)
+	}
+}
+
+func TestInterfaceSourceBinding(t *testing.T) {
+	// without a filter only the bound interface is considered
+	source := NewInterfaceSource(nil, &Binding{Interface: "cfdns-missing0"})
+	if ip, err := source.Lookup(context.Background(), FAMILY_IPV4); err == nil {
+		t.Errorf("Lookup() = %s, want error for a missing bound interface", ip)
+	}
+}
@@ -0,0 +1,205 @@
+package ipget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSQuery describes a special DNS name which resolves to the address of the client asking for it
+type DNSQuery struct {
+	Server string           // resolver address as host:port
+	Name   string           // fully qualified name to query
+	Type   dnsmessage.Type  // record type to query (A, AAAA or TXT)
+	Class  dnsmessage.Class // query class, TXT lookups like whoami.cloudflare use CHAOS
+}
+
+var (
+	// DNS queries that reveal the IPv4 address of the client
+	ipv4DNSQueries = []DNSQuery{
+		{Server: "208.67.222.222:53", Name: "myip.opendns.com.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		{Server: "1.1.1.1:53", Name: "whoami.cloudflare.", Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassCHAOS},
+		{Server: "216.239.32.10:53", Name: "o-o.myaddr.l.google.com.", Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+	}
+	// DNS queries that reveal the IPv6 address of the client
+	ipv6DNSQueries = []DNSQuery{
+		{Server: "[2620:119:35::35]:53", Name: "myip.opendns.com.", Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET},
+		{Server: "[2606:4700:4700::1111]:53", Name: "whoami.cloudflare.", Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassCHAOS},
+		{Server: "[2001:4860:4802:32::a]:53", Name: "o-o.myaddr.l.google.com.", Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+	}
+)
+
+// maximum size of a DNS response over UDP that we are willing to read
+const dnsMaxMessageSize = 1232
+
+// DNSSource discovers the public IP address by querying resolvers that echo the client's address
+type DNSSource struct {
+	binding     *Binding
+	ipv4Queries []DNSQuery
+	ipv6Queries []DNSQuery
+}
+
+// NewDNSSource creates a source backed by the built-in OpenDNS, Cloudflare and Google queries
+func NewDNSSource(binding *Binding) *DNSSource {
+	return NewDNSSourceWithQueries(ipv4DNSQueries, ipv6DNSQueries, binding)
+}
+
+// NewDNSSourceWithQueries creates a source using custom queries, e.g. against a local stub server
+func NewDNSSourceWithQueries(ipv4Queries, ipv6Queries []DNSQuery, binding *Binding) *DNSSource {
+	return &DNSSource{
+		binding:     binding,
+		ipv4Queries: ipv4Queries,
+		ipv6Queries: ipv6Queries,
+	}
+}
+
+func (s *DNSSource) Name() string {
+	return "dns"
+}
+
+func (s *DNSSource) Lookup(ctx context.Context, family Family) (string, error) {
+	var queries []DNSQuery
+	var network string
+
+	switch family {
+	case FAMILY_IPV4:
+		queries, network = s.ipv4Queries, "udp4"
+	case FAMILY_IPV6:
+		queries, network = s.ipv6Queries, "udp6"
+	default:
+		return "", fmt.Errorf("unsupported address family: %s", family)
+	}
+
+	for _, query := range shuffle(queries) {
+		logger := log.With().Str("server", query.Server).Str("name", query.Name).Logger()
+		ip, err := dnsLookupIP(ctx, s.binding, network, query, family)
+		if err != nil {
+			// context-related errors should be returned immediately
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+				logger.Error().Err(err).Msg("request context error")
+				return "", err
+			}
+
+			// all other errors are logged and we continue to the next query
+			logger.Warn().Err(err).Msg("failed to acquire IP address from resolver")
+			continue
+		}
+		return ip, nil
+	}
+
+	return "", fmt.Errorf("could not retrieve public IP address from DNS")
+}
+
+// dnsLookupIP performs a single query and extracts an address of the requested family from the answers
+func dnsLookupIP(ctx context.Context, binding *Binding, network string, query DNSQuery, family Family) (string, error) {
+	answers, err := dnsExchange(ctx, binding, network, query)
+	if err != nil {
+		return "", err
+	}
+
+	for _, answer := range answers {
+		var candidates []string
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			candidates = append(candidates, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			candidates = append(candidates, net.IP(body.AAAA[:]).String())
+		case *dnsmessage.TXTResource:
+			candidates = append(candidates, body.TXT...)
+		}
+
+		for _, candidate := range candidates {
+			ip := strToIP(strings.Trim(strings.TrimSpace(candidate), `"`))
+			if ip == nil || (family == FAMILY_IPV4) != (ip.To4() != nil) {
+				continue
+			}
+			return ip.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("no %s address in DNS response", family)
+}
+
+// dnsExchange sends a single query to the server and returns the answer section of the response
+func dnsExchange(ctx context.Context, binding *Binding, network string, query DNSQuery) ([]dnsmessage.Resource, error) {
+	name, err := dnsmessage.NewName(query.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	id := uint16(rand.Intn(1 << 16))
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: query.Type, Class: query.Class},
+		},
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := binding.DialContext(ctx, network, query.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// bound the exchange by the context deadline, or the default timeout if there is none
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		deadline = time.Now().Add(TIMEOUT_DEFAULT)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	// unblock the read if the context is cancelled before the deadline
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, dnsMaxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			// the socket deadline may expire just before the context reports it
+			if hasDeadline && !time.Now().Before(deadline) {
+				return nil, context.DeadlineExceeded
+			}
+			return nil, err
+		}
+
+		var resp dnsmessage.Message
+		if err := resp.Unpack(buf[:n]); err != nil {
+			return nil, fmt.Errorf("could not parse DNS response: %w", err)
+		}
+
+		// ignore stray responses which do not belong to our query
+		if !resp.Header.Response || resp.Header.ID != id {
+			continue
+		}
+
+		if resp.Header.RCode != dnsmessage.RCodeSuccess {
+			return nil, fmt.Errorf("unexpected DNS response code: %s", resp.Header.RCode)
+		}
+
+		return resp.Answers, nil
+	}
+}
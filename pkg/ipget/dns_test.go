@@ -0,0 +1,176 @@
+package ipget
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubAnswer returns the answers and response code of a stub DNS server for a question, or false to
+// leave the query unanswered
+type stubAnswer func(q dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode, bool)
+
+// startDNSStub serves DNS queries on a local UDP port until the test ends and returns its address
+func startDNSStub(t *testing.T, answer stubAnswer) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, dnsMaxMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var req dnsmessage.Message
+			if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) != 1 {
+				continue
+			}
+			answers, rcode, ok := answer(req.Questions[0])
+			if !ok {
+				continue
+			}
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: req.ID, Response: true, RCode: rcode},
+				Questions: req.Questions,
+				Answers:   answers,
+			}
+			packed, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(packed, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// stubHeader returns the header of an answer to the question
+func stubHeader(q dnsmessage.Question) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class}
+}
+
+func TestDNSSourceParsing(t *testing.T) {
+	server := startDNSStub(t, func(q dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode, bool) {
+		switch {
+		case q.Name.String() == "myip.opendns.com." && q.Type == dnsmessage.TypeA:
+			return []dnsmessage.Resource{{
+				Header: stubHeader(q),
+				Body:   &dnsmessage.AResource{A: [4]byte{203, 0, 113, 10}},
+			}}, dnsmessage.RCodeSuccess, true
+		case q.Name.String() == "whoami.cloudflare." && q.Class == dnsmessage.ClassCHAOS:
+			return []dnsmessage.Resource{{
+				Header: stubHeader(q),
+				Body:   &dnsmessage.TXTResource{TXT: []string{"203.0.113.20"}},
+			}}, dnsmessage.RCodeSuccess, true
+		case q.Name.String() == "o-o.myaddr.l.google.com." && q.Type == dnsmessage.TypeTXT:
+			// google answers with the quoted client address, preceded by an unrelated record
+			return []dnsmessage.Resource{
+				{Header: stubHeader(q), Body: &dnsmessage.TXTResource{TXT: []string{"edns0-client-subnet 198.51.100.0/24"}}},
+				{Header: stubHeader(q), Body: &dnsmessage.TXTResource{TXT: []string{`"203.0.113.30"`}}},
+			}, dnsmessage.RCodeSuccess, true
+		}
+		return nil, dnsmessage.RCodeNameError, true
+	})
+
+	tests := []struct {
+		name  string
+		query DNSQuery
+		want  string
+	}{
+		{"opendns A", DNSQuery{Server: server, Name: "myip.opendns.com.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}, "203.0.113.10"},
+		{"cloudflare CHAOS TXT", DNSQuery{Server: server, Name: "whoami.cloudflare.", Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassCHAOS}, "203.0.113.20"},
+		{"google TXT", DNSQuery{Server: server, Name: "o-o.myaddr.l.google.com.", Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}, "203.0.113.30"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := NewDNSSourceWithQueries([]DNSQuery{tt.query}, nil, nil)
+			ip, err := source.Lookup(context.Background(), FAMILY_IPV4)
+			if err != nil {
+				t.Fatalf("Lookup() error = %v", err)
+			}
+			if ip != tt.want {
+				t.Errorf("Lookup() = %s, want %s", ip, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSSourceNXDOMAIN(t *testing.T) {
+	server := startDNSStub(t, func(q dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode, bool) {
+		if q.Name.String() == "found.test." {
+			return []dnsmessage.Resource{{
+				Header: stubHeader(q),
+				Body:   &dnsmessage.AResource{A: [4]byte{203, 0, 113, 40}},
+			}}, dnsmessage.RCodeSuccess, true
+		}
+		return nil, dnsmessage.RCodeNameError, true
+	})
+
+	missing := DNSQuery{Server: server, Name: "missing.test.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	found := DNSQuery{Server: server, Name: "found.test.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+	_, err := dnsLookupIP(context.Background(), nil, "udp4", missing, FAMILY_IPV4)
+	if err == nil || !strings.Contains(err.Error(), dnsmessage.RCodeNameError.String()) {
+		t.Errorf("dnsLookupIP() error = %v, want %s", err, dnsmessage.RCodeNameError)
+	}
+
+	// a failing resolver falls through to the next query
+	source := NewDNSSourceWithQueries([]DNSQuery{missing, found}, nil, nil)
+	ip, err := source.Lookup(context.Background(), FAMILY_IPV4)
+	if err != nil || ip != "203.0.113.40" {
+		t.Errorf("Lookup() = %q, %v, want 203.0.113.40", ip, err)
+	}
+
+	source = NewDNSSourceWithQueries([]DNSQuery{missing}, nil, nil)
+	if ip, err := source.Lookup(context.Background(), FAMILY_IPV4); err == nil {
+		t.Errorf("Lookup() = %s, want error", ip)
+	}
+}
+
+func TestDNSSourceTimeout(t *testing.T) {
+	server := startDNSStub(t, func(q dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode, bool) {
+		return nil, dnsmessage.RCodeSuccess, false
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	source := NewDNSSourceWithQueries([]DNSQuery{
+		{Server: server, Name: "myip.opendns.com.", Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+	}, nil, nil)
+
+	started := time.Now()
+	_, err := source.Lookup(ctx, FAMILY_IPV4)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Lookup() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("Lookup() took %s, want it bounded by the context", elapsed)
+	}
+}
+
+func TestDNSSourceFamilyMismatch(t *testing.T) {
+	server := startDNSStub(t, func(q dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode, bool) {
+		return []dnsmessage.Resource{{
+			Header: stubHeader(q),
+			Body:   &dnsmessage.TXTResource{TXT: []string{"2001:db8::1"}},
+		}}, dnsmessage.RCodeSuccess, true
+	})
+
+	query := DNSQuery{Server: server, Name: "whoami.cloudflare.", Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassCHAOS}
+	if ip, err := dnsLookupIP(context.Background(), nil, "udp4", query, FAMILY_IPV4); err == nil {
+		t.Errorf("dnsLookupIP() = %s, want error for an IPv6 answer to an IPv4 lookup", ip)
+	}
+}
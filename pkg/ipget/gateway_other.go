@@ -0,0 +1,10 @@
+//go:build !linux
+
+package ipget
+
+import "net"
+
+// defaultGateway is not supported on this platform, the gateway must be configured explicitly
+func defaultGateway(iface string) net.IP {
+	return nil
+}
@@ -0,0 +1,111 @@
+package ipget
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/rs/zerolog/log"
+)
+
+// IPv6 address flags as reported by the kernel (IFA_F_*)
+const (
+	addrFlagTemporary  = 0x01 // privacy extension address (RFC 4941)
+	addrFlagDadFailed  = 0x08 // duplicate address detection failed
+	addrFlagDeprecated = 0x20 // preferred lifetime has expired
+	addrFlagTentative  = 0x40 // duplicate address detection still in progress
+)
+
+// addrFlagsUnusable are the flags that disqualify an IPv6 address from being published
+const addrFlagsUnusable = addrFlagTemporary | addrFlagDadFailed | addrFlagDeprecated | addrFlagTentative
+
+// cgnatNet is the shared address space used by carrier-grade NAT (RFC 6598)
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// InterfaceSource discovers the public IP address from addresses assigned to local network interfaces
+type InterfaceSource struct {
+	filter *regexp.Regexp // only consider interfaces whose name matches, nil = the bound interface
+	iface  string         // interface of the binding, empty = all interfaces
+}
+
+// NewInterfaceSource creates a source that reads addresses from local interfaces matching the filter,
+// or only from the bound interface if there is no filter
+func NewInterfaceSource(filter *regexp.Regexp, binding *Binding) *InterfaceSource {
+	s := &InterfaceSource{filter: filter}
+	if binding != nil {
+		s.iface = binding.Interface
+	}
+	return s
+}
+
+func (s *InterfaceSource) Name() string {
+	return "interface"
+}
+
+func (s *InterfaceSource) Lookup(ctx context.Context, family Family) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("could not list network interfaces: %w", err)
+	}
+
+	// kernel flags for IPv6 addresses, keyed by the address string (nil if unavailable on this platform)
+	flags := ipv6AddrFlags()
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if s.filter != nil && !s.filter.MatchString(iface.Name) {
+			continue
+		}
+		if s.filter == nil && s.iface != "" && iface.Name != s.iface {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			log.Warn().Err(err).Str("interface", iface.Name).Msg("failed to list interface addresses")
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+
+			ip := ipNet.IP
+			if (family == FAMILY_IPV4) != (ip.To4() != nil) {
+				continue
+			}
+			if !isPublicIP(ip) {
+				continue
+			}
+			if family == FAMILY_IPV6 && flags[ip.String()]&addrFlagsUnusable != 0 {
+				log.Debug().Str("interface", iface.Name).Str("address", ip.String()).Msg("skipping temporary or deprecated address")
+				continue
+			}
+
+			log.Debug().Str("interface", iface.Name).Str("address", ip.String()).Msg("found public address on interface")
+			return ip.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("no public %s address found on local interfaces", family)
+}
+
+// isPublicIP reports whether the address is globally routable and not private, ULA, link-local or CGNAT
+func isPublicIP(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil && cgnatNet.Contains(ip4) {
+		return false
+	}
+	return true
+}
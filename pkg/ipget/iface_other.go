@@ -0,0 +1,8 @@
+//go:build !linux
+
+package ipget
+
+// ipv6AddrFlags is not supported on this platform, so no addresses are excluded by flag
+func ipv6AddrFlags() map[string]uint32 {
+	return nil
+}
@@ -30,6 +30,7 @@ var (
 )
 
 const TIMEOUT_DEFAULT = time.Second * 5
+const MAX_RESPONSE_SIZE = 4096 // maximum number of bytes read from a service response
 
 // drain reads and discards all remaining data from an io.ReadCloser
 func drain(body io.ReadCloser) {
@@ -65,16 +66,19 @@ func shuffle[T any](items []T) []T {
 	return shuffled
 }
 
-// getSmallText is a helper function to get text content from a URL efficiently
-func getSmallText(ctx context.Context, url string) (string, error) {
+// getSmallText is a helper function to get text content from a service URL efficiently
+func getSmallText(ctx context.Context, httpClient *http.Client, service Service) (string, error) {
 	// create a new request tied to the context
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, service.URL, nil)
 	if err != nil {
 		return "", err
 	}
+	for key, value := range service.Headers {
+		req.Header.Set(key, value)
+	}
 
 	// perform the request
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -85,7 +89,7 @@ func getSmallText(ctx context.Context, url string) (string, error) {
 		return "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
-	body, err := io.ReadAll(io.LimitReader(resp.Body, 128))
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_RESPONSE_SIZE))
 	if err != nil {
 		return "", err
 	}
@@ -95,12 +99,13 @@ func getSmallText(ctx context.Context, url string) (string, error) {
 	return strings.TrimSpace(string(body)), nil
 }
 
-// getPublicIP tries to get the public IP address from a list of services
-func getPublicIP(ctx context.Context, services []string) (string, error) {
+// getPublicIP tries to get the public IP address of the given family from a list of services, a
+// service returning an address the validator rejects is skipped like a failing one
+func getPublicIP(ctx context.Context, httpClient *http.Client, services []Service, family Family, validator *Validator) (string, error) {
 	services = shuffle(services)
 	for _, service := range services {
-		logger := log.With().Str("service", service).Logger()
-		ipStr, err := getSmallText(ctx, service)
+		logger := log.With().Str("service", service.Name).Logger()
+		body, err := getSmallText(ctx, httpClient, service)
 		if err != nil {
 			// context-related errors should be returned immediately
 			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
@@ -113,19 +118,37 @@ func getPublicIP(ctx context.Context, services []string) (string, error) {
 			continue
 		}
 
+		parse := service.Parse
+		if parse == nil {
+			parse = TextParser()
+		}
+
+		ipStr, err := parse(body)
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed to parse IP address from service response")
+			continue
+		}
+
 		// validate the returned IP address
-		if ip := strToIP(ipStr); ip != nil {
-			return ip.String(), nil
+		ip := strToIP(ipStr)
+		if ip == nil || (family == FAMILY_IPV4) != (ip.To4() != nil) {
+			logger.Warn().Str("response", ipStr).Msgf("service did not return a valid %s address", family)
+			continue
+		}
+		if err := validator.Check(ip.String()); err != nil {
+			logger.Warn().Err(err).Msg("rejected IP address from service")
+			continue
 		}
+		return ip.String(), nil
 	}
 
 	return "", fmt.Errorf("could not retrieve public IP address")
 }
 
 func GetPublicIPv4(ctx context.Context) (string, error) {
-	return getPublicIP(ctx, ipv4Services)
+	return getPublicIP(ctx, client, textServices(ipv4Services), FAMILY_IPV4, &Validator{})
 }
 
 func GetPublicIPv6(ctx context.Context) (string, error) {
-	return getPublicIP(ctx, ipv6Services)
+	return getPublicIP(ctx, client, textServices(ipv6Services), FAMILY_IPV6, &Validator{})
 }
@@ -0,0 +1,45 @@
+package ipget
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// echoService returns a plain text service answering with a fixed body
+func echoService(t *testing.T, body string) Service {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return Service{Name: body, URL: srv.URL}
+}
+
+func TestGetPublicIP(t *testing.T) {
+	validator, err := NewValidator(nil, []string{"9.9.9.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	services := []Service{
+		echoService(t, "192.168.1.1"),
+		echoService(t, "9.9.9.9"),
+		echoService(t, "2606:4700::1111"),
+		echoService(t, "not-an-ip"),
+		echoService(t, "1.1.1.1"),
+	}
+
+	// services are shuffled, every order must skip the rejected answers
+	for range 10 {
+		ip, err := getPublicIP(context.Background(), http.DefaultClient, services, FAMILY_IPV4, validator)
+		if err != nil || ip != "1.1.1.1" {
+			t.Fatalf("getPublicIP() = %q, %v, want 1.1.1.1", ip, err)
+		}
+	}
+
+	if ip, err := getPublicIP(context.Background(), http.DefaultClient, services[:2], FAMILY_IPV4, validator); err == nil {
+		t.Errorf("getPublicIP() with only rejected addresses = %q, want error", ip)
+	}
+}
@@ -0,0 +1,33 @@
+package ipget
+
+import (
+	"fmt"
+	"net"
+)
+
+// CombinePrefix replaces the interface identifier of an IPv6 address with the given suffix, keeping
+// the first prefixLength bits of the address. It is used to derive the addresses of other hosts in a
+// delegated prefix from the detected address of this host.
+func CombinePrefix(address string, prefixLength int, suffix string) (string, error) {
+	ip := net.ParseIP(address)
+	if ip == nil || ip.To4() != nil {
+		return "", fmt.Errorf("invalid IPv6 address: %q", address)
+	}
+
+	id := net.ParseIP(suffix)
+	if id == nil || id.To4() != nil {
+		return "", fmt.Errorf("invalid IPv6 suffix: %q", suffix)
+	}
+
+	if prefixLength <= 0 || prefixLength >= 8*net.IPv6len {
+		return "", fmt.Errorf("invalid IPv6 prefix length: %d", prefixLength)
+	}
+
+	mask := net.CIDRMask(prefixLength, 8*net.IPv6len)
+	combined := make(net.IP, net.IPv6len)
+	for i := range combined {
+		combined[i] = (ip[i] & mask[i]) | (id[i] &^ mask[i])
+	}
+
+	return combined.String(), nil
+}
@@ -0,0 +1,51 @@
+package ipget
+
+import "testing"
+
+func TestCombinePrefix(t *testing.T) {
+	tests := []struct {
+		name         string
+		address      string
+		prefixLength int
+		suffix       string
+		want         string
+	}{
+		{"/64 prefix", "2001:db8:1:2:aaaa:bbbb:cccc:dddd", 64, "::10", "2001:db8:1:2::10"},
+		{"/64 prefix with a full interface identifier", "2001:db8:1:2::1", 64, "::211:22ff:fe33:4455", "2001:db8:1:2:211:22ff:fe33:4455"},
+		{"suffix bits within the prefix are ignored", "2001:db8:1:2::1", 64, "fd00:ffff:ffff:ffff::10", "2001:db8:1:2::10"},
+		{"/56 prefix with a subnet in the suffix", "2001:db8:1:2ff:aaaa::1", 56, "::34:0:0:0:10", "2001:db8:1:234::10"},
+		{"/48 prefix with a subnet in the suffix", "2001:db8:1:ffff::1", 48, "::5:0:0:0:10", "2001:db8:1:5::10"},
+		{"/72 prefix keeps part of the identifier", "2001:db8:1:2:aabb:ccdd:eeff:1", 72, "::10", "2001:db8:1:2:aa00::10"},
+		{"/127 prefix", "2001:db8::2", 127, "::1", "2001:db8::3"},
+		{"/1 prefix", "2001:db8::1", 1, "::10", "::10"},
+	}
+	for _, tt := range tests {
+		got, err := CombinePrefix(tt.address, tt.prefixLength, tt.suffix)
+		if err != nil || got != tt.want {
+			t.Errorf("CombinePrefix() with %s = %q, %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+
+	invalid := []struct {
+		name         string
+		address      string
+		prefixLength int
+		suffix       string
+	}{
+		{"IPv4 suffix", "2001:db8:1:2::1", 64, "10.0.0.10"},
+		{"IPv4-mapped suffix", "2001:db8:1:2::1", 64, "::ffff:10.0.0.10"},
+		{"malformed suffix", "2001:db8:1:2::1", 64, "::10::"},
+		{"suffix without colons", "2001:db8:1:2::1", 64, "10"},
+		{"empty suffix", "2001:db8:1:2::1", 64, ""},
+		{"IPv4 address", "198.51.100.7", 64, "::10"},
+		{"invalid address", "not-an-ip", 64, "::10"},
+		{"zero prefix length", "2001:db8:1:2::1", 0, "::10"},
+		{"full prefix length", "2001:db8:1:2::1", 128, "::10"},
+		{"negative prefix length", "2001:db8:1:2::1", -64, "::10"},
+	}
+	for _, tt := range invalid {
+		if got, err := CombinePrefix(tt.address, tt.prefixLength, tt.suffix); err == nil {
+			t.Errorf("CombinePrefix() with %s = %q, want error", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package ipget
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// NAT-PMP (RFC 6886) and PCP (RFC 6887) constants
+const (
+	natpmpPort           = 5351
+	natpmpVersion        = 0
+	natpmpOpExternalIP   = 0
+	natpmpResponseSize   = 12
+	pcpVersion           = 2
+	pcpOpMap             = 1
+	pcpResponseBit       = 0x80
+	pcpHeaderSize        = 24
+	pcpMapPayloadSize    = 36
+	pcpMapLifetime       = 60 // seconds, the temporary mapping is deleted right after the lookup
+	pcpProtocolUDP       = 17
+	routerInitialTimeout = time.Millisecond * 250
+	routerAttempts       = 3
+)
+
+// SSDP discovery of UPnP Internet Gateway Devices
+const (
+	ssdpAddress  = "239.255.255.250:1900"
+	ssdpWait     = time.Second * 2
+	igdMaxBody   = 64 * 1024
+	igdSearchURN = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+)
+
+// UPnP services which implement GetExternalIPAddress
+var igdServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// RouterSource discovers the WAN address by asking the local router via NAT-PMP, PCP or UPnP IGD
+type RouterSource struct {
+	binding  *Binding     // interface or address the router is reached through
+	client   *http.Client // HTTP client for UPnP requests
+	gateway  net.IP       // router address for NAT-PMP/PCP, nil = default route gateway
+	port     int          // NAT-PMP/PCP server port of the gateway
+	ssdpAddr string       // SSDP address M-SEARCH requests are sent to
+	igdURL   string       // UPnP device description URL, empty = discover via SSDP
+}
+
+// NewRouterSource creates a source querying the given gateway and IGD description URL, both optional
+func NewRouterSource(gateway net.IP, igdURL string, binding *Binding) *RouterSource {
+	return NewRouterSourceWithEndpoints(gateway, natpmpPort, ssdpAddress, igdURL, binding)
+}
+
+// NewRouterSourceWithEndpoints creates a source using a custom NAT-PMP/PCP port and SSDP address,
+// e.g. against a local fake router
+func NewRouterSourceWithEndpoints(gateway net.IP, port int, ssdpAddr, igdURL string, binding *Binding) *RouterSource {
+	httpClient := client
+	if binding != nil {
+		httpClient = NewHTTPClient(binding, TIMEOUT_DEFAULT)
+	}
+	return &RouterSource{
+		binding:  binding,
+		client:   httpClient,
+		gateway:  gateway,
+		port:     port,
+		ssdpAddr: ssdpAddr,
+		igdURL:   igdURL,
+	}
+}
+
+func (s *RouterSource) Name() string {
+	return "router"
+}
+
+func (s *RouterSource) Lookup(ctx context.Context, family Family) (string, error) {
+	// NAT-PMP and UPnP only report the IPv4 WAN address, IPv6 is normally not translated
+	if family != FAMILY_IPV4 {
+		return "", fmt.Errorf("router query does not support %s", family)
+	}
+
+	gateway := s.gateway
+	if gateway == nil {
+		var iface string
+		if s.binding != nil {
+			iface = s.binding.Interface
+		}
+		gateway = defaultGateway(iface)
+	}
+
+	type method struct {
+		name   string
+		lookup func(context.Context) (net.IP, error)
+	}
+	var methods []method
+	if gateway != nil {
+		server := net.JoinHostPort(gateway.String(), strconv.Itoa(s.port))
+		methods = append(methods,
+			method{"natpmp", func(ctx context.Context) (net.IP, error) { return natpmpExternalIP(ctx, s.binding, server) }},
+			method{"pcp", func(ctx context.Context) (net.IP, error) { return pcpExternalIP(ctx, s.binding, server) }},
+		)
+	}
+	methods = append(methods, method{"upnp", func(ctx context.Context) (net.IP, error) {
+		return s.upnpExternalIP(ctx, gateway)
+	}})
+
+	for _, m := range methods {
+		logger := log.With().Str("protocol", m.name).Logger()
+		ip, err := m.lookup(ctx)
+		if err != nil {
+			// context-related errors should be returned immediately
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				logger.Error().Err(ctxErr).Msg("request context error")
+				return "", ctxErr
+			}
+
+			logger.Debug().Err(err).Msg("router did not report a WAN address")
+			continue
+		}
+
+		ip4 := ip.To4()
+		if ip4 == nil {
+			logger.Warn().Str("address", ip.String()).Msg("router reported a non-IPv4 WAN address")
+			continue
+		}
+
+		// a router behind CGNAT or another NAT knows only its private WAN address
+		if !isPublicIP(ip4) {
+			return "", fmt.Errorf("router WAN address %s is not public, router is behind another NAT", ip4)
+		}
+
+		logger.Debug().Str("address", ip4.String()).Msg("router reported WAN address")
+		return ip4.String(), nil
+	}
+
+	return "", fmt.Errorf("could not retrieve WAN address from router")
+}
+
+// routerExchange sends a request to the gateway server (host:port) over UDP and returns the first
+// datagram accepted by valid, retransmitting with a doubling timeout
+func routerExchange(ctx context.Context, binding *Binding, server string, build func(local *net.UDPAddr) []byte, valid func([]byte) bool) ([]byte, error) {
+	conn, err := binding.DialContext(ctx, "udp4", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// unblock any pending read if the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, errors.New("unexpected local address type")
+	}
+	req := build(local)
+
+	buf := make([]byte, 1100)
+	timeout := routerInitialTimeout
+	for attempt := 0; attempt < routerAttempts; attempt++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return nil, ctxErr
+				}
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if valid(buf[:n]) {
+				return append([]byte(nil), buf[:n]...), nil
+			}
+		}
+		timeout *= 2
+	}
+
+	return nil, errors.New("no response from gateway")
+}
+
+// natpmpExternalIP requests the external address of the gateway using NAT-PMP
+func natpmpExternalIP(ctx context.Context, binding *Binding, server string) (net.IP, error) {
+	resp, err := routerExchange(ctx, binding, server,
+		func(*net.UDPAddr) []byte { return []byte{natpmpVersion, natpmpOpExternalIP} },
+		func(b []byte) bool {
+			return len(b) >= natpmpResponseSize && b[0] == natpmpVersion && b[1] == 128+natpmpOpExternalIP
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != 0 {
+		return nil, fmt.Errorf("NAT-PMP result code %d", code)
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+// pcpExternalIP creates a short-lived PCP mapping to learn the assigned external address, then deletes it
+func pcpExternalIP(ctx context.Context, binding *Binding, server string) (net.IP, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	// the delete request is sent from a new socket, so it must reuse the internal port of the mapping
+	var internalPort uint16
+	build := func(lifetime uint32) func(*net.UDPAddr) []byte {
+		return func(local *net.UDPAddr) []byte {
+			if internalPort == 0 {
+				internalPort = uint16(local.Port)
+			}
+
+			req := make([]byte, pcpHeaderSize+pcpMapPayloadSize)
+			req[0] = pcpVersion
+			req[1] = pcpOpMap
+			binary.BigEndian.PutUint32(req[4:8], lifetime)
+			copy(req[8:24], local.IP.To16())
+
+			payload := req[pcpHeaderSize:]
+			copy(payload[0:12], nonce)
+			payload[12] = pcpProtocolUDP
+			binary.BigEndian.PutUint16(payload[16:18], internalPort)
+			copy(payload[20:36], net.IPv4zero.To16())
+			return req
+		}
+	}
+	valid := func(b []byte) bool {
+		return len(b) >= pcpHeaderSize+pcpMapPayloadSize &&
+			b[0] == pcpVersion &&
+			b[1] == pcpResponseBit|pcpOpMap &&
+			bytes.Equal(b[pcpHeaderSize:pcpHeaderSize+12], nonce)
+	}
+
+	resp, err := routerExchange(ctx, binding, server, build(pcpMapLifetime), valid)
+	if err != nil {
+		return nil, err
+	}
+	if code := resp[3]; code != 0 {
+		return nil, fmt.Errorf("PCP result code %d", code)
+	}
+	ip := net.IP(append([]byte(nil), resp[pcpHeaderSize+20:pcpHeaderSize+36]...))
+
+	// remove the temporary mapping, failure only means it expires on its own
+	if _, err := routerExchange(ctx, binding, server, build(0), valid); err != nil {
+		log.Debug().Err(err).Msg("failed to delete temporary PCP mapping")
+	}
+
+	return ip, nil
+}
+
+// upnpExternalIP asks an Internet Gateway Device for its external address, discovering it via SSDP if needed
+func (s *RouterSource) upnpExternalIP(ctx context.Context, gateway net.IP) (net.IP, error) {
+	igdURL := s.igdURL
+	if igdURL == "" {
+		location, err := ssdpDiscover(ctx, s.binding, s.ssdpAddr, gateway)
+		if err != nil {
+			return nil, err
+		}
+		igdURL = location
+	}
+
+	serviceType, controlURL, err := igdControlURL(ctx, s.client, igdURL)
+	if err != nil {
+		return nil, err
+	}
+
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:GetExternalIPAddress xmlns:u="` + serviceType + `"></u:GetExternalIPAddress></s:Body>` +
+		`</s:Envelope>`
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, controlURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+serviceType+`#GetExternalIPAddress"`)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		drain(resp.Body)
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var envelope struct {
+		Address string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, igdMaxBody)).Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("could not parse UPnP response: %w", err)
+	}
+
+	ip := strToIP(strings.TrimSpace(envelope.Address))
+	if ip == nil {
+		return nil, fmt.Errorf("invalid UPnP external address: %q", envelope.Address)
+	}
+	return ip, nil
+}
+
+// ssdpDiscover multicasts an M-SEARCH for Internet Gateway Devices to the SSDP address and returns the
+// first description URL, preferring the device at the gateway address when it is known
+func ssdpDiscover(ctx context.Context, binding *Binding, ssdpAddr string, gateway net.IP) (string, error) {
+	conn, err := binding.ListenPacket(ctx, "udp4")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+
+	msg := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: " + igdSearchURN + "\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(msg), dst); err != nil {
+		return "", err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(ssdpWait)); err != nil {
+		return "", err
+	}
+
+	var fallback string
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return "", ctxErr
+			}
+			break
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+
+		location := resp.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+
+		udp, ok := from.(*net.UDPAddr)
+		if gateway == nil || (ok && udp.IP.Equal(gateway)) {
+			return location, nil
+		}
+		if fallback == "" {
+			fallback = location
+		}
+	}
+
+	if fallback == "" {
+		return "", errors.New("no UPnP Internet Gateway Device found")
+	}
+	return fallback, nil
+}
+
+// igdDevice is a (possibly nested) device in a UPnP device description
+type igdDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []igdDevice `xml:"deviceList>device"`
+}
+
+// igdControlURL fetches the device description and returns the WAN connection service type and control URL
+func igdControlURL(ctx context.Context, httpClient *http.Client, location string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		drain(resp.Body)
+		return "", "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var root struct {
+		URLBase string    `xml:"URLBase"`
+		Device  igdDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, igdMaxBody)).Decode(&root); err != nil {
+		return "", "", fmt.Errorf("could not parse UPnP device description: %w", err)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	if root.URLBase != "" {
+		if b, err := url.Parse(root.URLBase); err == nil {
+			base = b
+		}
+	}
+
+	// walk the device tree breadth first looking for a supported WAN connection service
+	for _, serviceType := range igdServiceTypes {
+		queue := []igdDevice{root.Device}
+		for len(queue) > 0 {
+			device := queue[0]
+			queue = append(queue[1:], device.Devices...)
+			for _, service := range device.Services {
+				if strings.TrimSpace(service.ServiceType) != serviceType {
+					continue
+				}
+				ref, err := url.Parse(strings.TrimSpace(service.ControlURL))
+				if err != nil {
+					return "", "", err
+				}
+				return serviceType, base.ResolveReference(ref).String(), nil
+			}
+		}
+	}
+
+	return "", "", errors.New("no WAN connection service in UPnP device description")
+}
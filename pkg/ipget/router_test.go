@@ -0,0 +1,212 @@
+package ipget
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRouter answers NAT-PMP and PCP requests on a local UDP port
+type fakeRouter struct {
+	conn   net.PacketConn
+	natpmp uint16 // NAT-PMP result code, 0 = success
+	pcp    byte   // PCP result code, 0 = success
+	wan    net.IP // external address reported by both protocols
+	mu     sync.Mutex
+	pcpReq []uint32 // lifetimes of the received PCP MAP requests
+}
+
+// startFakeRouter starts a fake router until the test ends
+func startFakeRouter(t *testing.T, natpmp uint16, pcp byte, wan string) *fakeRouter {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	r := &fakeRouter{conn: conn, natpmp: natpmp, pcp: pcp, wan: net.ParseIP(wan).To4()}
+	go r.serve()
+	return r
+}
+
+// port returns the UDP port of the fake router
+func (r *fakeRouter) port() int {
+	return r.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// lifetimes returns the lifetimes of the PCP MAP requests received so far
+func (r *fakeRouter) lifetimes() []uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]uint32(nil), r.pcpReq...)
+}
+
+func (r *fakeRouter) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+
+		switch {
+		case n == 2 && req[0] == natpmpVersion && req[1] == natpmpOpExternalIP:
+			resp := make([]byte, natpmpResponseSize)
+			resp[0] = natpmpVersion
+			resp[1] = 128 + natpmpOpExternalIP
+			binary.BigEndian.PutUint16(resp[2:4], r.natpmp)
+			copy(resp[8:12], r.wan)
+			r.conn.WriteTo(resp, addr)
+
+		case n == pcpHeaderSize+pcpMapPayloadSize && req[0] == pcpVersion && req[1] == pcpOpMap:
+			r.mu.Lock()
+			r.pcpReq = append(r.pcpReq, binary.BigEndian.Uint32(req[4:8]))
+			r.mu.Unlock()
+
+			// the response echoes the request with the assigned external address
+			resp := append([]byte(nil), req...)
+			resp[1] = pcpResponseBit | pcpOpMap
+			resp[3] = r.pcp
+			copy(resp[pcpHeaderSize+20:pcpHeaderSize+36], r.wan.To16())
+			r.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// startFakeIGD serves a UPnP device description with a nested WAN connection service
+func startFakeIGD(t *testing.T, wan string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`)
+	})
+	mux.HandleFunc("/ctl/IPConn", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || !strings.Contains(string(body), "GetExternalIPAddress") ||
+			r.Header.Get("SOAPAction") != `"urn:schemas-upnp-org:service:WANIPConnection:1#GetExternalIPAddress"` {
+			http.Error(w, "invalid action", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
+  <s:Body>
+    <u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+      <NewExternalIPAddress>%s</NewExternalIPAddress>
+    </u:GetExternalIPAddressResponse>
+  </s:Body>
+</s:Envelope>`, wan)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRouterNATPMP(t *testing.T) {
+	router := startFakeRouter(t, 0, 0, "203.0.113.50")
+	source := NewRouterSourceWithEndpoints(net.IPv4(127, 0, 0, 1), router.port(), ssdpAddress, "", nil)
+
+	ip, err := source.Lookup(context.Background(), FAMILY_IPV4)
+	if err != nil || ip != "203.0.113.50" {
+		t.Errorf("Lookup() = %q, %v, want 203.0.113.50", ip, err)
+	}
+	if lifetimes := router.lifetimes(); len(lifetimes) != 0 {
+		t.Errorf("PCP requests = %v, want none when NAT-PMP succeeds", lifetimes)
+	}
+}
+
+func TestRouterPCP(t *testing.T) {
+	// NAT-PMP result code 1 means unsupported version, the router only speaks PCP
+	router := startFakeRouter(t, 1, 0, "203.0.113.60")
+	source := NewRouterSourceWithEndpoints(net.IPv4(127, 0, 0, 1), router.port(), ssdpAddress, "", nil)
+
+	ip, err := source.Lookup(context.Background(), FAMILY_IPV4)
+	if err != nil || ip != "203.0.113.60" {
+		t.Errorf("Lookup() = %q, %v, want 203.0.113.60", ip, err)
+	}
+
+	// the temporary mapping is deleted again with a zero lifetime
+	lifetimes := router.lifetimes()
+	if len(lifetimes) != 2 || lifetimes[0] != pcpMapLifetime || lifetimes[1] != 0 {
+		t.Errorf("PCP lifetimes = %v, want [%d 0]", lifetimes, pcpMapLifetime)
+	}
+}
+
+func TestRouterUPnP(t *testing.T) {
+	// both port mapping protocols fail, so the router is asked via UPnP
+	router := startFakeRouter(t, 1, 1, "203.0.113.1")
+	igd := startFakeIGD(t, "203.0.113.70")
+	source := NewRouterSourceWithEndpoints(net.IPv4(127, 0, 0, 1), router.port(), ssdpAddress, igd.URL+"/rootDesc.xml", nil)
+
+	ip, err := source.Lookup(context.Background(), FAMILY_IPV4)
+	if err != nil || ip != "203.0.113.70" {
+		t.Errorf("Lookup() = %q, %v, want 203.0.113.70", ip, err)
+	}
+}
+
+func TestRouterSSDP(t *testing.T) {
+	igd := startFakeIGD(t, "203.0.113.80")
+
+	// a unicast responder stands in for the multicast group
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil || !strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+			return
+		}
+		conn.WriteTo([]byte("HTTP/1.1 200 OK\r\n"+
+			"ST: "+igdSearchURN+"\r\n"+
+			"LOCATION: "+igd.URL+"/rootDesc.xml\r\n\r\n"), addr)
+	}()
+
+	source := NewRouterSourceWithEndpoints(nil, natpmpPort, conn.LocalAddr().String(), "", nil)
+	ip, err := source.upnpExternalIP(context.Background(), net.IPv4(127, 0, 0, 1))
+	if err != nil || ip.String() != "203.0.113.80" {
+		t.Errorf("upnpExternalIP() = %v, %v, want 203.0.113.80", ip, err)
+	}
+}
+
+func TestRouterPrivateWAN(t *testing.T) {
+	// a router behind CGNAT knows only its private WAN address
+	router := startFakeRouter(t, 0, 0, "100.64.1.2")
+	source := NewRouterSourceWithEndpoints(net.IPv4(127, 0, 0, 1), router.port(), ssdpAddress, "", nil)
+
+	if ip, err := source.Lookup(context.Background(), FAMILY_IPV4); err == nil {
+		t.Errorf("Lookup() = %s, want error for a CGNAT address", ip)
+	}
+}
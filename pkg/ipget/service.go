@@ -0,0 +1,140 @@
+package ipget
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Response parser types for HTTP services
+const (
+	PARSER_TEXT  = "text"  // the whole response body is the address
+	PARSER_JSON  = "json"  // the address is found at a JSON path such as .ip
+	PARSER_REGEX = "regex" // the address is the first capture group of a regular expression
+	PARSER_KV    = "kv"    // the address is the value of a key=value line, e.g. /cdn-cgi/trace
+)
+
+// Parser extracts an IP address string from a service response body
+type Parser func(body string) (string, error)
+
+// Service is an HTTP endpoint which returns the public IP address of the client
+type Service struct {
+	Name    string            // identifier used in logs
+	URL     string            // URL to request
+	Headers map[string]string // additional request headers
+	Parse   Parser            // response parser, nil = plain text
+}
+
+// textServices converts a list of plain text service URLs to services
+func textServices(urls []string) []Service {
+	services := make([]Service, len(urls))
+	for i, url := range urls {
+		services[i] = Service{Name: url, URL: url, Parse: TextParser()}
+	}
+	return services
+}
+
+// NewParser creates a response parser of the given type, arg is the JSON path, pattern or key
+func NewParser(parserType, arg string) (Parser, error) {
+	switch parserType {
+	case "", PARSER_TEXT:
+		return TextParser(), nil
+	case PARSER_JSON:
+		return JSONParser(arg)
+	case PARSER_REGEX:
+		return RegexParser(arg)
+	case PARSER_KV:
+		return KVParser(arg)
+	}
+	return nil, fmt.Errorf("unknown parser type: %q", parserType)
+}
+
+// TextParser returns the trimmed response body
+func TextParser() Parser {
+	return func(body string) (string, error) {
+		return strings.TrimSpace(body), nil
+	}
+}
+
+// JSONParser returns the string at a dotted path such as .ip or .data.addresses.0
+func JSONParser(path string) (Parser, error) {
+	path = strings.TrimPrefix(strings.TrimSpace(path), ".")
+	if path == "" {
+		return nil, fmt.Errorf("json parser requires a path")
+	}
+	keys := strings.Split(path, ".")
+
+	return func(body string) (string, error) {
+		var value any
+		if err := json.Unmarshal([]byte(body), &value); err != nil {
+			return "", fmt.Errorf("invalid JSON response: %w", err)
+		}
+
+		for _, key := range keys {
+			switch v := value.(type) {
+			case map[string]any:
+				next, ok := v[key]
+				if !ok {
+					return "", fmt.Errorf("key %q not found in JSON response", key)
+				}
+				value = next
+			case []any:
+				index, err := strconv.Atoi(key)
+				if err != nil || index < 0 || index >= len(v) {
+					return "", fmt.Errorf("index %q out of range in JSON response", key)
+				}
+				value = v[index]
+			default:
+				return "", fmt.Errorf("cannot descend into JSON value at %q", key)
+			}
+		}
+
+		str, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("JSON value at %q is not a string", path)
+		}
+		return strings.TrimSpace(str), nil
+	}, nil
+}
+
+// RegexParser returns the first capture group of the pattern, or the whole match if it has no groups
+func RegexParser(pattern string) (Parser, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("regex parser requires a pattern")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(body string) (string, error) {
+		match := re.FindStringSubmatch(body)
+		if match == nil {
+			return "", fmt.Errorf("pattern did not match response")
+		}
+		if len(match) > 1 {
+			return strings.TrimSpace(match[1]), nil
+		}
+		return strings.TrimSpace(match[0]), nil
+	}, nil
+}
+
+// KVParser returns the value of the first key=value line with the given key
+func KVParser(key string) (Parser, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, fmt.Errorf("kv parser requires a key")
+	}
+
+	return func(body string) (string, error) {
+		for _, line := range strings.Split(body, "\n") {
+			k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+			if ok && strings.TrimSpace(k) == key {
+				return strings.TrimSpace(v), nil
+			}
+		}
+		return "", fmt.Errorf("key %q not found in response", key)
+	}, nil
+}
@@ -0,0 +1,85 @@
+package ipget
+
+import "testing"
+
+func TestParsers(t *testing.T) {
+	trace := "fl=123abc\nh=1.1.1.1\nip=198.51.100.7\nts=1700000000.1\nvisit_scheme=https\n"
+
+	tests := []struct {
+		name       string
+		parserType string
+		arg        string
+		body       string
+		want       string
+	}{
+		{"plain text", PARSER_TEXT, "", "  198.51.100.7\n", "198.51.100.7"},
+		{"default parser", "", "", "2001:db8::7\n", "2001:db8::7"},
+		{"JSON key", PARSER_JSON, ".ip", `{"ip": "198.51.100.7", "country": "DE"}`, "198.51.100.7"},
+		{"JSON path without dot", PARSER_JSON, "ip", `{"ip": " 198.51.100.7 "}`, "198.51.100.7"},
+		{"nested JSON path", PARSER_JSON, ".data.client.address", `{"data": {"client": {"address": "198.51.100.7"}}}`, "198.51.100.7"},
+		{"JSON array index", PARSER_JSON, ".addresses.1", `{"addresses": ["2001:db8::7", "198.51.100.7"]}`, "198.51.100.7"},
+		{"regex capture group", PARSER_REGEX, `Current IP Address: ([0-9.]+)`, "<body>Current IP Address: 198.51.100.7</body>", "198.51.100.7"},
+		{"regex without group", PARSER_REGEX, `\d+\.\d+\.\d+\.\d+`, "your address is 198.51.100.7.", "198.51.100.7"},
+		{"key value line", PARSER_KV, "ip", trace, "198.51.100.7"},
+		{"key value with spaces", PARSER_KV, "ip", "h = 1.1.1.1\n ip = 198.51.100.7 \r\n", "198.51.100.7"},
+	}
+	for _, tt := range tests {
+		parse, err := NewParser(tt.parserType, tt.arg)
+		if err != nil {
+			t.Errorf("NewParser() for %s = %v", tt.name, err)
+			continue
+		}
+		if got, err := parse(tt.body); err != nil || got != tt.want {
+			t.Errorf("parse() of %s = %q, %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+
+	malformed := []struct {
+		name       string
+		parserType string
+		arg        string
+		body       string
+	}{
+		{"invalid JSON", PARSER_JSON, ".ip", `<html>rate limited</html>`},
+		{"truncated JSON", PARSER_JSON, ".ip", `{"ip": "198.51`},
+		{"missing JSON key", PARSER_JSON, ".ip", `{"address": "198.51.100.7"}`},
+		{"JSON index out of range", PARSER_JSON, ".addresses.2", `{"addresses": ["198.51.100.7"]}`},
+		{"JSON index not a number", PARSER_JSON, ".addresses.first", `{"addresses": ["198.51.100.7"]}`},
+		{"JSON path through a string", PARSER_JSON, ".ip.v4", `{"ip": "198.51.100.7"}`},
+		{"JSON number", PARSER_JSON, ".ip", `{"ip": 3325256711}`},
+		{"JSON null", PARSER_JSON, ".ip", `{"ip": null}`},
+		{"regex without match", PARSER_REGEX, `IP: ([0-9.]+)`, "service unavailable"},
+		{"missing key", PARSER_KV, "ip", "fl=123abc\nh=1.1.1.1\n"},
+		{"key without value separator", PARSER_KV, "ip", "ip 198.51.100.7\n"},
+	}
+	for _, tt := range malformed {
+		parse, err := NewParser(tt.parserType, tt.arg)
+		if err != nil {
+			t.Errorf("NewParser() for %s = %v", tt.name, err)
+			continue
+		}
+		if got, err := parse(tt.body); err == nil {
+			t.Errorf("parse() of %s = %q, want error", tt.name, got)
+		}
+	}
+}
+
+func TestNewParserInvalid(t *testing.T) {
+	invalid := []struct {
+		name       string
+		parserType string
+		arg        string
+	}{
+		{"unknown type", "xml", ".ip"},
+		{"JSON without path", PARSER_JSON, ""},
+		{"JSON path of a dot", PARSER_JSON, "."},
+		{"regex without pattern", PARSER_REGEX, ""},
+		{"invalid regex", PARSER_REGEX, `([0-9.]+`},
+		{"kv without key", PARSER_KV, " "},
+	}
+	for _, tt := range invalid {
+		if _, err := NewParser(tt.parserType, tt.arg); err == nil {
+			t.Errorf("NewParser() with %s = nil, want error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package ipget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Family identifies the IP address family being looked up
+type Family string
+
+const (
+	FAMILY_IPV4 Family = "ipv4"
+	FAMILY_IPV6 Family = "ipv6"
+)
+
+// Source is a single method of discovering a public IP address
+type Source interface {
+	// Name returns a short identifier for the source, used in logs
+	Name() string
+	// Lookup returns the public IP address of the requested family
+	Lookup(ctx context.Context, family Family) (string, error)
+}
+
+// Detector tries each of its sources in order until one of them returns an acceptable address
+type Detector struct {
+	validator *Validator
+	sources   []Source
+}
+
+// NewDetector creates a detector from an ordered list of sources, later sources are fallbacks.
+// Addresses rejected by the validator fall through to the next source, nil rejects bogons only.
+func NewDetector(validator *Validator, sources ...Source) *Detector {
+	if validator == nil {
+		validator = &Validator{}
+	}
+	return &Detector{validator: validator, sources: sources}
+}
+
+// Lookup returns the public IP address of the requested family from the first source that succeeds
+func (d *Detector) Lookup(ctx context.Context, family Family) (string, error) {
+	for _, source := range d.sources {
+		logger := log.With().Str("source", source.Name()).Str("family", string(family)).Logger()
+		ip, err := source.Lookup(ctx, family)
+		if err != nil {
+			// context-related errors should be returned immediately
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+				return "", err
+			}
+
+			// all other errors are logged and we fall back to the next source
+			logger.Warn().Err(err).Msg("failed to acquire IP address from source")
+			continue
+		}
+
+		// a source returning a bogon or unexpected address is distrusted for this lookup
+		if err := d.validator.Check(ip); err != nil {
+			logger.Warn().Err(err).Str("address", ip).Msg("rejected IP address from source")
+			continue
+		}
+		return ip, nil
+	}
+
+	return "", fmt.Errorf("no source could determine the public %s address", family)
+}
+
+// GetPublicIPv4 returns the public IPv4 address using the detector's sources
+func (d *Detector) GetPublicIPv4(ctx context.Context) (string, error) {
+	return d.Lookup(ctx, FAMILY_IPV4)
+}
+
+// GetPublicIPv6 returns the public IPv6 address using the detector's sources
+func (d *Detector) GetPublicIPv6(ctx context.Context) (string, error) {
+	return d.Lookup(ctx, FAMILY_IPV6)
+}
+
+// HTTPSource discovers the public IP address by asking HTTP echo services
+type HTTPSource struct {
+	client       *http.Client
+	ipv4Services []Service
+	ipv6Services []Service
+	validator    *Validator
+}
+
+// NewHTTPSource creates a source backed by the built-in HTTP echo services
+func NewHTTPSource() *HTTPSource {
+	return NewHTTPSourceWithServices(nil, nil, nil, nil)
+}
+
+// NewHTTPSourceWithServices creates a source backed by custom services, a family without any
+// services uses the built-in ones. Requests honor the binding, nil = default routing. Services
+// returning an address the validator rejects fall through to the next one, nil rejects bogons only.
+func NewHTTPSourceWithServices(ipv4, ipv6 []Service, binding *Binding, validator *Validator) *HTTPSource {
+	if len(ipv4) == 0 {
+		ipv4 = textServices(ipv4Services)
+	}
+	if len(ipv6) == 0 {
+		ipv6 = textServices(ipv6Services)
+	}
+
+	if validator == nil {
+		validator = &Validator{}
+	}
+
+	httpClient := client
+	if binding != nil {
+		httpClient = NewHTTPClient(binding, TIMEOUT_DEFAULT)
+	}
+	return &HTTPSource{client: httpClient, ipv4Services: ipv4, ipv6Services: ipv6, validator: validator}
+}
+
+func (s *HTTPSource) Name() string {
+	return "http"
+}
+
+func (s *HTTPSource) Lookup(ctx context.Context, family Family) (string, error) {
+	switch family {
+	case FAMILY_IPV4:
+		return getPublicIP(ctx, s.client, s.ipv4Services, family, s.validator)
+	case FAMILY_IPV6:
+		return getPublicIP(ctx, s.client, s.ipv6Services, family, s.validator)
+	}
+	return "", fmt.Errorf("unsupported address family: %s", family)
+}
+
+// Vote is the result of a single source taking part in a quorum lookup
+type Vote struct {
+	Source string // name of the source
+	IP     string // address reported by the source, empty on error
+	Err    error  // error returned by the source
+}
+
+// Consensus returns the address reported by at least threshold of the votes. It fails if no address
+// reaches the threshold, or if more than one does.
+func Consensus(votes []Vote, threshold int) (string, error) {
+	tally := make(map[string]int)
+	for _, vote := range votes {
+		if vote.Err != nil {
+			continue
+		}
+		if ip := strToIP(vote.IP); ip != nil {
+			tally[ip.String()]++
+		}
+	}
+
+	var winners []string
+	for ip, count := range tally {
+		if count >= threshold {
+			winners = append(winners, ip)
+		}
+	}
+
+	switch len(winners) {
+	case 0:
+		return "", fmt.Errorf("no address was reported by at least %d of %d sources", threshold, len(votes))
+	case 1:
+		return winners[0], nil
+	default:
+		return "", fmt.Errorf("%d different addresses reached the threshold of %d sources", len(winners), threshold)
+	}
+}
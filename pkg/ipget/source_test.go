@@ -0,0 +1,76 @@
+package ipget
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestConsensus(t *testing.T) {
+	failed := errors.New("timeout")
+	rejected := fmt.Errorf("%w: 192.168.1.1 is in reserved range 192.168.0.0/16", ErrRejected)
+
+	tests := []struct {
+		name      string
+		votes     []Vote
+		threshold int
+		want      string // empty if no consensus is expected
+	}{
+		{
+			"agreement",
+			[]Vote{{Source: "http", IP: "1.1.1.1"}, {Source: "dns", IP: "1.1.1.1"}, {Source: "stun", IP: "1.1.1.1"}},
+			3, "1.1.1.1",
+		},
+		{
+			"majority",
+			[]Vote{{Source: "http", IP: "1.1.1.1"}, {Source: "dns", IP: "1.0.0.1"}, {Source: "stun", IP: "1.1.1.1"}},
+			2, "1.1.1.1",
+		},
+		{
+			"equal addresses in different notations",
+			[]Vote{{Source: "http", IP: "2606:4700:0:0::1111"}, {Source: "dns", IP: "2606:4700::1111"}},
+			2, "2606:4700::1111",
+		},
+		{
+			"disagreement",
+			[]Vote{{Source: "http", IP: "1.1.1.1"}, {Source: "dns", IP: "1.0.0.1"}, {Source: "stun", IP: "9.9.9.9"}},
+			2, "",
+		},
+		{
+			"quorum not reached",
+			[]Vote{{Source: "http", IP: "1.1.1.1"}, {Source: "dns", IP: "1.1.1.1"}, {Source: "stun", IP: "1.0.0.1"}},
+			3, "",
+		},
+		{
+			"several addresses reaching the threshold",
+			[]Vote{{Source: "http", IP: "1.1.1.1"}, {Source: "dns", IP: "1.0.0.1"}},
+			1, "",
+		},
+		{
+			"failed sources within the margin",
+			[]Vote{{Source: "http", IP: "1.1.1.1"}, {Source: "dns", Err: failed}, {Source: "stun", IP: "1.1.1.1"}},
+			2, "1.1.1.1",
+		},
+		{
+			"failed and rejected sources",
+			[]Vote{{Source: "http", IP: "1.1.1.1"}, {Source: "dns", Err: failed}, {Source: "stun", IP: "1.1.1.1", Err: rejected}},
+			2, "",
+		},
+		{
+			"invalid addresses",
+			[]Vote{{Source: "http", IP: "1.1.1.1"}, {Source: "dns", IP: "not-an-ip"}, {Source: "stun", IP: "not-an-ip"}},
+			2, "",
+		},
+		{"every source failing", []Vote{{Source: "http", Err: failed}, {Source: "dns", Err: failed}}, 1, ""},
+		{"no votes", nil, 1, ""},
+	}
+	for _, tt := range tests {
+		ip, err := Consensus(tt.votes, tt.threshold)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("Consensus() with %s = %q, want error", tt.name, ip)
+		case tt.want != "" && (err != nil || ip != tt.want):
+			t.Errorf("Consensus() with %s = %q, %v, want %s", tt.name, ip, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package ipget
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// STUN message constants (RFC 5389)
+const (
+	stunMagicCookie          = 0x2112A442
+	stunHeaderSize           = 20
+	stunBindingRequest       = 0x0001
+	stunBindingSuccess       = 0x0101
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXorMappedAddress = 0x0020
+	stunFamilyIPv4           = 0x01
+	stunFamilyIPv6           = 0x02
+)
+
+// how long to wait for a single STUN server to answer a binding request
+const stunServerTimeout = time.Second * 2
+
+// NAT mapping behaviour as observed from STUN binding responses (RFC 4787)
+const (
+	NAT_MAPPING_NONE                 = "none"                 // mapped address is the local address, no NAT
+	NAT_MAPPING_ENDPOINT_INDEPENDENT = "endpoint-independent" // same mapping towards every server
+	NAT_MAPPING_ENDPOINT_DEPENDENT   = "endpoint-dependent"   // mapping changes per server (symmetric NAT, common with CGNAT)
+	NAT_MAPPING_UNKNOWN              = "unknown"              // not enough responses to tell
+)
+
+// STUN servers to query when none are configured
+var stunServers = []string{
+	"stun.l.google.com:19302",
+	"stun1.l.google.com:19302",
+	"stun.cloudflare.com:3478",
+}
+
+// STUNSource discovers the public IP address from the XOR-MAPPED-ADDRESS of STUN binding responses
+type STUNSource struct {
+	binding *Binding
+	servers []string
+}
+
+// NewSTUNSource creates a source querying the given STUN servers (host:port), or the built-in list if empty
+func NewSTUNSource(servers []string, binding *Binding) *STUNSource {
+	if len(servers) == 0 {
+		servers = stunServers
+	}
+	return &STUNSource{binding: binding, servers: servers}
+}
+
+func (s *STUNSource) Name() string {
+	return "stun"
+}
+
+func (s *STUNSource) Lookup(ctx context.Context, family Family) (string, error) {
+	var network string
+	switch family {
+	case FAMILY_IPV4:
+		network = "udp4"
+	case FAMILY_IPV6:
+		network = "udp6"
+	default:
+		return "", fmt.Errorf("unsupported address family: %s", family)
+	}
+
+	// a single socket is used for every server so that mappings can be compared
+	conn, err := s.binding.ListenPacket(ctx, network)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	// unblock any pending read if the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	var local *net.UDPAddr
+	var mapped []*net.UDPAddr
+
+	for _, server := range shuffle(s.servers) {
+		logger := log.With().Str("server", server).Logger()
+
+		addr, err := stunResolve(ctx, s.binding, network, server)
+		if err == nil {
+			var m *net.UDPAddr
+			if m, err = stunBinding(ctx, conn, addr); err == nil {
+				if local == nil {
+					local = stunLocalAddr(ctx, s.binding, network, addr, conn.LocalAddr())
+				}
+				mapped = append(mapped, m)
+			}
+		}
+		if err != nil {
+			// context-related errors should be returned immediately
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				logger.Error().Err(ctxErr).Msg("request context error")
+				return "", ctxErr
+			}
+
+			// all other errors are logged and we continue to the next server
+			logger.Warn().Err(err).Msg("failed to acquire IP address from STUN server")
+			continue
+		}
+
+		// a second mapping is only needed to classify the NAT behaviour for debug output
+		if len(mapped) >= 2 || !log.Debug().Enabled() {
+			break
+		}
+	}
+
+	if len(mapped) == 0 {
+		return "", fmt.Errorf("could not retrieve public IP address from STUN")
+	}
+
+	log.Debug().
+		Str("local", local.String()).
+		Str("mapped", mapped[0].String()).
+		Str("mapping", natMappingType(local, mapped)).
+		Bool("cgnat", cgnatNet.Contains(local.IP) || cgnatNet.Contains(mapped[0].IP)).
+		Msg("detected NAT mapping")
+
+	ip := strToIP(mapped[0].IP.String())
+	if ip == nil || (family == FAMILY_IPV4) != (ip.To4() != nil) {
+		return "", fmt.Errorf("STUN server returned a non-%s address: %s", family, mapped[0].IP)
+	}
+	return ip.String(), nil
+}
+
+// natMappingType classifies the NAT between the local socket and the servers which answered
+func natMappingType(local *net.UDPAddr, mapped []*net.UDPAddr) string {
+	if local != nil && local.IP.Equal(mapped[0].IP) && local.Port == mapped[0].Port {
+		return NAT_MAPPING_NONE
+	}
+	if len(mapped) < 2 {
+		return NAT_MAPPING_UNKNOWN
+	}
+	if mapped[0].IP.Equal(mapped[1].IP) && mapped[0].Port == mapped[1].Port {
+		return NAT_MAPPING_ENDPOINT_INDEPENDENT
+	}
+	return NAT_MAPPING_ENDPOINT_DEPENDENT
+}
+
+// stunLocalAddr determines the local address used to reach the server, combined with the socket's port
+func stunLocalAddr(ctx context.Context, binding *Binding, network string, server *net.UDPAddr, socket net.Addr) *net.UDPAddr {
+	local := &net.UDPAddr{}
+	if addr, ok := socket.(*net.UDPAddr); ok {
+		local.Port = addr.Port
+	}
+
+	// connecting a UDP socket sends no packets but selects the outbound source address
+	conn, err := binding.DialContext(ctx, network, server.String())
+	if err != nil {
+		return local
+	}
+	defer conn.Close()
+
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		local.IP = addr.IP
+	}
+	return local
+}
+
+// stunResolve resolves a host:port STUN server address for the given network through the binding
+func stunResolve(ctx context.Context, binding *Binding, network, server string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+
+	ipNetwork := "ip4"
+	if network == "udp6" {
+		ipNetwork = "ip6"
+	}
+
+	ips, err := binding.Resolver().LookupIP(ctx, ipNetwork, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no %s address for STUN server %s", ipNetwork, host)
+	}
+
+	return net.ResolveUDPAddr(network, net.JoinHostPort(ips[0].String(), port))
+}
+
+// stunBinding sends a binding request to the server and returns the mapped address from its response
+func stunBinding(ctx context.Context, conn net.PacketConn, server *net.UDPAddr) (*net.UDPAddr, error) {
+	req := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(req[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint16(req[2:4], 0)
+	binary.BigEndian.PutUint32(req[4:8], stunMagicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return nil, err
+	}
+	txID := req[8:20]
+
+	deadline := time.Now().Add(stunServerTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.WriteTo(req, server); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// ignore packets from other servers or for other transactions (e.g. late responses)
+		if udp, ok := from.(*net.UDPAddr); !ok || !udp.IP.Equal(server.IP) || udp.Port != server.Port {
+			continue
+		}
+		if n < stunHeaderSize || !bytes.Equal(buf[8:20], txID) {
+			continue
+		}
+
+		return parseSTUNResponse(buf[:n])
+	}
+}
+
+// parseSTUNResponse extracts the mapped address from a binding success response
+func parseSTUNResponse(msg []byte) (*net.UDPAddr, error) {
+	if len(msg) < stunHeaderSize {
+		return nil, errors.New("truncated STUN message")
+	}
+	if binary.BigEndian.Uint16(msg[0:2]) != stunBindingSuccess {
+		return nil, fmt.Errorf("unexpected STUN message type: 0x%04x", binary.BigEndian.Uint16(msg[0:2]))
+	}
+	if binary.BigEndian.Uint32(msg[4:8]) != stunMagicCookie {
+		return nil, errors.New("invalid STUN magic cookie")
+	}
+
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	if stunHeaderSize+length > len(msg) {
+		return nil, errors.New("truncated STUN message")
+	}
+
+	var mapped *net.UDPAddr
+	attrs := msg[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+attrLen > len(attrs) {
+			return nil, errors.New("truncated STUN attribute")
+		}
+		value := attrs[4 : 4+attrLen]
+
+		switch attrType {
+		case stunAttrXorMappedAddress:
+			// XOR-MAPPED-ADDRESS is preferred and returned as soon as it is found
+			return parseSTUNAddress(value, msg[4:20])
+		case stunAttrMappedAddress:
+			if addr, err := parseSTUNAddress(value, nil); err == nil {
+				mapped = addr
+			}
+		}
+
+		// attributes are padded to a multiple of 4 bytes
+		padded := (attrLen + 3) &^ 3
+		if 4+padded > len(attrs) {
+			break
+		}
+		attrs = attrs[4+padded:]
+	}
+
+	if mapped == nil {
+		return nil, errors.New("no mapped address in STUN response")
+	}
+	return mapped, nil
+}
+
+// parseSTUNAddress decodes a (XOR-)MAPPED-ADDRESS value, xorKey is the cookie and transaction ID or nil
+func parseSTUNAddress(value, xorKey []byte) (*net.UDPAddr, error) {
+	if len(value) < 4 {
+		return nil, errors.New("invalid STUN address attribute")
+	}
+
+	var ip net.IP
+	switch value[1] {
+	case stunFamilyIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case stunFamilyIPv6:
+		ip = make(net.IP, net.IPv6len)
+	default:
+		return nil, fmt.Errorf("unknown STUN address family: %d", value[1])
+	}
+	if len(value) < 4+len(ip) {
+		return nil, errors.New("truncated STUN address attribute")
+	}
+
+	port := binary.BigEndian.Uint16(value[2:4])
+	copy(ip, value[4:4+len(ip)])
+
+	if xorKey != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xorKey[i]
+		}
+	}
+
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,169 @@
+package ipget
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTxID is the transaction ID of the test messages
+var testTxID = []byte("cfdns-tx-id1")
+
+// stunMessage builds a binding success response with the transaction ID and attributes
+func stunMessage(txID []byte, attrs ...[]byte) []byte {
+	body := bytes.Join(attrs, nil)
+	msg := make([]byte, stunHeaderSize, stunHeaderSize+len(body))
+	binary.BigEndian.PutUint16(msg[0:2], stunBindingSuccess)
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(body)))
+	binary.BigEndian.PutUint32(msg[4:8], stunMagicCookie)
+	copy(msg[8:20], txID)
+	return append(msg, body...)
+}
+
+// stunAttr encodes an attribute, padded to a multiple of 4 bytes
+func stunAttr(attrType uint16, value []byte) []byte {
+	attr := binary.BigEndian.AppendUint16(nil, attrType)
+	attr = binary.BigEndian.AppendUint16(attr, uint16(len(value)))
+	attr = append(attr, value...)
+	return append(attr, make([]byte, (4-len(value)%4)%4)...)
+}
+
+// stunAddress encodes a MAPPED-ADDRESS value, or a XOR-MAPPED-ADDRESS value if txID is set
+func stunAddress(address string, port uint16, txID []byte) []byte {
+	ip := net.ParseIP(address)
+	family := byte(stunFamilyIPv6)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, family = ip4, stunFamilyIPv4
+	}
+	ip = bytes.Clone(ip)
+
+	if txID != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		key := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+		key = append(key, txID...)
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+
+	value := []byte{0, family}
+	value = binary.BigEndian.AppendUint16(value, port)
+	return append(value, ip...)
+}
+
+func TestParseSTUNResponse(t *testing.T) {
+	xorIPv4 := stunAttr(stunAttrXorMappedAddress, stunAddress("1.1.1.1", 40000, testTxID))
+	xorIPv6 := stunAttr(stunAttrXorMappedAddress, stunAddress("2606:4700::1111", 40001, testTxID))
+	mappedIPv4 := stunAttr(stunAttrMappedAddress, stunAddress("1.0.0.1", 40002, nil))
+	software := stunAttr(0x8022, []byte("test"))
+
+	tests := []struct {
+		name string
+		msg  []byte
+		want string
+	}{
+		{"XOR-MAPPED-ADDRESS", stunMessage(testTxID, software, xorIPv4), "1.1.1.1:40000"},
+		{"IPv6 XOR-MAPPED-ADDRESS", stunMessage(testTxID, xorIPv6), "[2606:4700::1111]:40001"},
+		{"MAPPED-ADDRESS", stunMessage(testTxID, mappedIPv4, software), "1.0.0.1:40002"},
+		{"XOR-MAPPED-ADDRESS preferred", stunMessage(testTxID, mappedIPv4, xorIPv4), "1.1.1.1:40000"},
+		{"padded attribute", stunMessage(testTxID, stunAttr(0x8022, []byte("cfdns")), xorIPv4), "1.1.1.1:40000"},
+	}
+	for _, tt := range tests {
+		addr, err := parseSTUNResponse(tt.msg)
+		if err != nil || addr.String() != tt.want {
+			t.Errorf("parseSTUNResponse() of %s = %v, %v, want %s", tt.name, addr, err, tt.want)
+		}
+	}
+
+	errorResponse := stunMessage(testTxID, xorIPv4)
+	binary.BigEndian.PutUint16(errorResponse[0:2], 0x0111)
+	badCookie := stunMessage(testTxID, xorIPv4)
+	badCookie[4] ^= 0xFF
+	unknownFamily := stunAddress("1.1.1.1", 40000, testTxID)
+	unknownFamily[1] = 0x03
+
+	invalid := []struct {
+		name string
+		msg  []byte
+	}{
+		{"empty message", nil},
+		{"truncated header", stunMessage(testTxID)[:stunHeaderSize-1]},
+		{"error response", errorResponse},
+		{"invalid magic cookie", badCookie},
+		{"no mapped address", stunMessage(testTxID, software)},
+		{"message shorter than its length", stunMessage(testTxID, xorIPv4)[:stunHeaderSize+8]},
+		{"attribute longer than the message", stunMessage(testTxID, xorIPv4[:8])},
+		{"truncated IPv4 address", stunMessage(testTxID, stunAttr(stunAttrXorMappedAddress, stunAddress("1.1.1.1", 40000, testTxID)[:6]))},
+		{"truncated IPv6 address", stunMessage(testTxID, stunAttr(stunAttrXorMappedAddress, stunAddress("2606:4700::1111", 40000, testTxID)[:8]))},
+		{"address without family", stunMessage(testTxID, stunAttr(stunAttrXorMappedAddress, []byte{0, 1}))},
+		{"unknown address family", stunMessage(testTxID, stunAttr(stunAttrXorMappedAddress, unknownFamily))},
+		{"truncated MAPPED-ADDRESS", stunMessage(testTxID, stunAttr(stunAttrMappedAddress, stunAddress("1.0.0.1", 40002, nil)[:5]))},
+	}
+	for _, tt := range invalid {
+		if addr, err := parseSTUNResponse(tt.msg); err == nil {
+			t.Errorf("parseSTUNResponse() of %s = %v, want error", tt.name, addr)
+		}
+	}
+}
+
+// startFakeSTUNServer answers every binding request with the responses built from its transaction ID
+func startFakeSTUNServer(t *testing.T, responses ...func(txID []byte) []byte) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < stunHeaderSize {
+				continue
+			}
+			txID := bytes.Clone(buf[8:20])
+			for _, response := range responses {
+				conn.WriteTo(response(txID), from)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestSTUNBinding(t *testing.T) {
+	mapped := func(address string) func(txID []byte) []byte {
+		return func(txID []byte) []byte {
+			return stunMessage(txID, stunAttr(stunAttrXorMappedAddress, stunAddress(address, 40000, txID)))
+		}
+	}
+	otherTransaction := func(txID []byte) []byte {
+		return mapped("9.9.9.9")(bytes.Repeat([]byte{0xAB}, 12))
+	}
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// responses to other transactions, e.g. late ones to a previous request, are ignored
+	server := startFakeSTUNServer(t, otherTransaction, mapped("1.1.1.1"))
+	addr, err := stunBinding(context.Background(), conn, server)
+	if err != nil || addr.String() != "1.1.1.1:40000" {
+		t.Errorf("stunBinding() = %v, %v, want 1.1.1.1:40000", addr, err)
+	}
+
+	server = startFakeSTUNServer(t, otherTransaction)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if addr, err := stunBinding(ctx, conn, server); err == nil {
+		t.Errorf("stunBinding() with only other transactions = %v, want error", addr)
+	}
+}
@@ -0,0 +1,119 @@
+package ipget
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ranges which must never be published as a public address
+var bogonCIDRs = []string{
+	"0.0.0.0/8",       // "this" network
+	"10.0.0.0/8",      // private (RFC 1918)
+	"100.64.0.0/10",   // carrier-grade NAT (RFC 6598)
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link-local
+	"172.16.0.0/12",   // private (RFC 1918)
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation (TEST-NET-1)
+	"192.168.0.0/16",  // private (RFC 1918)
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation (TEST-NET-2)
+	"203.0.113.0/24",  // documentation (TEST-NET-3)
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved and broadcast
+	"::/128",          // unspecified
+	"::1/128",         // loopback
+	"64:ff9b::/96",    // NAT64
+	"100::/64",        // discard-only
+	"2001:db8::/32",   // documentation
+	"fc00::/7",        // unique local addresses
+	"fe80::/10",       // link-local
+	"ff00::/8",        // multicast
+}
+
+var bogonNets = mustParseCIDRs(bogonCIDRs)
+
+// ErrRejected is returned (wrapped) when an address fails validation
+var ErrRejected = errors.New("address rejected")
+
+// Validator rejects bogon addresses and enforces optional allowed and denied ranges
+type Validator struct {
+	allowed []*net.IPNet // if set, addresses must be in one of these, explicitly allowed bogons are accepted
+	denied  []*net.IPNet // addresses in these ranges are always rejected
+}
+
+// NewValidator creates a validator from lists of CIDRs, both lists are optional
+func NewValidator(allowed, denied []string) (*Validator, error) {
+	allowedNets, err := parseCIDRs(allowed)
+	if err != nil {
+		return nil, err
+	}
+	deniedNets, err := parseCIDRs(denied)
+	if err != nil {
+		return nil, err
+	}
+	return &Validator{allowed: allowedNets, denied: deniedNets}, nil
+}
+
+// Check returns an error wrapping ErrRejected with the reason if the address must not be published
+func (v *Validator) Check(address string) error {
+	ip := strToIP(address)
+	if ip == nil {
+		return fmt.Errorf("%w: %q is not an IP address", ErrRejected, address)
+	}
+
+	if n := findNet(v.denied, ip); n != nil {
+		return fmt.Errorf("%w: %s is in denied range %s", ErrRejected, ip, n)
+	}
+
+	if len(v.allowed) > 0 {
+		if findNet(v.allowed, ip) == nil {
+			return fmt.Errorf("%w: %s is not in any allowed range", ErrRejected, ip)
+		}
+		return nil
+	}
+
+	if n := findNet(bogonNets, ip); n != nil {
+		return fmt.Errorf("%w: %s is in reserved range %s", ErrRejected, ip, n)
+	}
+
+	return nil
+}
+
+// findNet returns the first network of the address family containing the address, or nil. Contains
+// alone would match every IPv4 address against IPv6 networks such as ::ffff:0:0/96.
+func findNet(nets []*net.IPNet, ip net.IP) *net.IPNet {
+	isIPv4 := ip.To4() != nil
+	for _, n := range nets {
+		if (len(n.IP) == net.IPv4len) != isIPv4 {
+			continue
+		}
+		if n.Contains(ip) {
+			return n
+		}
+	}
+	return nil
+}
+
+// parseCIDRs parses a list of CIDR strings
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// mustParseCIDRs parses a list of built-in CIDR strings, panicking on error
+func mustParseCIDRs(cidrs []string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
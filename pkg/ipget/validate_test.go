@@ -0,0 +1,76 @@
+package ipget
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestValidatorPublic(t *testing.T) {
+	v, err := NewValidator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, address := range []string{"8.8.8.8", "1.1.1.1", "2606:4700:4700::1111", "2001:4860:4860::8888"} {
+		if err := v.Check(address); err != nil {
+			t.Errorf("Check(%s) = %v, want nil", address, err)
+		}
+	}
+}
+
+func TestValidatorBogons(t *testing.T) {
+	v, err := NewValidator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first and last address of every reserved range are rejected
+	for _, cidr := range bogonCIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := make(net.IP, len(n.IP))
+		for i := range n.IP {
+			last[i] = n.IP[i] | ^n.Mask[i]
+		}
+
+		for _, ip := range []net.IP{n.IP, last} {
+			err := v.Check(ip.String())
+			if !errors.Is(err, ErrRejected) {
+				t.Errorf("Check(%s) = %v, want rejection by %s", ip, err, cidr)
+			}
+		}
+	}
+
+	for _, address := range []string{"", "not-an-ip", "::ffff:10.0.0.1"} {
+		if err := v.Check(address); !errors.Is(err, ErrRejected) {
+			t.Errorf("Check(%q) = %v, want rejection", address, err)
+		}
+	}
+}
+
+func TestValidatorAllowedDenied(t *testing.T) {
+	v, err := NewValidator([]string{"10.0.0.0/8", "2001:db8::/32", "8.8.0.0/16"}, []string{"8.8.4.0/24", "::ffff:0:0/96"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		address string
+		ok      bool
+	}{
+		{"10.1.2.3", true},    // explicitly allowed bogon
+		{"2001:db8::1", true}, // explicitly allowed bogon
+		{"8.8.8.8", true},     // allowed, not in the IPv4-mapped denied range
+		{"8.8.4.4", false},    // denied wins over allowed
+		{"1.1.1.1", false},    // not in any allowed range
+		{"2606:4700::1", false},
+	}
+	for _, tt := range tests {
+		if err := v.Check(tt.address); (err == nil) != tt.ok {
+			t.Errorf("Check(%s) = %v, want ok = %v", tt.address, err, tt.ok)
+		}
+	}
+}
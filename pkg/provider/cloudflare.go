@@ -0,0 +1,142 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/goodieshq/cfdns/pkg/config"
+	"golang.org/x/time/rate"
+)
+
+// Cloudflare manages the records of the zones accessible with a Cloudflare API token
+type Cloudflare struct {
+	api   *cloudflare.API // API client for the token
+	retry *retrier        // retry policy of the API calls
+}
+
+// NewCloudflare creates a provider for the zones accessible with the token. The HTTP client should
+// use a transport created by NewAPITransport, so rate limiting is shared by all clients.
+func NewCloudflare(token string, httpClient *http.Client, retry config.Retry) (*Cloudflare, error) {
+	// retries and rate limiting are handled by the retry layer and the shared transport
+	api, err := cloudflare.NewWithAPIToken(
+		token,
+		cloudflare.HTTPClient(httpClient),
+		cloudflare.UsingRetryPolicy(0, 0, 0),
+		cloudflare.UsingRateLimit(float64(rate.Inf)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	transport, _ := httpClient.Transport.(*apiTransport)
+	return &Cloudflare{api: api, retry: newRetrier(retry, transport)}, nil
+}
+
+// Zones lists the zones accessible with the token
+func (p *Cloudflare) Zones(ctx context.Context) ([]Zone, error) {
+	list, err := withRetry(ctx, p.retry, "list zones", func(ctx context.Context) ([]cloudflare.Zone, error) {
+		return p.api.ListZones(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	zones := make([]Zone, len(list))
+	for i, z := range list {
+		zones[i] = Zone{ID: z.ID, Name: z.Name}
+	}
+	return zones, nil
+}
+
+// ValidateZone checks that the zone ID is accessible with the token
+func (p *Cloudflare) ValidateZone(ctx context.Context, zone Zone) error {
+	zones, err := p.Zones(ctx)
+	if err != nil {
+		return err
+	}
+	for _, z := range zones {
+		if z.ID == zone.ID {
+			return nil
+		}
+	}
+	return fmt.Errorf("zone %s: %w", zone.Name, ErrZoneNotFound)
+}
+
+// ListRecords lists every record of the zone, the listing is paginated by the client
+func (p *Cloudflare) ListRecords(ctx context.Context, zone Zone) ([]Record, error) {
+	list, err := withRetry(ctx, p.retry, "list DNS records", func(ctx context.Context) ([]cloudflare.DNSRecord, error) {
+		records, _, err := p.api.ListDNSRecords(ctx, cloudflare.ZoneIdentifier(zone.ID), cloudflare.ListDNSRecordsParams{})
+		return records, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]Record, len(list))
+	for i, record := range list {
+		records[i] = fromCloudflare(record)
+	}
+	return records, nil
+}
+
+// CreateRecord creates a record in the zone
+func (p *Cloudflare) CreateRecord(ctx context.Context, zone Zone, record Record) (Record, error) {
+	created, err := withRetry(ctx, p.retry, "create DNS record", func(ctx context.Context) (cloudflare.DNSRecord, error) {
+		return p.api.CreateDNSRecord(ctx, cloudflare.ZoneIdentifier(zone.ID), cloudflare.CreateDNSRecordParams{
+			Type:    record.Type,
+			Name:    record.Name,
+			Content: record.Content,
+			Proxied: record.Proxied,
+			TTL:     record.TTL,
+			Comment: record.Comment,
+			Tags:    record.Tags,
+		})
+	})
+	if err != nil {
+		return record, err
+	}
+	return fromCloudflare(created), nil
+}
+
+// UpdateRecord replaces the content and settings of a record in the zone
+func (p *Cloudflare) UpdateRecord(ctx context.Context, zone Zone, record Record) (Record, error) {
+	updated, err := withRetry(ctx, p.retry, "update DNS record", func(ctx context.Context) (cloudflare.DNSRecord, error) {
+		return p.api.UpdateDNSRecord(ctx, cloudflare.ZoneIdentifier(zone.ID), cloudflare.UpdateDNSRecordParams{
+			ID:      record.ID,
+			Type:    record.Type,
+			Name:    record.Name,
+			Content: record.Content,
+			Proxied: record.Proxied,
+			TTL:     record.TTL,
+			Comment: &record.Comment,
+			Tags:    record.Tags,
+		})
+	})
+	if err != nil {
+		return record, err
+	}
+	return fromCloudflare(updated), nil
+}
+
+// DeleteRecord deletes a record from the zone
+func (p *Cloudflare) DeleteRecord(ctx context.Context, zone Zone, record Record) error {
+	_, err := withRetry(ctx, p.retry, "delete DNS record", func(ctx context.Context) (any, error) {
+		return nil, p.api.DeleteDNSRecord(ctx, cloudflare.ZoneIdentifier(zone.ID), record.ID)
+	})
+	return err
+}
+
+// fromCloudflare converts a Cloudflare record
+func fromCloudflare(record cloudflare.DNSRecord) Record {
+	return Record{
+		ID:      record.ID,
+		Type:    record.Type,
+		Name:    record.Name,
+		Content: record.Content,
+		Proxied: record.Proxied,
+		TTL:     record.TTL,
+		Comment: record.Comment,
+		Tags:    record.Tags,
+	}
+}
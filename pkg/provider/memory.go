@@ -0,0 +1,157 @@
+package provider
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Memory keeps the records of its zones in memory, for tests and for trying out a configuration
+// without changing any DNS record
+type Memory struct {
+	mu      sync.Mutex
+	zones   map[string]Zone              // zones keyed by ID
+	records map[string]map[string]Record // records of each zone keyed by zone ID and record ID
+	nextID  int                          // sequence of record identifiers
+}
+
+// NewMemory creates a provider hosting the given zones, without any record
+func NewMemory(zones ...Zone) *Memory {
+	p := &Memory{
+		zones:   make(map[string]Zone),
+		records: make(map[string]map[string]Record),
+	}
+	for _, zone := range zones {
+		p.AddZone(zone)
+	}
+	return p
+}
+
+// AddZone adds an empty zone, the zone name is used as ID if the ID is empty
+func (p *Memory) AddZone(zone Zone) {
+	if zone.ID == "" {
+		zone.ID = zone.Name
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.zones[zone.ID]; !ok {
+		p.zones[zone.ID] = zone
+		p.records[zone.ID] = make(map[string]Record)
+	}
+}
+
+// Zones lists the hosted zones
+func (p *Memory) Zones(ctx context.Context) ([]Zone, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	zones := make([]Zone, 0, len(p.zones))
+	for _, zone := range p.zones {
+		zones = append(zones, zone)
+	}
+	slices.SortFunc(zones, func(a, b Zone) int { return cmp.Compare(a.Name, b.Name) })
+	return zones, nil
+}
+
+// ValidateZone checks that the zone is hosted
+func (p *Memory) ValidateZone(ctx context.Context, zone Zone) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.zones[zone.ID]; !ok {
+		return fmt.Errorf("zone %s: %w", zone.Name, ErrZoneNotFound)
+	}
+	return nil
+}
+
+// ListRecords lists every record of the zone in creation order
+func (p *Memory) ListRecords(ctx context.Context, zone Zone) ([]Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stored, ok := p.records[zone.ID]
+	if !ok {
+		return nil, fmt.Errorf("zone %s: %w", zone.Name, ErrZoneNotFound)
+	}
+
+	records := make([]Record, 0, len(stored))
+	for _, record := range stored {
+		records = append(records, cloneRecord(record))
+	}
+	slices.SortFunc(records, func(a, b Record) int {
+		return cmp.Compare(recordSeq(a.ID), recordSeq(b.ID))
+	})
+	return records, nil
+}
+
+// CreateRecord stores a new record with a fresh identifier
+func (p *Memory) CreateRecord(ctx context.Context, zone Zone, record Record) (Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stored, ok := p.records[zone.ID]
+	if !ok {
+		return record, fmt.Errorf("zone %s: %w", zone.Name, ErrZoneNotFound)
+	}
+
+	p.nextID++
+	record.ID = strconv.Itoa(p.nextID)
+	record.Name = strings.ToLower(record.Name)
+	stored[record.ID] = cloneRecord(record)
+	return record, nil
+}
+
+// UpdateRecord replaces a stored record
+func (p *Memory) UpdateRecord(ctx context.Context, zone Zone, record Record) (Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stored, ok := p.records[zone.ID]
+	if !ok {
+		return record, fmt.Errorf("zone %s: %w", zone.Name, ErrZoneNotFound)
+	}
+	if _, ok := stored[record.ID]; !ok {
+		return record, fmt.Errorf("record %s: %w", record.ID, ErrRecordNotFound)
+	}
+
+	record.Name = strings.ToLower(record.Name)
+	stored[record.ID] = cloneRecord(record)
+	return record, nil
+}
+
+// DeleteRecord removes a stored record
+func (p *Memory) DeleteRecord(ctx context.Context, zone Zone, record Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stored, ok := p.records[zone.ID]
+	if !ok {
+		return fmt.Errorf("zone %s: %w", zone.Name, ErrZoneNotFound)
+	}
+	if _, ok := stored[record.ID]; !ok {
+		return fmt.Errorf("record %s: %w", record.ID, ErrRecordNotFound)
+	}
+
+	delete(stored, record.ID)
+	return nil
+}
+
+// cloneRecord copies a record so stored records do not share slices with callers
+func cloneRecord(record Record) Record {
+	record.Tags = slices.Clone(record.Tags)
+	if record.Proxied != nil {
+		proxied := *record.Proxied
+		record.Proxied = &proxied
+	}
+	return record
+}
+
+// recordSeq returns the sequence number of a record identifier
+func recordSeq(id string) int {
+	seq, _ := strconv.Atoi(id)
+	return seq
+}
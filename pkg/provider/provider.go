@@ -0,0 +1,47 @@
+package provider
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrZoneNotFound is returned when a zone is not hosted by the provider or not accessible with its credentials
+var ErrZoneNotFound = errors.New("zone not found")
+
+// ErrRecordNotFound is returned when a record to change no longer exists
+var ErrRecordNotFound = errors.New("record not found")
+
+// Zone is a DNS zone hosted by a provider
+type Zone struct {
+	ID   string // identifier of the zone at the provider, the zone name if the provider has none
+	Name string // zone name, e.g. example.com
+}
+
+// Record is a DNS record independent of the provider hosting it. Settings the provider does not
+// support are ignored when writing and left empty when reading.
+type Record struct {
+	ID      string   // identifier of the record at the provider
+	Type    string   // record type, e.g. A, AAAA or TXT
+	Name    string   // fully qualified name of the record
+	Content string   // address or text of the record
+	Proxied *bool    // whether the record is proxied (Cloudflare only), nil = unknown
+	TTL     int      // TTL in seconds (1 = automatic on Cloudflare)
+	Comment string   // record comment
+	Tags    []string // record tags
+}
+
+// Provider manages the records of the zones hosted by a DNS provider
+type Provider interface {
+	// Zones lists the zones accessible to the provider, used to resolve zones configured by name
+	Zones(ctx context.Context) ([]Zone, error)
+	// ValidateZone checks that the zone is accessible, ErrZoneNotFound if it is not
+	ValidateZone(ctx context.Context, zone Zone) error
+	// ListRecords lists every record of the zone
+	ListRecords(ctx context.Context, zone Zone) ([]Record, error)
+	// CreateRecord creates a record and returns it with its identifier
+	CreateRecord(ctx context.Context, zone Zone, record Record) (Record, error)
+	// UpdateRecord replaces the content and settings of the record with the same identifier
+	UpdateRecord(ctx context.Context, zone Zone, record Record) (Record, error)
+	// DeleteRecord deletes the record with the same identifier
+	DeleteRecord(ctx context.Context, zone Zone, record Record) error
+}
@@ -0,0 +1,272 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/goodieshq/cfdns/pkg/config"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+const (
+	ERROR_CLASS_RATE_LIMIT = "rate_limit" // the API asked to slow down (HTTP 429)
+	ERROR_CLASS_AUTH       = "auth"       // the token is invalid or lacks permissions (HTTP 401/403)
+	ERROR_CLASS_VALIDATION = "validation" // the request was rejected (HTTP 400/404/409...)
+	ERROR_CLASS_SERVER     = "server"     // the API failed (HTTP 5xx)
+	ERROR_CLASS_NETWORK    = "network"    // the API could not be reached or timed out
+	ERROR_CLASS_CANCELED   = "canceled"   // the cycle was canceled
+	ERROR_CLASS_UNKNOWN    = "unknown"    // anything else
+)
+
+// attemptKey is the context key of the attempt a request belongs to
+type attemptKey struct{}
+
+// attempt records what the transport saw of the last response of an API call
+type attempt struct {
+	mu         sync.Mutex
+	status     int           // HTTP status of the last response, 0 if none was received
+	retryAfter time.Duration // delay requested by the Retry-After header, 0 if none
+}
+
+// apiTransport is shared by all Cloudflare API clients. It records the status and Retry-After header
+// of responses for the retry layer, which waits for its token bucket and pause before each attempt,
+// outside the timeout of the HTTP client.
+type apiTransport struct {
+	base    http.RoundTripper
+	limiter *rate.Limiter
+
+	mu          sync.Mutex
+	pausedUntil time.Time // no attempt is started before this time
+}
+
+// NewAPITransport wraps a transport with a rate limit in requests per second, shared by every API
+// client using it
+func NewAPITransport(base http.RoundTripper, rps float64) *apiTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	burst := max(1, int(rps))
+	return &apiTransport{base: base, limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+}
+
+// RoundTrip sends the request and records the status and Retry-After header of the response
+func (t *apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if a, ok := req.Context().Value(attemptKey{}).(*attempt); ok {
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+		a.mu.Lock()
+		a.status = resp.StatusCode
+		a.retryAfter = retryAfter
+		a.mu.Unlock()
+
+		// a rate limited request holds back every worker, not only the one retrying
+		if resp.StatusCode == http.StatusTooManyRequests && retryAfter > 0 {
+			t.pause(retryAfter)
+		}
+	}
+
+	return resp, nil
+}
+
+// wait blocks until the API is no longer paused and the shared limiter grants a request
+func (t *apiTransport) wait(ctx context.Context) error {
+	t.mu.Lock()
+	wait := time.Until(t.pausedUntil)
+	t.mu.Unlock()
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return t.limiter.Wait(ctx)
+}
+
+// pause holds back all requests for the duration
+func (t *apiTransport) pause(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until := time.Now().Add(d); until.After(t.pausedUntil) {
+		t.pausedUntil = until
+	}
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date, 0 if absent
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(0, time.Until(date))
+	}
+	return 0
+}
+
+// ClassifyError returns the ERROR_CLASS_* class of an error returned by the Cloudflare API
+func ClassifyError(err error) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Class
+	}
+	return classifyError(err, 0)
+}
+
+// classifyError classifies an API error, using the HTTP status seen by the transport for the errors
+// the client does not type itself
+func classifyError(err error, status int) string {
+	var (
+		rateLimitErr *cloudflare.RatelimitError
+		serviceErr   *cloudflare.ServiceError
+		authnErr     *cloudflare.AuthenticationError
+		authzErr     *cloudflare.AuthorizationError
+		notFoundErr  *cloudflare.NotFoundError
+		requestErr   *cloudflare.RequestError
+		netErr       net.Error
+	)
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ERROR_CLASS_CANCELED
+	case errors.As(err, &rateLimitErr) || status == http.StatusTooManyRequests:
+		return ERROR_CLASS_RATE_LIMIT
+	case errors.As(err, &serviceErr) || status >= http.StatusInternalServerError:
+		return ERROR_CLASS_SERVER
+	case errors.As(err, &authnErr) || errors.As(err, &authzErr) ||
+		status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ERROR_CLASS_AUTH
+	case errors.As(err, &notFoundErr) || errors.As(err, &requestErr) || status >= http.StatusBadRequest:
+		return ERROR_CLASS_VALIDATION
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr):
+		return ERROR_CLASS_NETWORK
+	default:
+		return ERROR_CLASS_UNKNOWN
+	}
+}
+
+// retryable reports whether a call failing with an error of the class may succeed when repeated
+func retryable(class string) bool {
+	switch class {
+	case ERROR_CLASS_RATE_LIMIT, ERROR_CLASS_SERVER, ERROR_CLASS_NETWORK:
+		return true
+	default:
+		return false
+	}
+}
+
+// retrier repeats failed Cloudflare API calls with jittered exponential backoff
+type retrier struct {
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	transport *apiTransport // shared rate limit of the attempts, nil = unlimited
+}
+
+// newRetrier creates the configured retry policy, rate limited by the shared transport
+func newRetrier(cfg config.Retry, transport *apiTransport) *retrier {
+	return &retrier{
+		attempts:  cfg.Attempts,
+		baseDelay: cfg.BaseDelay,
+		maxDelay:  cfg.MaxDelay,
+		transport: transport,
+	}
+}
+
+// wait blocks until the shared transport lets the next attempt through
+func (r *retrier) wait(ctx context.Context) error {
+	if r.transport == nil {
+		return nil
+	}
+	return r.transport.wait(ctx)
+}
+
+// backoff returns the delay before a retry, with full jitter to spread the retries of all workers
+func (r *retrier) backoff(retry int) time.Duration {
+	delay := time.Duration(float64(r.baseDelay) * math.Pow(2, float64(retry)))
+	if delay <= 0 || delay > r.maxDelay {
+		delay = r.maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// withRetry calls an API function until it succeeds, fails with an error which is not retryable, or
+// runs out of attempts. A Retry-After header sent by the API takes precedence over the backoff.
+// Each attempt first waits for the shared rate limit, then every request of it is bounded by the
+// timeout of the HTTP client.
+func withRetry[T any](ctx context.Context, r *retrier, call string, fn func(ctx context.Context) (T, error)) (T, error) {
+	var result T
+	var err error
+
+	for i := 0; i < r.attempts; i++ {
+		if err := r.wait(ctx); err != nil {
+			return result, &APIError{Call: call, Class: ERROR_CLASS_CANCELED, Err: err}
+		}
+
+		a := &attempt{}
+		result, err = fn(context.WithValue(ctx, attemptKey{}, a))
+		if err == nil {
+			return result, nil
+		}
+
+		a.mu.Lock()
+		status, retryAfter := a.status, a.retryAfter
+		a.mu.Unlock()
+
+		class := classifyError(err, status)
+		if !retryable(class) || i == r.attempts-1 || ctx.Err() != nil {
+			return result, &APIError{Call: call, Class: class, Err: err}
+		}
+
+		delay := r.backoff(i)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+
+		log.Warn().Err(err).
+			Str("call", call).
+			Str("class", class).
+			Int("attempt", i+1).
+			Str("delay", delay.String()).
+			Msg("Cloudflare API call failed, retrying")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return result, &APIError{Call: call, Class: ERROR_CLASS_CANCELED, Err: ctx.Err()}
+		}
+	}
+
+	return result, err
+}
+
+// APIError is a failed Cloudflare API call together with the class of its error
+type APIError struct {
+	Call  string // name of the API call
+	Class string // one of the ERROR_CLASS_* classes
+	Err   error
+}
+
+func (e *APIError) Error() string {
+	return e.Call + " (" + e.Class + "): " + e.Err.Error()
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,189 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/goodieshq/cfdns/pkg/config"
+)
+
+func TestClassifyError(t *testing.T) {
+	failed := errors.New("failed")
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		want   string
+	}{
+		{"canceled", fmt.Errorf("list: %w", context.Canceled), 0, ERROR_CLASS_CANCELED},
+		{"rate limit error", &cloudflare.RatelimitError{}, 0, ERROR_CLASS_RATE_LIMIT},
+		{"rate limit status", failed, http.StatusTooManyRequests, ERROR_CLASS_RATE_LIMIT},
+		{"service error", &cloudflare.ServiceError{}, 0, ERROR_CLASS_SERVER},
+		{"server status", failed, http.StatusBadGateway, ERROR_CLASS_SERVER},
+		{"authentication error", &cloudflare.AuthenticationError{}, 0, ERROR_CLASS_AUTH},
+		{"authorization error", &cloudflare.AuthorizationError{}, 0, ERROR_CLASS_AUTH},
+		{"forbidden status", failed, http.StatusForbidden, ERROR_CLASS_AUTH},
+		{"not found error", &cloudflare.NotFoundError{}, 0, ERROR_CLASS_VALIDATION},
+		{"request error", &cloudflare.RequestError{}, 0, ERROR_CLASS_VALIDATION},
+		{"conflict status", failed, http.StatusConflict, ERROR_CLASS_VALIDATION},
+		{"deadline exceeded", context.DeadlineExceeded, 0, ERROR_CLASS_NETWORK},
+		{"network error", &net.OpError{Op: "dial", Err: failed}, 0, ERROR_CLASS_NETWORK},
+		{"other error", failed, 0, ERROR_CLASS_UNKNOWN},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.err, tt.status); got != tt.want {
+			t.Errorf("classifyError() of %s = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// errors of the retry layer keep the class they were given
+	if got := ClassifyError(&APIError{Call: "list", Class: ERROR_CLASS_AUTH, Err: failed}); got != ERROR_CLASS_AUTH {
+		t.Errorf("ClassifyError() = %s, want %s", got, ERROR_CLASS_AUTH)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("30"); got != 30*time.Second {
+		t.Errorf("parseRetryAfter(30) = %v, want 30s", got)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got <= 50*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter(%s) = %v, want about 1m", date, got)
+	}
+	for _, value := range []string{"", "0", "-5", "soon", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)} {
+		if got := parseRetryAfter(value); got != 0 {
+			t.Errorf("parseRetryAfter(%q) = %v, want 0", value, got)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	r := newRetrier(config.Retry{Attempts: 5, BaseDelay: time.Second, MaxDelay: 10 * time.Second}, nil)
+	for retry, limit := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		for range 100 {
+			if got := r.backoff(retry); got < 0 || got > limit {
+				t.Fatalf("backoff(%d) = %v, want 0 to %v", retry, got, limit)
+			}
+		}
+	}
+
+	// the delay doubling past the range of time.Duration is capped as well
+	if got := r.backoff(100); got < 0 || got > r.maxDelay {
+		t.Errorf("backoff(100) = %v, want 0 to %v", got, r.maxDelay)
+	}
+}
+
+// newRetryServer starts a server answering with the statuses in order, then 200, and counts requests.
+// Rate limited answers ask to retry after one second.
+func newRetryServer(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+		if n > len(statuses) {
+			return
+		}
+		if statuses[n-1] == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		w.WriteHeader(statuses[n-1])
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+// get returns an API call requesting the URL with the client, failing on any status but 200
+func get(client *http.Client, url string) func(ctx context.Context) (int, error) {
+	return func(ctx context.Context) (int, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return 0, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return resp.StatusCode, nil
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	cfg := config.Retry{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+	srv, requests := newRetryServer(t, http.StatusInternalServerError, http.StatusBadGateway)
+	transport := NewAPITransport(nil, 100)
+	client := &http.Client{Transport: transport}
+	if _, err := withRetry(context.Background(), newRetrier(cfg, transport), "get", get(client, srv.URL)); err != nil {
+		t.Errorf("withRetry() = %v, want nil", err)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("withRetry() sent %d requests, want 3", got)
+	}
+
+	// validation errors are not retried
+	srv, requests = newRetryServer(t, http.StatusBadRequest)
+	_, err := withRetry(context.Background(), newRetrier(cfg, transport), "get", get(client, srv.URL))
+	if got := ClassifyError(err); got != ERROR_CLASS_VALIDATION {
+		t.Errorf("withRetry() error class = %s, want %s", got, ERROR_CLASS_VALIDATION)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("withRetry() sent %d requests, want 1", got)
+	}
+
+	// calls giving up keep the last error
+	srv, _ = newRetryServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	_, err = withRetry(context.Background(), newRetrier(cfg, transport), "get", get(client, srv.URL))
+	if got := ClassifyError(err); got != ERROR_CLASS_SERVER {
+		t.Errorf("withRetry() error class = %s, want %s", got, ERROR_CLASS_SERVER)
+	}
+}
+
+func TestWithRetryAfter(t *testing.T) {
+	cfg := config.Retry{Attempts: 2, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	srv, requests := newRetryServer(t, http.StatusTooManyRequests, http.StatusTooManyRequests)
+	transport := NewAPITransport(nil, 100)
+
+	// the Retry-After header takes precedence over the shorter backoff
+	started := time.Now()
+	_, err := withRetry(context.Background(), newRetrier(cfg, transport), "get", get(&http.Client{Transport: transport}, srv.URL))
+	if got := ClassifyError(err); got != ERROR_CLASS_RATE_LIMIT {
+		t.Errorf("withRetry() error class = %s, want %s", got, ERROR_CLASS_RATE_LIMIT)
+	}
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Errorf("withRetry() retried after %v, want at least 1s", elapsed)
+	}
+
+	// other calls wait for the pause before they start, outside of the shorter client timeout
+	started = time.Now()
+	client := &http.Client{Transport: transport, Timeout: 200 * time.Millisecond}
+	if _, err := withRetry(context.Background(), newRetrier(cfg, transport), "get", get(client, srv.URL)); err != nil {
+		t.Errorf("withRetry() = %v, want nil", err)
+	}
+	if elapsed := time.Since(started); elapsed < 500*time.Millisecond {
+		t.Errorf("withRetry() started after %v, want the rest of the 1s pause", elapsed)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("withRetry() sent %d requests, want 3", got)
+	}
+
+	// a canceled call does not wait for the pause
+	transport.pause(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = withRetry(ctx, newRetrier(cfg, transport), "get", get(client, srv.URL))
+	if got := ClassifyError(err); got != ERROR_CLASS_CANCELED {
+		t.Errorf("withRetry() error class = %s, want %s", got, ERROR_CLASS_CANCELED)
+	}
+}
@@ -0,0 +1,459 @@
+package provider
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/goodieshq/cfdns/pkg/config"
+	"github.com/goodieshq/cfdns/pkg/ipget"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	RFC2136_DEFAULT_TTL = 300 // TTL of records written without one, RFC 2136 servers have no automatic TTL
+	RFC2136_OPCODE      = 5   // opcode of dynamic update messages
+	RFC2136_CLASS_NONE  = 254 // class of the records deleted by an update
+	RFC2136_TXT_CHUNK   = 255 // maximum length of a TXT character string
+)
+
+// RFC2136 manages the records of a zone on an authoritative server accepting dynamic updates
+// (RFC 2136), e.g. BIND, Knot or PowerDNS. Records are listed with a zone transfer, so the server
+// must allow transfers to the TSIG key (or the address) of cfdns. Updates and transfers are sent
+// over TCP and signed when a TSIG key is configured.
+type RFC2136 struct {
+	zone    Zone            // the only zone of the provider
+	origin  dnsmessage.Name // name of the zone in requests
+	server  string          // address of the server as host:port
+	key     *tsigKey        // key signing the requests, nil = unsigned
+	binding *ipget.Binding  // source interface/address of the connections
+	timeout time.Duration   // timeout of a request
+}
+
+// NewRFC2136 creates a provider for a zone hosted on an authoritative server
+func NewRFC2136(zoneName string, cfg config.RFC2136, binding *ipget.Binding, timeout time.Duration) (*RFC2136, error) {
+	key, err := newTSIGKey(cfg.TSIG)
+	if err != nil {
+		return nil, err
+	}
+	zoneName = strings.ToLower(strings.TrimSuffix(zoneName, "."))
+	origin, err := dnsmessage.NewName(fqdn(zoneName))
+	if err != nil {
+		return nil, fmt.Errorf("invalid zone name %q: %w", zoneName, err)
+	}
+	return &RFC2136{
+		zone:    Zone{ID: zoneName, Name: zoneName},
+		origin:  origin,
+		server:  cfg.Server,
+		key:     key,
+		binding: binding,
+		timeout: timeout,
+	}, nil
+}
+
+// Zones returns the zone of the provider, the server is not queried
+func (p *RFC2136) Zones(ctx context.Context) ([]Zone, error) {
+	return []Zone{p.zone}, nil
+}
+
+// ValidateZone checks that the server is authoritative for the zone
+func (p *RFC2136) ValidateZone(ctx context.Context, zone Zone) error {
+	if zone.ID != p.zone.ID {
+		return fmt.Errorf("zone %s: %w", zone.Name, ErrZoneNotFound)
+	}
+
+	msg, err := p.exchange(ctx, dnsmessage.Header{}, dnsmessage.Question{
+		Name:  p.origin,
+		Type:  dnsmessage.TypeSOA,
+		Class: dnsmessage.ClassINET,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil {
+		return fmt.Errorf("invalid response from %s: %w", p.server, err)
+	}
+	if header.RCode != dnsmessage.RCodeSuccess || !header.Authoritative {
+		return fmt.Errorf("zone %s: server %s is not authoritative (%s): %w", zone.Name, p.server, rcodeName(header.RCode), ErrZoneNotFound)
+	}
+	return nil
+}
+
+// ListRecords transfers the zone and returns its A, AAAA and TXT records
+func (p *RFC2136) ListRecords(ctx context.Context, zone Zone) ([]Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	request, mac, err := p.message(dnsmessage.Header{}, dnsmessage.Question{
+		Name:  p.origin,
+		Type:  dnsmessage.TypeAXFR,
+		Class: dnsmessage.ClassINET,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := writeMessage(conn, request); err != nil {
+		return nil, fmt.Errorf("could not send zone transfer request to %s: %w", p.server, err)
+	}
+
+	var verifier *tsigVerifier
+	if p.key != nil {
+		verifier = p.key.verifier(mac)
+	}
+
+	// the transfer starts and ends with the SOA record of the zone
+	var records []Record
+	soas := 0
+	for soas < 2 {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return nil, fmt.Errorf("zone transfer from %s failed: %w", p.server, err)
+		}
+		if verifier != nil {
+			if err := verifier.verify(msg, time.Now()); err != nil {
+				return nil, fmt.Errorf("zone transfer from %s: %w", p.server, err)
+			}
+		}
+
+		var parser dnsmessage.Parser
+		header, err := parser.Start(msg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zone transfer response from %s: %w", p.server, err)
+		}
+		if header.RCode != dnsmessage.RCodeSuccess {
+			return nil, fmt.Errorf("zone transfer of %s refused by %s: %s", zone.Name, p.server, rcodeName(header.RCode))
+		}
+		if err := parser.SkipAllQuestions(); err != nil {
+			return nil, fmt.Errorf("invalid zone transfer response from %s: %w", p.server, err)
+		}
+
+		for soas < 2 {
+			rr, err := parser.AnswerHeader()
+			if errors.Is(err, dnsmessage.ErrSectionDone) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid zone transfer response from %s: %w", p.server, err)
+			}
+
+			record, ok, err := parseRecord(&parser, rr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid zone transfer response from %s: %w", p.server, err)
+			}
+			if rr.Type == dnsmessage.TypeSOA {
+				soas++
+			}
+			if ok {
+				records = append(records, record)
+			}
+		}
+	}
+
+	if verifier != nil {
+		if err := verifier.done(); err != nil {
+			return nil, fmt.Errorf("zone transfer from %s: %w", p.server, err)
+		}
+	}
+	return records, nil
+}
+
+// CreateRecord adds a record to the zone
+func (p *RFC2136) CreateRecord(ctx context.Context, zone Zone, record Record) (Record, error) {
+	record.Name = strings.ToLower(record.Name)
+	if record.TTL <= config.TTL_AUTOMATIC {
+		record.TTL = RFC2136_DEFAULT_TTL
+	}
+	if err := p.update(ctx, zone, nil, []Record{record}); err != nil {
+		return record, err
+	}
+	record.ID = recordID(record)
+	return record, nil
+}
+
+// UpdateRecord replaces a record of the zone in a single update, deleting the old content and adding
+// the new one
+func (p *RFC2136) UpdateRecord(ctx context.Context, zone Zone, record Record) (Record, error) {
+	old, err := parseRecordID(record.ID)
+	if err != nil {
+		return record, err
+	}
+
+	record.Name = strings.ToLower(record.Name)
+	if record.TTL <= config.TTL_AUTOMATIC {
+		record.TTL = RFC2136_DEFAULT_TTL
+	}
+	if err := p.update(ctx, zone, []Record{old}, []Record{record}); err != nil {
+		return record, err
+	}
+	record.ID = recordID(record)
+	return record, nil
+}
+
+// DeleteRecord deletes a record from the zone, other records of the same name and type are kept
+func (p *RFC2136) DeleteRecord(ctx context.Context, zone Zone, record Record) error {
+	old, err := parseRecordID(record.ID)
+	if err != nil {
+		return err
+	}
+	return p.update(ctx, zone, []Record{old}, nil)
+}
+
+// update sends a dynamic update deleting and adding records
+func (p *RFC2136) update(ctx context.Context, zone Zone, deletes, adds []Record) error {
+	msg, err := p.exchange(ctx, dnsmessage.Header{OpCode: RFC2136_OPCODE}, dnsmessage.Question{
+		Name:  p.origin,
+		Type:  dnsmessage.TypeSOA,
+		Class: dnsmessage.ClassINET,
+	}, func(b *dnsmessage.Builder) error {
+		if err := b.StartAuthorities(); err != nil {
+			return err
+		}
+		for _, record := range deletes {
+			if err := addRecord(b, record, RFC2136_CLASS_NONE, 0); err != nil {
+				return err
+			}
+		}
+		for _, record := range adds {
+			if err := addRecord(b, record, dnsmessage.ClassINET, uint32(record.TTL)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil {
+		return fmt.Errorf("invalid update response from %s: %w", p.server, err)
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("update of zone %s refused by %s: %s", zone.Name, p.server, rcodeName(header.RCode))
+	}
+	return nil
+}
+
+// exchange sends a single request over TCP and returns the verified response
+func (p *RFC2136) exchange(ctx context.Context, header dnsmessage.Header, question dnsmessage.Question, build func(*dnsmessage.Builder) error) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	request, mac, err := p.message(header, question, build)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := writeMessage(conn, request); err != nil {
+		return nil, fmt.Errorf("could not send request to %s: %w", p.server, err)
+	}
+	msg, err := readMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("could not read response from %s: %w", p.server, err)
+	}
+	if binary.BigEndian.Uint16(msg) != binary.BigEndian.Uint16(request) {
+		return nil, fmt.Errorf("response from %s does not match the request", p.server)
+	}
+
+	if p.key != nil {
+		if err := p.key.verifier(mac).verify(msg, time.Now()); err != nil {
+			return nil, fmt.Errorf("response from %s: %w", p.server, err)
+		}
+	}
+	return msg, nil
+}
+
+// message builds a request with a random ID and signs it if a key is configured, returning the
+// request and its MAC
+func (p *RFC2136) message(header dnsmessage.Header, question dnsmessage.Question, build func(*dnsmessage.Builder) error) ([]byte, []byte, error) {
+	header.ID = uint16(rand.Intn(1 << 16))
+	b := dnsmessage.NewBuilder(nil, header)
+	if err := b.StartQuestions(); err != nil {
+		return nil, nil, err
+	}
+	if err := b.Question(question); err != nil {
+		return nil, nil, err
+	}
+	if build != nil {
+		if err := build(&b); err != nil {
+			return nil, nil, err
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if p.key == nil {
+		return msg, nil, nil
+	}
+	msg, mac := p.key.sign(msg, time.Now())
+	return msg, mac, nil
+}
+
+// dial connects to the server over TCP honoring the binding
+func (p *RFC2136) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := p.binding.DialContext(ctx, "tcp", p.server)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %w", p.server, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// writeMessage writes a DNS message prefixed with its length, as sent over TCP
+func writeMessage(conn net.Conn, msg []byte) error {
+	_, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+// readMessage reads a DNS message prefixed with its length, as sent over TCP
+func readMessage(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	if len(msg) < 12 {
+		return nil, errors.New("DNS message too short")
+	}
+	return msg, nil
+}
+
+// addRecord adds a record to the update section of a message
+func addRecord(b *dnsmessage.Builder, record Record, class dnsmessage.Class, ttl uint32) error {
+	name, err := dnsmessage.NewName(fqdn(record.Name))
+	if err != nil {
+		return fmt.Errorf("invalid record name %q: %w", record.Name, err)
+	}
+
+	switch record.Type {
+	case "A":
+		ip := net.ParseIP(record.Content).To4()
+		if ip == nil {
+			return fmt.Errorf("invalid IPv4 address %q", record.Content)
+		}
+		header := dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: class, TTL: ttl}
+		return b.AResource(header, dnsmessage.AResource{A: [4]byte(ip)})
+	case "AAAA":
+		ip := net.ParseIP(record.Content)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid IPv6 address %q", record.Content)
+		}
+		header := dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeAAAA, Class: class, TTL: ttl}
+		return b.AAAAResource(header, dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())})
+	case "TXT":
+		header := dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeTXT, Class: class, TTL: ttl}
+		return b.TXTResource(header, dnsmessage.TXTResource{TXT: splitTXT(record.Content)})
+	default:
+		return fmt.Errorf("unsupported record type %s", record.Type)
+	}
+}
+
+// parseRecord parses the A, AAAA or TXT record following a resource header, other records are
+// skipped and reported as not ok
+func parseRecord(parser *dnsmessage.Parser, rr dnsmessage.ResourceHeader) (Record, bool, error) {
+	record := Record{
+		Name: strings.ToLower(strings.TrimSuffix(rr.Name.String(), ".")),
+		TTL:  int(rr.TTL),
+	}
+
+	switch {
+	case rr.Class != dnsmessage.ClassINET:
+		return record, false, parser.SkipAnswer()
+	case rr.Type == dnsmessage.TypeA:
+		a, err := parser.AResource()
+		if err != nil {
+			return record, false, err
+		}
+		record.Type, record.Content = "A", net.IP(a.A[:]).String()
+	case rr.Type == dnsmessage.TypeAAAA:
+		aaaa, err := parser.AAAAResource()
+		if err != nil {
+			return record, false, err
+		}
+		record.Type, record.Content = "AAAA", net.IP(aaaa.AAAA[:]).String()
+	case rr.Type == dnsmessage.TypeTXT:
+		txt, err := parser.TXTResource()
+		if err != nil {
+			return record, false, err
+		}
+		record.Type, record.Content = "TXT", strings.Join(txt.TXT, "")
+	default:
+		return record, false, parser.SkipAnswer()
+	}
+
+	record.ID = recordID(record)
+	return record, true, nil
+}
+
+// recordID returns the identifier of a record. Records have no identifier on an RFC 2136 server,
+// so the name, type and content identifying the record to delete are kept in it.
+func recordID(record Record) string {
+	return record.Name + "/" + record.Type + "/" + record.Content
+}
+
+// parseRecordID returns the record identified by an identifier created by recordID
+func parseRecordID(id string) (Record, error) {
+	parts := strings.SplitN(id, "/", 3)
+	if len(parts) != 3 {
+		return Record{}, fmt.Errorf("record %s: %w", id, ErrRecordNotFound)
+	}
+	return Record{ID: id, Name: parts[0], Type: parts[1], Content: parts[2]}, nil
+}
+
+// splitTXT splits a TXT content into character strings of at most 255 bytes
+func splitTXT(content string) []string {
+	var chunks []string
+	for len(content) > RFC2136_TXT_CHUNK {
+		chunks = append(chunks, content[:RFC2136_TXT_CHUNK])
+		content = content[RFC2136_TXT_CHUNK:]
+	}
+	return append(chunks, content)
+}
+
+// rcodeName returns the name of a response code, including the codes of dynamic updates
+func rcodeName(rcode dnsmessage.RCode) string {
+	switch rcode {
+	case 6:
+		return "YXDOMAIN"
+	case 7:
+		return "YXRRSET"
+	case 8:
+		return "NXRRSET"
+	case 9:
+		return "NOTAUTH"
+	case 10:
+		return "NOTZONE"
+	default:
+		return rcode.String()
+	}
+}
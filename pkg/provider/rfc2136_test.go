@@ -0,0 +1,379 @@
+package provider
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goodieshq/cfdns/pkg/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testOrigin is the zone served by the fake DNS server
+var testOrigin = dnsmessage.MustNewName("example.com.")
+
+// buildMessage returns a response answering with the given records
+func buildMessage(t *testing.T, id uint16, answers ...Record) []byte {
+	t.Helper()
+	return buildResponse(t, dnsmessage.Header{ID: id, Response: true}, func(b *dnsmessage.Builder) error {
+		for _, record := range answers {
+			if err := addRecord(b, record, dnsmessage.ClassINET, 300); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// buildResponse returns a response to a question for the test zone, build adds its answers
+func buildResponse(t *testing.T, header dnsmessage.Header, build func(*dnsmessage.Builder) error) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, header)
+	if err := b.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Question(dnsmessage.Question{Name: testOrigin, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StartAnswers(); err != nil {
+		t.Fatal(err)
+	}
+	if build != nil {
+		if err := build(&b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// soaAnswer adds the SOA record of the test zone
+func soaAnswer(b *dnsmessage.Builder) error {
+	return b.SOAResource(
+		dnsmessage.ResourceHeader{Name: testOrigin, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+		dnsmessage.SOAResource{
+			NS:      dnsmessage.MustNewName("ns.example.com."),
+			MBox:    dnsmessage.MustNewName("hostmaster.example.com."),
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			MinTTL:  300,
+		},
+	)
+}
+
+// fakeDNSServer is an authoritative server of example.com answering SOA queries, zone transfers and
+// dynamic updates over TCP, one request per connection
+type fakeDNSServer struct {
+	t        *testing.T
+	listener net.Listener
+	key      *tsigKey // key of the requests and responses, nil = unsigned
+	mu       sync.Mutex
+	records  []Record // A, AAAA and TXT records of the zone
+}
+
+// startFakeDNSServer serves the records until the test ends
+func startFakeDNSServer(t *testing.T, key *tsigKey, records ...Record) *fakeDNSServer {
+	t.Helper()
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &fakeDNSServer{t: t, listener: listener, key: key, records: records}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+// zone returns the sorted identifiers of the records of the zone
+func (s *fakeDNSServer) zone() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return recordIDs(s.records)
+}
+
+func (s *fakeDNSServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	msg, err := readMessage(conn)
+	if err != nil {
+		return
+	}
+	requestMAC, err := s.verifyRequest(msg)
+	if err != nil {
+		s.t.Errorf("fake DNS server: %v", err)
+		return
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil {
+		s.t.Errorf("fake DNS server: %v", err)
+		return
+	}
+	question, err := parser.Question()
+	if err != nil {
+		s.t.Errorf("fake DNS server: %v", err)
+		return
+	}
+	response := dnsmessage.Header{ID: header.ID, Response: true, OpCode: header.OpCode, Authoritative: true}
+
+	switch {
+	case header.OpCode == RFC2136_OPCODE:
+		if err := s.update(&parser); err != nil {
+			s.t.Errorf("fake DNS server: %v", err)
+			response.RCode = dnsmessage.RCodeFormatError
+		}
+		s.write(conn, buildResponse(s.t, response, nil), requestMAC, nil, true)
+
+	case question.Type == dnsmessage.TypeAXFR:
+		s.transfer(conn, response, requestMAC)
+
+	case question.Type == dnsmessage.TypeSOA:
+		s.write(conn, buildResponse(s.t, response, soaAnswer), requestMAC, nil, true)
+	}
+}
+
+// transfer sends the zone in three messages: the opening SOA with the first record, the remaining
+// records and the closing SOA. The middle message is not signed.
+func (s *fakeDNSServer) transfer(conn net.Conn, header dnsmessage.Header, requestMAC []byte) {
+	s.mu.Lock()
+	records := slices.Clone(s.records)
+	s.mu.Unlock()
+
+	split := min(1, len(records))
+	first := buildResponse(s.t, header, func(b *dnsmessage.Builder) error {
+		if err := soaAnswer(b); err != nil {
+			return err
+		}
+		for _, record := range records[:split] {
+			if err := addRecord(b, record, dnsmessage.ClassINET, uint32(record.TTL)); err != nil {
+				return err
+			}
+		}
+		// records of other types are skipped by the client
+		return b.MXResource(
+			dnsmessage.ResourceHeader{Name: testOrigin, Type: dnsmessage.TypeMX, Class: dnsmessage.ClassINET, TTL: 3600},
+			dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mail.example.com.")},
+		)
+	})
+	middle := buildResponse(s.t, header, func(b *dnsmessage.Builder) error {
+		for _, record := range records[split:] {
+			if err := addRecord(b, record, dnsmessage.ClassINET, uint32(record.TTL)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	last := buildResponse(s.t, header, soaAnswer)
+
+	mac := s.write(conn, first, requestMAC, nil, true)
+	writeMessage(conn, middle)
+	s.write(conn, last, mac, middle, false)
+}
+
+// write sends a response, signed if the server has a key, and returns its MAC
+func (s *fakeDNSServer) write(conn net.Conn, msg, prevMAC, unsigned []byte, first bool) []byte {
+	var mac []byte
+	if s.key != nil {
+		msg, mac = signResponse(s.key, msg, prevMAC, unsigned, first, time.Now())
+	}
+	writeMessage(conn, msg)
+	return mac
+}
+
+// verifyRequest checks the TSIG record of a request as described in RFC 8945 and returns its MAC.
+// Requests to a server without key are not checked.
+func (s *fakeDNSServer) verifyRequest(msg []byte) ([]byte, error) {
+	if s.key == nil {
+		return nil, nil
+	}
+
+	offset, rec, err := findTSIG(msg)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return nil, errors.New("request is not signed")
+	}
+
+	stripped := slices.Clone(msg[:offset])
+	binary.BigEndian.PutUint16(stripped[10:], binary.BigEndian.Uint16(stripped[10:])-1)
+	mac := hmac.New(s.key.hash, s.key.secret)
+	mac.Write(stripped)
+	mac.Write(rec.variables())
+	if !hmac.Equal(mac.Sum(nil), rec.mac) {
+		return nil, errors.New("request TSIG signature does not verify")
+	}
+	return rec.mac, nil
+}
+
+// update applies the deletions and additions of the update section of a dynamic update
+func (s *fakeDNSServer) update(parser *dnsmessage.Parser) error {
+	if err := parser.SkipAllQuestions(); err != nil {
+		return err
+	}
+	if err := parser.SkipAllAnswers(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		rr, err := parser.AuthorityHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// deletions carry class NONE, their content is parsed like the one of additions
+		class := rr.Class
+		rr.Class = dnsmessage.ClassINET
+		record, ok, err := parseRecord(parser, rr)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("unsupported record in update")
+		}
+
+		if class == RFC2136_CLASS_NONE {
+			s.records = slices.DeleteFunc(s.records, func(r Record) bool { return recordID(r) == record.ID })
+		} else {
+			s.records = append(s.records, record)
+		}
+	}
+}
+
+// recordIDs returns the sorted identifiers of records
+func recordIDs(records []Record) []string {
+	ids := make([]string, len(records))
+	for i, record := range records {
+		ids[i] = recordID(record)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestRFC2136RoundTrip(t *testing.T) {
+	for _, signed := range []bool{false, true} {
+		name := "unsigned"
+		if signed {
+			name = "signed"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			cfg := config.RFC2136{}
+			var key *tsigKey
+			if signed {
+				key = testTSIGKey(t)
+				cfg.TSIG = config.TSIG{Name: "cfdns-key", Algorithm: config.TSIG_HMAC_SHA256, Secret: testTSIGSecret}
+			}
+
+			server := startFakeDNSServer(t, key,
+				Record{Type: "A", Name: "host.example.com", Content: "192.0.2.1", TTL: 300},
+				Record{Type: "AAAA", Name: "host.example.com", Content: "2001:db8::1", TTL: 300},
+				Record{Type: "TXT", Name: "_cfdns-a.host.example.com", Content: "heritage=cfdns,owner=test", TTL: 300},
+			)
+			cfg.Server = server.listener.Addr().String()
+
+			p, err := NewRFC2136("example.com", cfg, nil, 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			zone := Zone{ID: "example.com", Name: "example.com"}
+
+			if err := p.ValidateZone(ctx, zone); err != nil {
+				t.Fatalf("ValidateZone() = %v", err)
+			}
+
+			records, err := p.ListRecords(ctx, zone)
+			if err != nil {
+				t.Fatalf("ListRecords() error = %v", err)
+			}
+			if got, want := recordIDs(records), server.zone(); !slices.Equal(got, want) {
+				t.Fatalf("ListRecords() = %v, want %v", got, want)
+			}
+
+			// a long TXT content is split into several character strings and joined again
+			long := strings.Repeat("x", 300)
+			if _, err := p.CreateRecord(ctx, zone, Record{Type: "TXT", Name: "Long.example.com", Content: long}); err != nil {
+				t.Fatalf("CreateRecord() error = %v", err)
+			}
+			for _, record := range records {
+				switch record.Type {
+				case "A":
+					record.Content = "192.0.2.2"
+					if _, err := p.UpdateRecord(ctx, zone, record); err != nil {
+						t.Fatalf("UpdateRecord() error = %v", err)
+					}
+				case "TXT":
+					if err := p.DeleteRecord(ctx, zone, record); err != nil {
+						t.Fatalf("DeleteRecord() error = %v", err)
+					}
+				}
+			}
+
+			want := []string{"host.example.com/A/192.0.2.2", "host.example.com/AAAA/2001:db8::1", "long.example.com/TXT/" + long}
+			if got := server.zone(); !slices.Equal(got, want) {
+				t.Errorf("zone = %v, want %v", got, want)
+			}
+			records, err = p.ListRecords(ctx, zone)
+			if err != nil {
+				t.Fatalf("ListRecords() error = %v", err)
+			}
+			if got := recordIDs(records); !slices.Equal(got, want) {
+				t.Errorf("ListRecords() = %v, want %v", got, want)
+			}
+			for _, record := range records {
+				if record.Name == "long.example.com" && record.TTL != RFC2136_DEFAULT_TTL {
+					t.Errorf("created record TTL = %d, want %d", record.TTL, RFC2136_DEFAULT_TTL)
+				}
+			}
+		})
+	}
+}
+
+func TestRFC2136UnsignedResponse(t *testing.T) {
+	// the server does not sign its responses although the requests are signed
+	server := startFakeDNSServer(t, nil, Record{Type: "A", Name: "host.example.com", Content: "192.0.2.1", TTL: 300})
+	p, err := NewRFC2136("example.com", config.RFC2136{
+		Server: server.listener.Addr().String(),
+		TSIG:   config.TSIG{Name: "cfdns-key", Algorithm: config.TSIG_HMAC_SHA256, Secret: testTSIGSecret},
+	}, nil, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone := Zone{ID: "example.com", Name: "example.com"}
+
+	if records, err := p.ListRecords(context.Background(), zone); err == nil {
+		t.Errorf("ListRecords() = %v, want error for an unsigned transfer", records)
+	}
+	if err := p.ValidateZone(context.Background(), zone); err == nil {
+		t.Error("ValidateZone() = nil, want error for an unsigned response")
+	}
+}
@@ -0,0 +1,361 @@
+package provider
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+
+	"github.com/goodieshq/cfdns/pkg/config"
+)
+
+const (
+	TSIG_TYPE     = 250 // resource record type of TSIG records
+	TSIG_CLASS    = 255 // class ANY, used by TSIG records
+	TSIG_FUDGE    = 300 // seconds of clock skew allowed between cfdns and the server
+	TSIG_BADSIG   = 16  // TSIG error: the MAC did not verify
+	TSIG_BADKEY   = 17  // TSIG error: the key is not known to the server
+	TSIG_BADTIME  = 18  // TSIG error: the signing time is outside of the fudge
+	TSIG_BADTRUNC = 22  // TSIG error: the MAC is truncated too much
+)
+
+// tsigKey signs requests and verifies responses with a shared secret (RFC 8945)
+type tsigKey struct {
+	name      string           // key name as a fully qualified domain name
+	algorithm string           // algorithm name as a fully qualified domain name
+	hash      func() hash.Hash // hash function of the HMAC
+	secret    []byte
+}
+
+// tsigRecord is the content of a TSIG record
+type tsigRecord struct {
+	name       string
+	algorithm  string
+	timeSigned uint64
+	fudge      uint16
+	mac        []byte
+	originalID uint16
+	err        uint16
+	other      []byte
+}
+
+// newTSIGKey creates the key of the configuration, nil if updates are not signed
+func newTSIGKey(cfg config.TSIG) (*tsigKey, error) {
+	if cfg.Name == "" {
+		return nil, nil
+	}
+
+	key := &tsigKey{name: fqdn(cfg.Name), algorithm: fqdn(cfg.Algorithm)}
+	switch cfg.Algorithm {
+	case config.TSIG_HMAC_SHA256:
+		key.hash = sha256.New
+	case config.TSIG_HMAC_SHA512:
+		key.hash = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported TSIG algorithm %q", cfg.Algorithm)
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(cfg.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSIG secret: %w", err)
+	}
+	key.secret = secret
+	return key, nil
+}
+
+// sign appends a TSIG record to a message and returns the signed message and its MAC
+func (k *tsigKey) sign(msg []byte, now time.Time) ([]byte, []byte) {
+	t := tsigRecord{
+		name:       k.name,
+		algorithm:  k.algorithm,
+		timeSigned: uint64(now.Unix()),
+		fudge:      TSIG_FUDGE,
+		originalID: binary.BigEndian.Uint16(msg),
+	}
+
+	mac := hmac.New(k.hash, k.secret)
+	mac.Write(msg)
+	mac.Write(t.variables())
+	t.mac = mac.Sum(nil)
+
+	signed := append(append([]byte(nil), msg...), t.pack()...)
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])+1)
+	return signed, t.mac
+}
+
+// verifier returns a verifier of the responses to a request signed with the given MAC
+func (k *tsigKey) verifier(requestMAC []byte) *tsigVerifier {
+	return &tsigVerifier{key: k, prevMAC: requestMAC}
+}
+
+// tsigVerifier checks the TSIG records of the responses to a signed request. Zone transfers may
+// only sign every few messages, each signature then covers the unsigned messages before it.
+type tsigVerifier struct {
+	key      *tsigKey
+	prevMAC  []byte // MAC of the request or of the last signed response
+	unsigned []byte // messages received since the last signed response
+	pending  int    // number of messages received since the last signed response
+	signed   bool   // whether a signed response was received
+}
+
+// verify checks the TSIG record of a response
+func (v *tsigVerifier) verify(msg []byte, now time.Time) error {
+	offset, t, err := findTSIG(msg)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		// RFC 8945 allows up to 99 unsigned messages in a row, the first one must be signed
+		if !v.signed || v.pending >= 99 {
+			return errors.New("response is not signed with TSIG")
+		}
+		v.unsigned = append(v.unsigned, msg...)
+		v.pending++
+		return nil
+	}
+
+	if t.name != v.key.name || t.algorithm != v.key.algorithm {
+		return fmt.Errorf("response is signed with an unexpected TSIG key %s (%s)", t.name, t.algorithm)
+	}
+	if t.err != 0 {
+		return fmt.Errorf("server rejected the TSIG signature: %s", tsigErrorName(t.err))
+	}
+
+	// the MAC covers the response without its TSIG record and with its original ID
+	stripped := append([]byte(nil), msg[:offset]...)
+	binary.BigEndian.PutUint16(stripped, t.originalID)
+	binary.BigEndian.PutUint16(stripped[10:], binary.BigEndian.Uint16(stripped[10:])-1)
+
+	mac := hmac.New(v.key.hash, v.key.secret)
+	mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(v.prevMAC))))
+	mac.Write(v.prevMAC)
+	if v.signed {
+		mac.Write(v.unsigned)
+		mac.Write(stripped)
+		mac.Write(t.timers())
+	} else {
+		mac.Write(stripped)
+		mac.Write(t.variables())
+	}
+	if !hmac.Equal(mac.Sum(nil), t.mac) {
+		return errors.New("response TSIG signature does not verify")
+	}
+
+	signedAt := time.Unix(int64(t.timeSigned), 0)
+	if skew := now.Sub(signedAt).Abs(); skew > time.Duration(t.fudge)*time.Second {
+		return fmt.Errorf("response TSIG signing time is off by %s", skew)
+	}
+
+	v.prevMAC = t.mac
+	v.unsigned = nil
+	v.pending = 0
+	v.signed = true
+	return nil
+}
+
+// done checks that the last response was signed
+func (v *tsigVerifier) done() error {
+	if v.pending > 0 {
+		return errors.New("last response is not signed with TSIG")
+	}
+	return nil
+}
+
+// variables returns the TSIG variables covered by the MAC of a request or of a first response
+func (t *tsigRecord) variables() []byte {
+	b := packName(t.name)
+	b = binary.BigEndian.AppendUint16(b, TSIG_CLASS)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = append(b, packName(t.algorithm)...)
+	b = append(b, t.timers()...)
+	b = binary.BigEndian.AppendUint16(b, t.err)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.other)))
+	return append(b, t.other...)
+}
+
+// timers returns the signing time and fudge, which are all the MAC of later responses covers
+func (t *tsigRecord) timers() []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(t.timeSigned>>32))
+	b = binary.BigEndian.AppendUint32(b, uint32(t.timeSigned))
+	return binary.BigEndian.AppendUint16(b, t.fudge)
+}
+
+// pack returns the TSIG resource record in wire format
+func (t *tsigRecord) pack() []byte {
+	rdata := packName(t.algorithm)
+	rdata = append(rdata, t.timers()...)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(t.mac)))
+	rdata = append(rdata, t.mac...)
+	rdata = binary.BigEndian.AppendUint16(rdata, t.originalID)
+	rdata = binary.BigEndian.AppendUint16(rdata, t.err)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(t.other)))
+	rdata = append(rdata, t.other...)
+
+	b := packName(t.name)
+	b = binary.BigEndian.AppendUint16(b, TSIG_TYPE)
+	b = binary.BigEndian.AppendUint16(b, TSIG_CLASS)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	return append(b, rdata...)
+}
+
+// findTSIG returns the offset and content of the TSIG record ending a message, nil if it has none
+func findTSIG(msg []byte) (int, *tsigRecord, error) {
+	if len(msg) < 12 {
+		return 0, nil, errors.New("DNS message too short")
+	}
+
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	records := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	additionals := int(binary.BigEndian.Uint16(msg[10:]))
+
+	offset := 12
+	var err error
+	for range questions {
+		if _, offset, err = readName(msg, offset); err != nil {
+			return 0, nil, err
+		}
+		offset += 4
+	}
+
+	for i := range records {
+		start := offset
+		var name string
+		if name, offset, err = readName(msg, offset); err != nil {
+			return 0, nil, err
+		}
+		if offset+10 > len(msg) {
+			return 0, nil, errors.New("DNS message truncated")
+		}
+		rrType := binary.BigEndian.Uint16(msg[offset:])
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+length > len(msg) {
+			return 0, nil, errors.New("DNS message truncated")
+		}
+
+		if rrType == TSIG_TYPE {
+			if i != records-1 || additionals == 0 {
+				return 0, nil, errors.New("TSIG record is not the last record of the message")
+			}
+			t, err := parseTSIG(msg, offset, length)
+			if err != nil {
+				return 0, nil, err
+			}
+			t.name = name
+			return start, t, nil
+		}
+		offset += length
+	}
+
+	return 0, nil, nil
+}
+
+// parseTSIG parses the content of a TSIG record
+func parseTSIG(msg []byte, offset, length int) (*tsigRecord, error) {
+	end := offset + length
+	t := &tsigRecord{}
+
+	var err error
+	if t.algorithm, offset, err = readName(msg, offset); err != nil {
+		return nil, err
+	}
+	if offset+10 > end {
+		return nil, errors.New("TSIG record truncated")
+	}
+	t.timeSigned = uint64(binary.BigEndian.Uint16(msg[offset:]))<<32 | uint64(binary.BigEndian.Uint32(msg[offset+2:]))
+	t.fudge = binary.BigEndian.Uint16(msg[offset+6:])
+	macSize := int(binary.BigEndian.Uint16(msg[offset+8:]))
+	offset += 10
+
+	if offset+macSize+6 > end {
+		return nil, errors.New("TSIG record truncated")
+	}
+	t.mac = msg[offset : offset+macSize]
+	offset += macSize
+	t.originalID = binary.BigEndian.Uint16(msg[offset:])
+	t.err = binary.BigEndian.Uint16(msg[offset+2:])
+	otherSize := int(binary.BigEndian.Uint16(msg[offset+4:]))
+	offset += 6
+
+	if offset+otherSize > end {
+		return nil, errors.New("TSIG record truncated")
+	}
+	t.other = msg[offset : offset+otherSize]
+	return t, nil
+}
+
+// tsigErrorName returns the name of a TSIG error code
+func tsigErrorName(code uint16) string {
+	switch code {
+	case TSIG_BADSIG:
+		return "BADSIG"
+	case TSIG_BADKEY:
+		return "BADKEY"
+	case TSIG_BADTIME:
+		return "BADTIME"
+	case TSIG_BADTRUNC:
+		return "BADTRUNC"
+	default:
+		return fmt.Sprintf("error %d", code)
+	}
+}
+
+// fqdn returns the lowercase fully qualified form of a name
+func fqdn(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
+
+// packName returns a fully qualified name in uncompressed, lowercase wire format
+func packName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readName reads a possibly compressed name at the offset and returns it in lowercase fully
+// qualified form, together with the offset following it
+func readName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errors.New("DNS name truncated")
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")) + ".", end, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(msg) || jumps > 10 {
+				return "", 0, errors.New("invalid DNS name compression")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+			jumps++
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errors.New("DNS name truncated")
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
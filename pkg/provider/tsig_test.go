@@ -0,0 +1,222 @@
+package provider
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goodieshq/cfdns/pkg/config"
+)
+
+// testTSIGSecret is the base64 encoded secret of the test key
+const testTSIGSecret = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+// testTSIGKey returns the HMAC-SHA256 key cfdns-key the test vectors are computed with
+func testTSIGKey(t *testing.T) *tsigKey {
+	t.Helper()
+	key, err := newTSIGKey(config.TSIG{Name: "cfdns-key", Algorithm: config.TSIG_HMAC_SHA256, Secret: testTSIGSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// appendTSIG appends a TSIG record to a message and counts it in the additional section
+func appendTSIG(msg []byte, rec tsigRecord) []byte {
+	signed := append(append([]byte(nil), msg...), rec.pack()...)
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])+1)
+	return signed
+}
+
+// signResponse signs a response like a server does (RFC 8945 section 5.3). The MAC covers the MAC
+// of the request or previous signed response, then either the first response with all TSIG
+// variables, or the unsigned messages since the previous signed response and this one with the timers.
+func signResponse(key *tsigKey, msg, prevMAC, unsigned []byte, first bool, now time.Time) ([]byte, []byte) {
+	rec := tsigRecord{
+		name:       key.name,
+		algorithm:  key.algorithm,
+		timeSigned: uint64(now.Unix()),
+		fudge:      TSIG_FUDGE,
+		originalID: binary.BigEndian.Uint16(msg),
+	}
+
+	mac := hmac.New(key.hash, key.secret)
+	mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(prevMAC))))
+	mac.Write(prevMAC)
+	if first {
+		mac.Write(msg)
+		mac.Write(rec.variables())
+	} else {
+		mac.Write(unsigned)
+		mac.Write(msg)
+		mac.Write(rec.timers())
+	}
+	rec.mac = mac.Sum(nil)
+	return appendTSIG(msg, rec), rec.mac
+}
+
+func TestTSIGSign(t *testing.T) {
+	// SOA query for example.com with ID 0x1234, signed at 2023-11-14T22:13:20Z
+	msg, _ := hex.DecodeString("123400000001000000000000" + "076578616d706c6503636f6d00" + "00060001")
+	original := bytes.Clone(msg)
+
+	// the MAC is HMAC-SHA256 over the message and the TSIG variables of RFC 8945 section 4.3.3
+	wantMAC := "f6a8f966dd63135bf05dac993acf53e117f552b5d89b7b132f2a476057af5aef"
+	want := "123400000001000000000001" + "076578616d706c6503636f6d00" + "00060001" +
+		"096366646e732d6b657900" + "00fa" + "00ff" + "00000000" + "003d" + // key name, type, class, TTL, rdata length
+		"0b686d61632d73686132353600" + "00006553f100" + "012c" + // algorithm, time signed, fudge
+		"0020" + wantMAC + "1234" + "0000" + "0000" // MAC, original ID, error, other length
+
+	signed, mac := testTSIGKey(t).sign(msg, time.Unix(1700000000, 0))
+	if got := hex.EncodeToString(mac); got != wantMAC {
+		t.Errorf("sign() MAC = %s, want %s", got, wantMAC)
+	}
+	if got := hex.EncodeToString(signed); got != want {
+		t.Errorf("sign() = %s, want %s", got, want)
+	}
+	if !bytes.Equal(msg, original) {
+		t.Error("sign() modified the message")
+	}
+}
+
+func TestTSIGVerify(t *testing.T) {
+	key := testTSIGKey(t)
+	now := time.Now()
+	requestMAC := bytes.Repeat([]byte{0xAB}, 32)
+	msg := buildMessage(t, 0x4321, Record{Type: "A", Name: "host.example.com", Content: "192.0.2.1"})
+
+	signed, _ := signResponse(key, msg, requestMAC, nil, true, now)
+	if err := key.verifier(requestMAC).verify(signed, now); err != nil {
+		t.Errorf("verify() = %v, want nil", err)
+	}
+
+	tampered := bytes.Clone(signed)
+	tampered[len(msg)-1] ^= 1
+	if err := key.verifier(requestMAC).verify(tampered, now); err == nil {
+		t.Error("verify() of a modified response = nil, want error")
+	}
+
+	if err := key.verifier(bytes.Repeat([]byte{0xCD}, 32)).verify(signed, now); err == nil {
+		t.Error("verify() of a response to another request = nil, want error")
+	}
+
+	if err := key.verifier(requestMAC).verify(signed, now.Add(time.Hour)); err == nil {
+		t.Error("verify() of an outdated response = nil, want error")
+	}
+
+	if err := key.verifier(requestMAC).verify(msg, now); err == nil {
+		t.Error("verify() of an unsigned response = nil, want error")
+	}
+
+	// a server rejecting the request answers with an error and an empty MAC
+	rejected := appendTSIG(msg, tsigRecord{
+		name:       key.name,
+		algorithm:  key.algorithm,
+		timeSigned: uint64(now.Unix()),
+		fudge:      TSIG_FUDGE,
+		originalID: 0x4321,
+		err:        TSIG_BADSIG,
+	})
+	if err := key.verifier(requestMAC).verify(rejected, now); err == nil || !strings.Contains(err.Error(), "BADSIG") {
+		t.Errorf("verify() = %v, want BADSIG error", err)
+	}
+}
+
+func TestTSIGVerifyAXFR(t *testing.T) {
+	key := testTSIGKey(t)
+	now := time.Now()
+	requestMAC := bytes.Repeat([]byte{0xAB}, 32)
+	msgs := make([][]byte, 4)
+	for i := range msgs {
+		msgs[i] = buildMessage(t, 0x4321, Record{Type: "A", Name: "host.example.com", Content: "192.0.2." + strconv.Itoa(i+1)})
+	}
+
+	// the first and last messages are signed, the last signature covers the unsigned ones before it
+	first, mac := signResponse(key, msgs[0], requestMAC, nil, true, now)
+	last, _ := signResponse(key, msgs[3], mac, append(bytes.Clone(msgs[1]), msgs[2]...), false, now)
+
+	v := key.verifier(requestMAC)
+	for i, msg := range [][]byte{first, msgs[1], msgs[2], last} {
+		if err := v.verify(msg, now); err != nil {
+			t.Fatalf("verify() of message %d = %v, want nil", i, err)
+		}
+	}
+	if err := v.done(); err != nil {
+		t.Errorf("done() = %v, want nil", err)
+	}
+
+	// a signature not covering the unsigned messages does not verify
+	skipped, _ := signResponse(key, msgs[3], mac, nil, false, now)
+	v = key.verifier(requestMAC)
+	for _, msg := range [][]byte{first, msgs[1], msgs[2]} {
+		if err := v.verify(msg, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := v.verify(skipped, now); err == nil {
+		t.Error("verify() of a signature skipping messages = nil, want error")
+	}
+
+	// the transfer must end with a signed message
+	v = key.verifier(requestMAC)
+	for _, msg := range [][]byte{first, msgs[1]} {
+		if err := v.verify(msg, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := v.done(); err == nil {
+		t.Error("done() after an unsigned message = nil, want error")
+	}
+
+	// at most 99 unsigned messages may follow each other
+	v = key.verifier(requestMAC)
+	if err := v.verify(first, now); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 99 {
+		if err := v.verify(msgs[1], now); err != nil {
+			t.Fatalf("verify() of unsigned message %d = %v, want nil", i+1, err)
+		}
+	}
+	if err := v.verify(msgs[1], now); err == nil {
+		t.Error("verify() of the 100th unsigned message = nil, want error")
+	}
+}
+
+func TestReadName(t *testing.T) {
+	header := make([]byte, 12)
+
+	// www.example.com compressed with a pointer to example.com at offset 12
+	msg := append(bytes.Clone(header), "\x07example\x03com\x00\x03WWW\xc0\x0c"...)
+	name, next, err := readName(msg, 25)
+	if err != nil || name != "www.example.com." || next != len(msg) {
+		t.Errorf("readName() = %q, %d, %v, want www.example.com., %d", name, next, err, len(msg))
+	}
+	if name, next, err := readName(msg, 12); err != nil || name != "example.com." || next != 25 {
+		t.Errorf("readName() = %q, %d, %v, want example.com., 25", name, next, err)
+	}
+
+	invalid := []struct {
+		name string
+		data string
+	}{
+		{"pointer to itself", "\xc0\x0c"},
+		{"pointer loop", "\xc0\x0e\xc0\x0c"},
+		{"pointer out of bounds", "\xc0\xff"},
+		{"truncated pointer", "\xc0"},
+		{"truncated label", "\x07exa"},
+		{"missing terminator", "\x03www"},
+		{"empty", ""},
+	}
+	for _, tt := range invalid {
+		msg := append(bytes.Clone(header), tt.data...)
+		if name, _, err := readName(msg, 12); err == nil {
+			t.Errorf("readName() of %s = %q, want error", tt.name, name)
+		}
+	}
+}